@@ -2,7 +2,6 @@ module github.com/iafisher/browser-engineering
 
 go 1.22.5
 
-require (
-	github.com/veandco/go-sdl2 v0.4.40 // indirect
-	github.com/visualfc/atk v1.2.3 // indirect
-)
+require github.com/veandco/go-sdl2 v0.4.40
+
+require github.com/visualfc/atk v1.2.3 // indirect
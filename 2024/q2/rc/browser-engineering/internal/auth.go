@@ -0,0 +1,631 @@
+package internal
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"slices"
+	"strings"
+	"sync"
+)
+
+type Credentials struct {
+	Username string
+	Password string
+}
+
+// Supplies credentials when a server asks for them, e.g., `Netrc` or the GUI's sign-in prompt.
+type CredentialProvider interface {
+	// `realm` is the server's description of what the credentials are for. Returns false if there are none.
+	Credentials(url Url, realm string) (Credentials, bool)
+}
+
+// One of the challenges in a WWW-Authenticate header (RFC 9110, section 11.6.1).
+type Challenge struct {
+	// lowercase, e.g., "basic"
+	Scheme string
+	// by lowercase name
+	Params map[string]string
+	// the rarely used alternative to parameters, e.g., for "Negotiate"
+	Token68 string
+}
+
+func (challenge Challenge) realm() string {
+	return challenge.Params["realm"]
+}
+
+// RFC 9110, section 11.6.1. The header's grammar lets a comma separate either two challenges or two parameters of the
+// same challenge; a token followed by '=' is a parameter, and anything else starts a new challenge. Malformed
+// parameters are skipped, and if a parameter appears more than once, the first occurrence wins.
+func parseChallenges(values []string) []Challenge {
+	challenges := []Challenge{}
+	rest := strings.Join(values, ",")
+	for {
+		rest = strings.TrimLeft(rest, ","+HTTP_WHITESPACE)
+		if rest == "" {
+			break
+		}
+
+		name, after := readHttpToken(rest)
+		if name == "" {
+			rest = skipToComma(rest)
+			continue
+		}
+
+		if !strings.HasPrefix(strings.TrimLeft(after, HTTP_WHITESPACE), "=") {
+			challenge := Challenge{Scheme: strings.ToLower(name), Params: map[string]string{}}
+			rest = after
+			// token68 must be separated from the scheme by a space, and is the challenge's only content
+			if strings.HasPrefix(after, " ") {
+				token68, remainder := readToken68(strings.TrimLeft(after, " "))
+				remainder = strings.TrimLeft(remainder, HTTP_WHITESPACE)
+				if token68 != "" && (remainder == "" || remainder[0] == ',') {
+					challenge.Token68 = token68
+					rest = remainder
+				}
+			}
+			challenges = append(challenges, challenge)
+			continue
+		}
+
+		value, remainder, ok := readAuthParamValue(after)
+		if !ok {
+			rest = skipToComma(after)
+			continue
+		}
+		rest = remainder
+
+		// a parameter before any scheme has nothing to belong to
+		if len(challenges) > 0 {
+			params := challenges[len(challenges)-1].Params
+			name = strings.ToLower(name)
+			if _, exists := params[name]; !exists {
+				params[name] = value
+			}
+		}
+	}
+	return challenges
+}
+
+// RFC 9110, section 11.2: a comma-separated list of parameters, as in the Authentication-Info header
+func parseAuthParams(text string) map[string]string {
+	params := map[string]string{}
+	rest := text
+	for {
+		rest = strings.TrimLeft(rest, ","+HTTP_WHITESPACE)
+		if rest == "" {
+			break
+		}
+
+		name, after := readHttpToken(rest)
+		value, remainder, ok := readAuthParamValue(after)
+		if name == "" || !ok {
+			rest = skipToComma(rest)
+			continue
+		}
+		rest = remainder
+
+		name = strings.ToLower(name)
+		if _, exists := params[name]; !exists {
+			params[name] = value
+		}
+	}
+	return params
+}
+
+// reads "= value" (where the value is a token or a quoted string) up to the next comma, returning false if it's
+// malformed
+func readAuthParamValue(text string) (string, string, bool) {
+	rest := strings.TrimLeft(text, HTTP_WHITESPACE)
+	if !strings.HasPrefix(rest, "=") {
+		return "", text, false
+	}
+	rest = strings.TrimLeft(rest[1:], HTTP_WHITESPACE)
+
+	var value string
+	if strings.HasPrefix(rest, "\"") {
+		value, rest = readHttpQuotedString(rest)
+	} else {
+		value, rest = readHttpToken(rest)
+		if value == "" {
+			return "", rest, false
+		}
+	}
+
+	rest = strings.TrimLeft(rest, HTTP_WHITESPACE)
+	if rest != "" && rest[0] != ',' {
+		return "", rest, false
+	}
+	return value, rest, true
+}
+
+// returns the longest prefix of `text` that is a token, and the rest
+func readHttpToken(text string) (string, string) {
+	i := 0
+	for i < len(text) && isHttpToken(text[i:i+1]) {
+		i++
+	}
+	return text[:i], text[i:]
+}
+
+// RFC 9110, section 11.2
+func readToken68(text string) (string, string) {
+	i := 0
+	for i < len(text) {
+		c := text[i]
+		isAlnum := ('a' <= c && c <= 'z') || ('A' <= c && c <= 'Z') || ('0' <= c && c <= '9')
+		if !isAlnum && !strings.ContainsRune("-._~+/", rune(c)) {
+			break
+		}
+		i++
+	}
+	if i == 0 {
+		return "", text
+	}
+	for i < len(text) && text[i] == '=' {
+		i++
+	}
+	return text[:i], text[i:]
+}
+
+func skipToComma(text string) string {
+	i := strings.Index(text, ",")
+	if i == -1 {
+		return ""
+	}
+	return text[i:]
+}
+
+// hash functions for Digest authentication (RFC 7616, section 6.1), strongest first
+var DIGEST_ALGORITHMS = []struct {
+	name    string
+	newHash func() hash.Hash
+}{
+	{"SHA-512-256", sha512.New512_256},
+	{"SHA-256", sha256.New},
+	{"MD5", md5.New},
+}
+
+// the index in `DIGEST_ALGORITHMS` of a Digest challenge's algorithm, and whether it's a "-sess" variant
+func digestAlgorithm(challenge Challenge) (int, bool, bool) {
+	name, ok := challenge.Params["algorithm"]
+	if !ok {
+		// RFC 7616, section 3.3: the default for compatibility with RFC 2617
+		name = "MD5"
+	}
+	base, sess := strings.CutSuffix(strings.ToUpper(name), "-SESS")
+	for i, algorithm := range DIGEST_ALGORITHMS {
+		if algorithm.name == base {
+			return i, sess, true
+		}
+	}
+	return 0, false, false
+}
+
+// picks the challenge we can answer most securely: Digest with the strongest hash, then Basic
+func chooseChallenge(challenges []Challenge) (Challenge, bool) {
+	best := -1
+	var chosen Challenge
+	for _, challenge := range challenges {
+		rank := -1
+		switch challenge.Scheme {
+		case "basic":
+			rank = 0
+		case "digest":
+			i, _, ok := digestAlgorithm(challenge)
+			if ok && challenge.Params["nonce"] != "" {
+				rank = len(DIGEST_ALGORITHMS) - i
+			}
+		}
+		if rank > best {
+			best = rank
+			chosen = challenge
+		}
+	}
+	return chosen, best >= 0
+}
+
+// RFC 7617, section 2
+func basicAuthorization(credentials Credentials) string {
+	return "Basic " + base64.StdEncoding.EncodeToString([]byte(credentials.Username+":"+credentials.Password))
+}
+
+// RFC 7616, section 3.4. `nonceCount` is how many requests (including this one) have used the challenge's nonce.
+func digestAuthorization(request *Request, challenge Challenge, credentials Credentials, nonceCount int, cnonce string) (string, error) {
+	algorithm, sess, ok := digestAlgorithm(challenge)
+	if !ok {
+		return "", fmt.Errorf("unsupported Digest algorithm: %q", challenge.Params["algorithm"])
+	}
+	h := func(text string) string {
+		digest := DIGEST_ALGORITHMS[algorithm].newHash()
+		digest.Write([]byte(text))
+		return hex.EncodeToString(digest.Sum(nil))
+	}
+
+	qop := ""
+	if offered, ok := challenge.Params["qop"]; ok {
+		options := strings.Split(offered, ",")
+		for i := range options {
+			options[i] = strings.ToLower(strings.TrimSpace(options[i]))
+		}
+		for _, option := range []string{"auth", "auth-int"} {
+			if qop == "" && slices.Contains(options, option) {
+				qop = option
+			}
+		}
+		if qop == "" {
+			return "", fmt.Errorf("unsupported Digest quality of protection: %q", offered)
+		}
+	}
+
+	realm := challenge.realm()
+	nonce := challenge.Params["nonce"]
+	nc := fmt.Sprintf("%08x", nonceCount)
+	uri := request.Url.requestTarget()
+
+	a1 := h(credentials.Username + ":" + realm + ":" + credentials.Password)
+	if sess {
+		a1 = h(a1 + ":" + nonce + ":" + cnonce)
+	}
+	a2 := h(request.Method + ":" + uri)
+	if qop == "auth-int" {
+		a2 = h(request.Method + ":" + uri + ":" + h(string(request.body)))
+	}
+
+	var response string
+	if qop == "" {
+		// RFC 2069, for servers that predate RFC 2617
+		response = h(a1 + ":" + nonce + ":" + a2)
+	} else {
+		response = h(a1 + ":" + nonce + ":" + nc + ":" + cnonce + ":" + qop + ":" + a2)
+	}
+
+	params := []string{}
+	userhash := strings.EqualFold(challenge.Params["userhash"], "true")
+	if userhash {
+		params = append(params, "username="+quoteHttpString(h(credentials.Username+":"+realm)))
+	} else if isHttpQuotedStringValue(credentials.Username) && isAscii(credentials.Username) {
+		params = append(params, "username="+quoteHttpString(credentials.Username))
+	} else {
+		// RFC 7616, section 3.4.4
+		params = append(params, "username*="+encodeExtValue(credentials.Username))
+	}
+	params = append(params, "realm="+quoteHttpString(realm), "uri="+quoteHttpString(uri))
+	if name, ok := challenge.Params["algorithm"]; ok {
+		params = append(params, "algorithm="+name)
+	}
+	params = append(params, "nonce="+quoteHttpString(nonce))
+	if qop != "" {
+		params = append(params, "nc="+nc, "cnonce="+quoteHttpString(cnonce), "qop="+qop)
+	}
+	params = append(params, "response="+quoteHttpString(response))
+	if opaque, ok := challenge.Params["opaque"]; ok {
+		params = append(params, "opaque="+quoteHttpString(opaque))
+	}
+	if userhash {
+		params = append(params, "userhash=true")
+	}
+	return "Digest " + strings.Join(params, ", "), nil
+}
+
+// RFC 8187, section 3.2
+func encodeExtValue(text string) string {
+	var sb strings.Builder
+	sb.WriteString("UTF-8''")
+	for i := 0; i < len(text); i++ {
+		c := text[i]
+		isAlnum := ('a' <= c && c <= 'z') || ('A' <= c && c <= 'Z') || ('0' <= c && c <= '9')
+		if isAlnum || strings.IndexByte("!#$&+-.^_`|~", c) != -1 {
+			sb.WriteByte(c)
+		} else {
+			fmt.Fprintf(&sb, "%%%02X", c)
+		}
+	}
+	return sb.String()
+}
+
+func newCnonce() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func quoteHttpString(text string) string {
+	var sb strings.Builder
+	sb.WriteString("\"")
+	for _, r := range text {
+		if r == '"' || r == '\\' {
+			sb.WriteRune('\\')
+		}
+		sb.WriteRune(r)
+	}
+	sb.WriteString("\"")
+	return sb.String()
+}
+
+// Credentials that servers have accepted, by protection space (RFC 9110, section 11.5), so that later requests can
+// send them without waiting to be challenged.
+type authCache struct {
+	mu sync.Mutex
+	// by origin and realm
+	entries map[string]*authEntry
+}
+
+type authEntry struct {
+	origin string
+	realm  string
+	// the paths that we assume are in the protection space, so that requests for them and anything below them get
+	// credentials up front
+	paths       []string
+	credentials Credentials
+	// the challenge that the credentials answer, which for Digest includes the current nonce
+	challenge  Challenge
+	nonceCount int
+}
+
+func newAuthCache() *authCache {
+	return &authCache{entries: make(map[string]*authEntry)}
+}
+
+func authCacheKey(origin string, realm string) string {
+	return origin + " " + realm
+}
+
+// the entry whose protection space most specifically covers `url`, or nil
+func (cache *authCache) lookup(url Url) *authEntry {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+
+	origin := url.Origin()
+	var best *authEntry
+	bestLength := -1
+	for _, entry := range cache.entries {
+		if entry.origin != origin {
+			continue
+		}
+		for _, path := range entry.paths {
+			if strings.HasPrefix(url.Path, path) && len(path) > bestLength {
+				best = entry
+				bestLength = len(path)
+			}
+		}
+	}
+	return best
+}
+
+// the credentials for the protection space that `url` and `realm` identify, if we have them
+func (cache *authCache) credentialsFor(url Url, realm string) (Credentials, bool) {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+
+	entry, ok := cache.entries[authCacheKey(url.Origin(), realm)]
+	if !ok {
+		return Credentials{}, false
+	}
+	return entry.credentials, true
+}
+
+// the credentials in `entry`, if it is for the same protection space as `challenge`
+func (cache *authCache) credentialsIn(entry *authEntry, challenge Challenge) (Credentials, bool) {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+
+	if entry.realm != challenge.realm() {
+		return Credentials{}, false
+	}
+	return entry.credentials, true
+}
+
+// records that `credentials` are to be used to answer `challenge` for `url` and the URLs around it
+func (cache *authCache) store(url Url, challenge Challenge, credentials Credentials) *authEntry {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+
+	origin := url.Origin()
+	key := authCacheKey(origin, challenge.realm())
+	entry, ok := cache.entries[key]
+	if !ok {
+		entry = &authEntry{origin: origin, realm: challenge.realm()}
+		cache.entries[key] = entry
+	}
+	if entry.challenge.Params["nonce"] != challenge.Params["nonce"] {
+		entry.nonceCount = 0
+	}
+	entry.challenge = challenge
+	entry.credentials = credentials
+
+	for _, path := range protectionSpacePaths(url, challenge) {
+		if !slices.Contains(entry.paths, path) {
+			entry.paths = append(entry.paths, path)
+		}
+	}
+	return entry
+}
+
+// forgets credentials that the server rejected
+func (cache *authCache) remove(entry *authEntry) {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+
+	key := authCacheKey(entry.origin, entry.realm)
+	if cache.entries[key] == entry {
+		delete(cache.entries, key)
+	}
+}
+
+// a copy of `request` with an Authorization header from `entry`
+func (cache *authCache) authorize(request *Request, entry *authEntry) (*Request, error) {
+	cache.mu.Lock()
+	challenge, credentials := entry.challenge, entry.credentials
+	entry.nonceCount++
+	nonceCount := entry.nonceCount
+	cache.mu.Unlock()
+
+	var authorization string
+	if challenge.Scheme == "digest" {
+		var err error
+		authorization, err = digestAuthorization(request, challenge, credentials, nonceCount, newCnonce())
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		authorization = basicAuthorization(credentials)
+	}
+
+	r := request.clone()
+	r.Headers.Set("Authorization", authorization)
+	return r, nil
+}
+
+// RFC 7616, section 3.5: the server may tell us which nonce to use next
+func (cache *authCache) acknowledge(entry *authEntry, response *HttpResponse) {
+	info, ok := response.Headers.Lookup("authentication-info")
+	if !ok {
+		return
+	}
+	nextNonce, ok := parseAuthParams(info)["nextnonce"]
+	if !ok {
+		return
+	}
+
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	if entry.challenge.Scheme != "digest" {
+		return
+	}
+	params := map[string]string{}
+	for name, value := range entry.challenge.Params {
+		params[name] = value
+	}
+	params["nonce"] = nextNonce
+	entry.challenge = Challenge{Scheme: entry.challenge.Scheme, Params: params}
+	entry.nonceCount = 0
+}
+
+// RFC 7617, section 2.2: a Basic protection space is assumed to include everything at or below the directory of the
+// URL that was challenged. RFC 7616, section 3.3: a Digest challenge can list its protection space in the "domain"
+// parameter, and otherwise covers the whole origin.
+func protectionSpacePaths(requestUrl Url, challenge Challenge) []string {
+	if challenge.Scheme != "digest" {
+		return []string{requestUrl.Path[:strings.LastIndex(requestUrl.Path, "/")+1]}
+	}
+
+	domain := strings.Fields(challenge.Params["domain"])
+	if len(domain) == 0 {
+		return []string{"/"}
+	}
+	paths := []string{}
+	for _, ref := range domain {
+		resolved, err := requestUrl.Resolve(ref)
+		if err == nil && resolved.Origin() == requestUrl.Origin() {
+			paths = append(paths, resolved.Path)
+		}
+	}
+	return paths
+}
+
+// where to look for credentials when challenged, in order: the URL's userinfo, credentials already accepted for the
+// same protection space, and then each of `CredentialProviders`
+const (
+	CREDENTIALS_FROM_URL = iota
+	CREDENTIALS_FROM_CACHE
+	CREDENTIALS_FROM_PROVIDERS
+)
+
+// Looks for credentials starting with source number `next`. Returns the credentials and the source to try after
+// them.
+func (fetcher *UrlFetcher) findCredentials(url Url, realm string, next int) (Credentials, int, bool) {
+	for ; ; next++ {
+		switch {
+		case next == CREDENTIALS_FROM_URL:
+			if url.Username != "" || url.Password != "" {
+				return Credentials{Username: percentDecode(url.Username), Password: percentDecode(url.Password)}, next + 1, true
+			}
+		case next == CREDENTIALS_FROM_CACHE:
+			credentials, ok := fetcher.auth.credentialsFor(url, realm)
+			if ok {
+				return credentials, next + 1, true
+			}
+		case next-CREDENTIALS_FROM_PROVIDERS < len(fetcher.CredentialProviders):
+			credentials, ok := fetcher.CredentialProviders[next-CREDENTIALS_FROM_PROVIDERS].Credentials(url, realm)
+			if ok {
+				return credentials, next + 1, true
+			}
+		default:
+			return Credentials{}, next, false
+		}
+	}
+}
+
+// Sends credentials up front if an earlier request to the same protection space needed them, and otherwise answers
+// a 401 response by retrying with credentials (see `findCredentials`). If none of them work, the last 401 response
+// is returned.
+func (fetcher *UrlFetcher) fetchHttpAuthenticated(ctx context.Context, request *Request) (*HttpResponse, error) {
+	// the caller is handling authentication itself
+	if request.Headers.Has("authorization") {
+		return fetcher.fetchHttpCached(ctx, request)
+	}
+
+	url := request.Url
+	entry := fetcher.auth.lookup(url)
+	nextSource := CREDENTIALS_FROM_URL
+	retriedStale := false
+	for {
+		attempt := request
+		if entry != nil {
+			var err error
+			attempt, err = fetcher.auth.authorize(request, entry)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		r, err := fetcher.fetchHttpCached(ctx, attempt)
+		if err != nil {
+			return nil, err
+		}
+		if r.Status != 401 {
+			if entry != nil {
+				fetcher.auth.acknowledge(entry, r)
+			}
+			return r, nil
+		}
+
+		challenge, ok := chooseChallenge(parseChallenges(r.Headers.Values("www-authenticate")))
+		if !ok {
+			PrintVerbose(fmt.Sprintf("no supported authentication scheme for %s", url.String()))
+			return r, nil
+		}
+
+		if entry != nil {
+			previous, sameSpace := fetcher.auth.credentialsIn(entry, challenge)
+			// RFC 7616, section 3.3: the credentials were fine, but the nonce has expired
+			if sameSpace && challenge.Scheme == "digest" && strings.EqualFold(challenge.Params["stale"], "true") && !retriedStale {
+				PrintVerbose(fmt.Sprintf("nonce for %s is stale; retrying with a new one", url.String()))
+				retriedStale = true
+				entry = fetcher.auth.store(url, challenge, previous)
+				r.discardBody()
+				continue
+			}
+			if sameSpace {
+				// the server rejected them
+				fetcher.auth.remove(entry)
+			}
+		}
+
+		credentials, next, ok := fetcher.findCredentials(url, challenge.realm(), nextSource)
+		if !ok {
+			return r, nil
+		}
+		nextSource = next
+		PrintVerbose(fmt.Sprintf("authenticating to %s (realm %q) with %s", url.Origin(), challenge.realm(), challenge.Scheme))
+		entry = fetcher.auth.store(url, challenge, credentials)
+		r.discardBody()
+	}
+}
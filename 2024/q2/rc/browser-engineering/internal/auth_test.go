@@ -0,0 +1,317 @@
+package internal
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+func TestParseChallenges(t *testing.T) {
+	testCases := []struct {
+		values   []string
+		expected string
+	}{
+		{[]string{`Basic realm="simple"`}, `basic{realm=simple}`},
+		{
+			[]string{`Digest realm="a, b", qop="auth,auth-int", nonce=abc, Basic realm=x`},
+			`digest{nonce=abc qop=auth,auth-int realm=a, b} basic{realm=x}`,
+		},
+		{[]string{`Basic realm="one"`, `Bearer`}, `basic{realm=one} bearer{}`},
+		{[]string{`Negotiate abc123==, Basic realm="x"`}, `negotiate[abc123==]{} basic{realm=x}`},
+		{[]string{`Basic REALM="first", realm="second"`}, `basic{realm=first}`},
+		{[]string{`Basic realm="escaped \"quote\""`}, `basic{realm=escaped "quote"}`},
+		// malformed parameters are skipped
+		{[]string{`Basic realm="x" junk, charset="UTF-8"`}, `basic{charset=UTF-8}`},
+		{[]string{`realm="orphan", Basic`}, `basic{}`},
+		{[]string{``}, ``},
+	}
+
+	for _, testCase := range testCases {
+		descriptions := []string{}
+		for _, challenge := range parseChallenges(testCase.values) {
+			params := []string{}
+			for name, value := range challenge.Params {
+				params = append(params, name+"="+value)
+			}
+			slices.Sort(params)
+			description := challenge.Scheme
+			if challenge.Token68 != "" {
+				description += "[" + challenge.Token68 + "]"
+			}
+			descriptions = append(descriptions, description+"{"+strings.Join(params, " ")+"}")
+		}
+		assertStrEqual(t, strings.Join(descriptions, " "), testCase.expected)
+	}
+}
+
+func TestChooseChallenge(t *testing.T) {
+	challenges := parseChallenges([]string{`Basic realm="x", Digest realm="x", nonce="1", Digest realm="x", nonce="2", algorithm=SHA-256, Digest realm="x", nonce="3", algorithm=UNKNOWN`})
+	challenge, ok := chooseChallenge(challenges)
+	if !ok {
+		t.Fatalf("expected a challenge to be chosen")
+	}
+	assertStrEqual(t, challenge.Params["nonce"], "2")
+
+	_, ok = chooseChallenge(parseChallenges([]string{"Bearer, Negotiate"}))
+	if ok {
+		t.Errorf("expected no supported challenge")
+	}
+}
+
+// the example from RFC 7616, section 3.9.1
+func TestDigestAuthorization(t *testing.T) {
+	url, err := ParseUrl("http://www.example.org/dir/index.html")
+	assertNoErr(t, err)
+	request := NewRequest("GET", url, nil)
+	credentials := Credentials{Username: "Mufasa", Password: "Circle of Life"}
+
+	testCases := []struct {
+		algorithm string
+		response  string
+	}{
+		{"MD5", "8ca523f5e9506fed4657c9700eebdbec"},
+		{"SHA-256", "753927fa0e85d155564e2e272a28d1802ca10daf4496794697cf8db5856cb6c1"},
+	}
+
+	for _, testCase := range testCases {
+		challenges := parseChallenges([]string{fmt.Sprintf(`Digest realm="http-auth@example.org", qop="auth, auth-int", algorithm=%s, nonce="7ypf/xlj9XXwfDPEoM4URrv/xwf94BcCAzFZH4GiTo0v", opaque="FQhe/qaU925kfnzjCev0ciny7QMkPqMAFRtzCUYo5tdS"`, testCase.algorithm)})
+		authorization, err := digestAuthorization(request, challenges[0], credentials, 1, "f2/wE4q74E6zIJEtWaHKaf5wv/H5QzzpXusqGemxURZJ")
+		assertNoErr(t, err)
+		expected := `Digest username="Mufasa", realm="http-auth@example.org", uri="/dir/index.html", ` +
+			`algorithm=` + testCase.algorithm + `, nonce="7ypf/xlj9XXwfDPEoM4URrv/xwf94BcCAzFZH4GiTo0v", nc=00000001, ` +
+			`cnonce="f2/wE4q74E6zIJEtWaHKaf5wv/H5QzzpXusqGemxURZJ", qop=auth, response="` + testCase.response + `", ` +
+			`opaque="FQhe/qaU925kfnzjCev0ciny7QMkPqMAFRtzCUYo5tdS"`
+		assertStrEqual(t, authorization, expected)
+	}
+
+	// RFC 7616, section 3.4.4
+	challenge := Challenge{Scheme: "digest", Params: map[string]string{"realm": "r", "nonce": "n"}}
+	authorization, err := digestAuthorization(request, challenge, Credentials{Username: "Jäsøn Doe"}, 1, "c")
+	assertNoErr(t, err)
+	if !strings.HasPrefix(authorization, "Digest username*=UTF-8''J%C3%A4s%C3%B8n%20Doe, ") {
+		t.Errorf("unexpected encoding of non-ASCII username: %s", authorization)
+	}
+}
+
+func TestBasicAuth(t *testing.T) {
+	var challenges atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasPrefix(r.URL.Path, "/private/") {
+			fmt.Fprintf(w, "authorization=%s", r.Header.Get("Authorization"))
+			return
+		}
+		username, password, ok := r.BasicAuth()
+		if !ok || username != "alice" || password != "secret" {
+			challenges.Add(1)
+			w.Header().Set("WWW-Authenticate", `Basic realm="private area"`)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		fmt.Fprintf(w, "hello %s", username)
+	}))
+	defer server.Close()
+
+	provider := &testCredentialProvider{credentials: Credentials{Username: "alice", Password: "secret"}}
+	fetcher := NewUrlFetcher()
+	fetcher.CredentialProviders = []CredentialProvider{provider}
+	defer fetcher.Cleanup()
+
+	r := fetchHttpForTest(t, &fetcher, strings.Replace(server.URL, "http://", "http://alice:secret@", 1)+"/private/a")
+	assertStrEqual(t, string(r.Body), "hello alice")
+	assertIntEqual(t, int(challenges.Load()), 1)
+
+	// the credentials are sent up front for the same directory, without asking the provider
+	r = fetchHttpForTest(t, &fetcher, server.URL+"/private/b")
+	assertStrEqual(t, string(r.Body), "hello alice")
+	assertIntEqual(t, int(challenges.Load()), 1)
+	assertIntEqual(t, len(provider.requests()), 0)
+
+	// but not outside of it
+	r = fetchHttpForTest(t, &fetcher, server.URL+"/public")
+	assertStrEqual(t, string(r.Body), "authorization=")
+
+	// wrong credentials
+	provider = &testCredentialProvider{credentials: Credentials{Username: "alice", Password: "wrong"}}
+	fetcher2 := NewUrlFetcher()
+	fetcher2.CredentialProviders = []CredentialProvider{provider}
+	defer fetcher2.Cleanup()
+	r = fetchHttpForTest(t, &fetcher2, server.URL+"/private/a")
+	assertIntEqual(t, r.Status, 401)
+	assertStrEqual(t, strings.Join(provider.requests(), ","), "private area")
+}
+
+func TestDigestAuth(t *testing.T) {
+	var mu sync.Mutex
+	nonce := "nonce-1"
+	uses := 0
+	counts := []string{}
+	h := func(text string) string {
+		digest := sha256.Sum256([]byte(text))
+		return hex.EncodeToString(digest[:])
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		challenge := func(stale bool) {
+			value := fmt.Sprintf(`Digest realm="digest area", qop="auth", algorithm=SHA-256, nonce="%s", opaque="xyz"`, nonce)
+			if stale {
+				value += ", stale=true"
+			}
+			w.Header().Add("WWW-Authenticate", `Basic realm="digest area"`)
+			w.Header().Add("WWW-Authenticate", value)
+			w.WriteHeader(http.StatusUnauthorized)
+		}
+
+		authorization, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Digest ")
+		if !ok {
+			challenge(false)
+			return
+		}
+		params := parseAuthParams(authorization)
+		a1 := h("alice:digest area:secret")
+		a2 := h(r.Method + ":" + params["uri"])
+		expected := h(a1 + ":" + params["nonce"] + ":" + params["nc"] + ":" + params["cnonce"] + ":auth:" + a2)
+		if params["response"] != expected || params["opaque"] != "xyz" || params["uri"] != r.URL.RequestURI() {
+			challenge(false)
+			return
+		}
+		if params["nonce"] != nonce {
+			challenge(true)
+			return
+		}
+
+		counts = append(counts, params["nc"])
+		uses++
+		// the nonce expires after two uses
+		if uses == 2 {
+			nonce = "nonce-2"
+		}
+		fmt.Fprintf(w, "welcome to %s", r.URL.Path)
+	}))
+	defer server.Close()
+
+	provider := &testCredentialProvider{credentials: Credentials{Username: "alice", Password: "secret"}}
+	fetcher := NewUrlFetcher()
+	fetcher.CredentialProviders = []CredentialProvider{provider}
+	defer fetcher.Cleanup()
+
+	for _, path := range []string{"/a", "/b/c", "/d"} {
+		r := fetchHttpForTest(t, &fetcher, server.URL+path)
+		assertIntEqual(t, r.Status, 200)
+		assertStrEqual(t, string(r.Body), "welcome to "+path)
+	}
+	assertStrEqual(t, strings.Join(provider.requests(), ","), "digest area")
+	assertStrEqual(t, strings.Join(counts, ","), "00000001,00000002,00000001")
+}
+
+// run with -race: concurrent fetches share the cached credentials and nonce
+func TestConcurrentDigestAuth(t *testing.T) {
+	var mu sync.Mutex
+	issued := map[string]bool{"nonce-0": true}
+	staleSent := map[string]bool{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		newNonce := func() string {
+			nonce := fmt.Sprintf("nonce-%d", len(issued))
+			issued[nonce] = true
+			return nonce
+		}
+		params := parseAuthParams(strings.TrimPrefix(r.Header.Get("Authorization"), "Digest "))
+		if !issued[params["nonce"]] || params["username"] != "alice" {
+			w.Header().Set("WWW-Authenticate", `Digest realm="area", qop="auth", nonce="nonce-0"`)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		// every path is told once that its nonce is stale
+		if !staleSent[r.URL.Path] {
+			staleSent[r.URL.Path] = true
+			w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Digest realm="area", qop="auth", nonce="%s", stale=true`, newNonce()))
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.Header().Set("Authentication-Info", fmt.Sprintf(`nextnonce="%s"`, newNonce()))
+		fmt.Fprint(w, r.URL.Path)
+	}))
+	defer server.Close()
+
+	fetcher := NewUrlFetcher()
+	fetcher.CredentialProviders = []CredentialProvider{&testCredentialProvider{credentials: Credentials{Username: "alice"}}}
+	defer fetcher.Cleanup()
+
+	urls := []Url{}
+	for i := 0; i < 8; i++ {
+		url, err := ParseUrl(fmt.Sprintf("%s/%d", server.URL, i))
+		assertNoErr(t, err)
+		urls = append(urls, url)
+	}
+	for i, result := range fetcher.FetchAll(urls) {
+		assertNoErr(t, result.Err)
+		assertStrEqual(t, string(result.Response.GetBody()), fmt.Sprintf("/%d", i))
+	}
+}
+
+func TestAuthorizationDroppedOnCrossOriginRedirect(t *testing.T) {
+	other := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "authorization=%s", r.Header.Get("Authorization"))
+	}))
+	defer other.Close()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/same-origin":
+			http.Redirect(w, r, "/echo", http.StatusFound)
+		case "/cross-origin":
+			http.Redirect(w, r, other.URL+"/echo", http.StatusFound)
+		default:
+			fmt.Fprintf(w, "authorization=%s", r.Header.Get("Authorization"))
+		}
+	}))
+	defer server.Close()
+
+	fetcher := NewUrlFetcher()
+	defer fetcher.Cleanup()
+
+	for _, testCase := range []struct{ path, expected string }{
+		{"/same-origin", "authorization=Bearer token"},
+		{"/cross-origin", "authorization="},
+	} {
+		url, err := ParseUrl(server.URL + testCase.path)
+		assertNoErr(t, err)
+		request := NewRequest("GET", url, nil)
+		request.Headers.Add("Authorization", "Bearer token")
+		r, err := fetcher.FetchRequest(context.Background(), request)
+		assertNoErr(t, err)
+		assertStrEqual(t, string(r.GetBody()), testCase.expected)
+	}
+}
+
+// always offers the same credentials, and records the realms it was asked about
+type testCredentialProvider struct {
+	credentials Credentials
+	mu          sync.Mutex
+	realms      []string
+}
+
+func (provider *testCredentialProvider) Credentials(url Url, realm string) (Credentials, bool) {
+	provider.mu.Lock()
+	defer provider.mu.Unlock()
+	provider.realms = append(provider.realms, realm)
+	return provider.credentials, true
+}
+
+func (provider *testCredentialProvider) requests() []string {
+	provider.mu.Lock()
+	defer provider.mu.Unlock()
+	return append([]string{}, provider.realms...)
+}
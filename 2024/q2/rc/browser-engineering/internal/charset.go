@@ -0,0 +1,556 @@
+package internal
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"unicode/utf16"
+	"unicode/utf8"
+)
+
+// names from the WHATWG Encoding standard
+const (
+	UTF_8        = "UTF-8"
+	UTF_16BE     = "UTF-16BE"
+	UTF_16LE     = "UTF-16LE"
+	WINDOWS_1252 = "windows-1252"
+)
+
+// WHATWG Encoding standard, section 4.2, for the encodings we can decode. (Labels for other encodings, like
+// Shift_JIS, are treated as unknown.)
+var ENCODING_LABELS = map[string]string{}
+
+func init() {
+	labels := map[string][]string{
+		UTF_8:         {"unicode-1-1-utf-8", "unicode11utf8", "unicode20utf8", "utf-8", "utf8", "x-unicode20utf8"},
+		UTF_16BE:      {"unicodefffe", "utf-16be"},
+		UTF_16LE:      {"csunicode", "iso-10646-ucs-2", "ucs-2", "unicode", "unicodefeff", "utf-16", "utf-16le"},
+		"windows-874": {"dos-874", "iso-8859-11", "iso8859-11", "iso885911", "tis-620", "windows-874"},
+		WINDOWS_1252: {
+			"ansi_x3.4-1968", "ascii", "cp1252", "cp819", "csisolatin1", "ibm819", "iso-8859-1", "iso-ir-100",
+			"iso8859-1", "iso88591", "iso_8859-1", "iso_8859-1:1987", "l1", "latin1", "us-ascii", "windows-1252",
+			"x-cp1252",
+		},
+		"windows-1254": {
+			"cp1254", "csisolatin5", "iso-8859-9", "iso-ir-148", "iso8859-9", "iso88599", "iso_8859-9",
+			"iso_8859-9:1989", "l5", "latin5", "windows-1254", "x-cp1254",
+		},
+		"ISO-8859-2": {"csisolatin2", "iso-8859-2", "iso-ir-101", "iso8859-2", "iso88592", "iso_8859-2", "iso_8859-2:1987", "l2", "latin2"},
+		"ISO-8859-3": {"csisolatin3", "iso-8859-3", "iso-ir-109", "iso8859-3", "iso88593", "iso_8859-3", "iso_8859-3:1988", "l3", "latin3"},
+		"ISO-8859-4": {"csisolatin4", "iso-8859-4", "iso-ir-110", "iso8859-4", "iso88594", "iso_8859-4", "iso_8859-4:1988", "l4", "latin4"},
+		"ISO-8859-5": {"csisolatincyrillic", "cyrillic", "iso-8859-5", "iso-ir-144", "iso8859-5", "iso88595", "iso_8859-5", "iso_8859-5:1988"},
+		"ISO-8859-6": {
+			"arabic", "asmo-708", "csiso88596e", "csiso88596i", "csisolatinarabic", "ecma-114", "iso-8859-6",
+			"iso-8859-6-e", "iso-8859-6-i", "iso-ir-127", "iso8859-6", "iso88596", "iso_8859-6", "iso_8859-6:1987",
+		},
+		"ISO-8859-7": {
+			"csisolatingreek", "ecma-118", "elot_928", "greek", "greek8", "iso-8859-7", "iso-ir-126", "iso8859-7",
+			"iso88597", "iso_8859-7", "iso_8859-7:1987", "sun_eu_greek",
+		},
+		"ISO-8859-8": {
+			"csiso88598e", "csisolatinhebrew", "hebrew", "iso-8859-8", "iso-8859-8-e", "iso-ir-138", "iso8859-8",
+			"iso88598", "iso_8859-8", "iso_8859-8:1988", "visual",
+		},
+		"ISO-8859-8-I": {"csiso88598i", "iso-8859-8-i", "logical"},
+		"ISO-8859-10":  {"csisolatin6", "iso-8859-10", "iso-ir-157", "iso8859-10", "iso885910", "l6", "latin6"},
+		"ISO-8859-13":  {"iso-8859-13", "iso8859-13", "iso885913"},
+		"ISO-8859-14":  {"iso-8859-14", "iso8859-14", "iso885914"},
+		"ISO-8859-15":  {"csisolatin9", "iso-8859-15", "iso8859-15", "iso885915", "iso_8859-15", "l9"},
+		"ISO-8859-16":  {"iso-8859-16"},
+	}
+	for name, aliases := range labels {
+		for _, label := range aliases {
+			ENCODING_LABELS[label] = name
+		}
+	}
+}
+
+// WHATWG Encoding standard, section 4.2 ("get an encoding"): the name of the encoding that `label` refers to, or
+// false if it's unknown or one we can't decode
+func lookupEncoding(label string) (string, bool) {
+	name, ok := ENCODING_LABELS[strings.ToLower(strings.Trim(label, ASCII_WHITESPACE))]
+	return name, ok
+}
+
+// Decodes `content` to UTF-8. As in the WHATWG Encoding standard's "decode" algorithm (section 6), a byte order mark
+// overrides `encoding` and is removed. Malformed input is replaced with U+FFFD.
+func decodeText(content []byte, encoding string) string {
+	if bomEncoding, length := sniffByteOrderMark(content); bomEncoding != "" {
+		encoding = bomEncoding
+		content = content[length:]
+	}
+	return decodeWithEncoding(content, encoding)
+}
+
+// like `decodeText`, but without looking for a byte order mark
+func decodeWithEncoding(content []byte, encoding string) string {
+	switch encoding {
+	case UTF_8:
+		return decodeUtf8(content)
+	case UTF_16BE, UTF_16LE:
+		return decodeUtf16(content, encoding == UTF_16BE)
+	}
+
+	table, ok := SINGLE_BYTE_ENCODINGS[strings.TrimSuffix(encoding, "-I")]
+	if !ok {
+		PrintVerbose(fmt.Sprintf("no decoder for %s; assuming UTF-8", encoding))
+		return decodeUtf8(content)
+	}
+
+	var sb strings.Builder
+	sb.Grow(len(content))
+	for _, b := range content {
+		if b < 0x80 {
+			sb.WriteByte(b)
+		} else {
+			sb.WriteRune(table[b-0x80])
+		}
+	}
+	return sb.String()
+}
+
+func sniffByteOrderMark(content []byte) (string, int) {
+	if bytes.HasPrefix(content, []byte{0xEF, 0xBB, 0xBF}) {
+		return UTF_8, 3
+	} else if bytes.HasPrefix(content, []byte{0xFE, 0xFF}) {
+		return UTF_16BE, 2
+	} else if bytes.HasPrefix(content, []byte{0xFF, 0xFE}) {
+		return UTF_16LE, 2
+	}
+	return "", 0
+}
+
+func decodeUtf8(content []byte) string {
+	if utf8.Valid(content) {
+		return string(content)
+	}
+
+	var sb strings.Builder
+	sb.Grow(len(content))
+	for len(content) > 0 {
+		r, width := utf8.DecodeRune(content)
+		sb.WriteRune(r)
+		content = content[width:]
+	}
+	return sb.String()
+}
+
+func decodeUtf16(content []byte, bigEndian bool) string {
+	units := make([]uint16, 0, len(content)/2)
+	for i := 0; i+1 < len(content); i += 2 {
+		if bigEndian {
+			units = append(units, uint16(content[i])<<8|uint16(content[i+1]))
+		} else {
+			units = append(units, uint16(content[i+1])<<8|uint16(content[i]))
+		}
+	}
+
+	// unpaired surrogates become U+FFFD
+	text := string(utf16.Decode(units))
+	if len(content)%2 == 1 {
+		text += string(utf8.RuneError)
+	}
+	return text
+}
+
+// how many bytes of an HTML document are searched for a <meta> tag that declares its encoding
+const ENCODING_PRESCAN_LENGTH = 1024
+
+// HTML standard, section 13.2.3.2 ("determining the character encoding"). `transportCharset` is the charset parameter
+// of the Content-Type header, if any; the <meta> prescan is only done for HTML.
+//
+// In place of the standard's locale-dependent default, a document that is valid UTF-8 is assumed to be UTF-8, and
+// anything else windows-1252.
+func sniffEncoding(content []byte, transportCharset string, isHtml bool) string {
+	if encoding, _ := sniffByteOrderMark(content); encoding != "" {
+		return encoding
+	}
+
+	if transportCharset != "" {
+		if encoding, ok := lookupEncoding(transportCharset); ok {
+			return encoding
+		}
+		PrintVerbose(fmt.Sprintf("unsupported charset in Content-Type: %q", transportCharset))
+	}
+
+	if isHtml {
+		if encoding, ok := prescanForEncoding(content); ok {
+			return encoding
+		}
+	}
+
+	if utf8.Valid(content) {
+		return UTF_8
+	}
+	return WINDOWS_1252
+}
+
+// DecodeText returns the body of `response` as UTF-8 text, and the encoding it was decoded from. A body that isn't
+// text (according to its Content-Type) is returned unchanged, with an empty encoding.
+func DecodeText(response GenericResponse) (string, string) {
+	content := response.GetBody()
+	mimeType, ok := response.GetContentType()
+	encoding := bodyEncoding(content, mimeType, ok)
+	if encoding == "" {
+		return string(content), ""
+	}
+	return decodeText(content, encoding), encoding
+}
+
+// the encoding of a body with the given Content-Type (if `hasType`), or an empty string if it isn't text. A body
+// without a type is assumed to be HTML.
+func bodyEncoding(content []byte, mimeType MimeType, hasType bool) string {
+	if !hasType {
+		return sniffEncoding(content, "", true)
+	}
+	if !isTextMimeType(mimeType) {
+		return ""
+	}
+	return sniffEncoding(content, mimeType.Charset(), mimeType.IsHtml())
+}
+
+// Decodes a body to UTF-8 as it arrives, for when it can't wait for the whole body (see `DecodeText`). The encoding is
+// settled once ENCODING_PRESCAN_LENGTH bytes have arrived or the body has ended, since that's as far as the <meta>
+// prescan looks.
+type textDecoder struct {
+	mimeType MimeType
+	hasType  bool
+	settled  bool
+	// empty if the body isn't text
+	encoding string
+	// bytes not yet decoded: everything until the encoding is settled, and after that any sequence cut off at the end
+	// of the last chunk
+	pending []byte
+}
+
+func newTextDecoder(mimeType MimeType, hasType bool) *textDecoder {
+	return &textDecoder{mimeType: mimeType, hasType: hasType}
+}
+
+// returns as much text as can be decoded so far
+func (d *textDecoder) Write(chunk []byte) string {
+	d.pending = append(d.pending, chunk...)
+	if !d.settled {
+		if len(d.pending) < ENCODING_PRESCAN_LENGTH {
+			return ""
+		}
+		d.settle(false)
+	}
+	return d.decode(false)
+}
+
+// returns the rest of the text, once the body has ended
+func (d *textDecoder) Flush() string {
+	if !d.settled {
+		d.settle(true)
+	}
+	return d.decode(true)
+}
+
+func (d *textDecoder) settle(final bool) {
+	content := d.pending
+	if !final {
+		// a sequence cut off at the end would otherwise look like invalid UTF-8
+		content = content[:completeUtf8Length(content)]
+	}
+	d.encoding = bodyEncoding(content, d.mimeType, d.hasType)
+	d.settled = true
+
+	if d.encoding != "" {
+		_, length := sniffByteOrderMark(d.pending)
+		d.pending = d.pending[length:]
+	}
+}
+
+func (d *textDecoder) decode(final bool) string {
+	length := len(d.pending)
+	if !final {
+		length = d.completeLength()
+	}
+	content := d.pending[:length]
+	d.pending = append([]byte(nil), d.pending[length:]...)
+
+	if d.encoding == "" {
+		return string(content)
+	}
+	return decodeWithEncoding(content, d.encoding)
+}
+
+// the length of `pending` without any character that's cut off at the end
+func (d *textDecoder) completeLength() int {
+	switch d.encoding {
+	case "":
+		return len(d.pending)
+	case UTF_16BE, UTF_16LE:
+		length := len(d.pending) - len(d.pending)%2
+		if length >= 2 {
+			unit := uint16(d.pending[length-2])<<8 | uint16(d.pending[length-1])
+			if d.encoding == UTF_16LE {
+				unit = uint16(d.pending[length-1])<<8 | uint16(d.pending[length-2])
+			}
+			if utf16.IsSurrogate(rune(unit)) && unit < 0xDC00 {
+				// the first half of a surrogate pair
+				length -= 2
+			}
+		}
+		return length
+	}
+
+	if _, ok := SINGLE_BYTE_ENCODINGS[strings.TrimSuffix(d.encoding, "-I")]; ok {
+		return len(d.pending)
+	}
+	return completeUtf8Length(d.pending)
+}
+
+// the length of `content` without any multi-byte sequence that's cut off at the end
+func completeUtf8Length(content []byte) int {
+	for i := len(content) - 1; i >= 0 && i > len(content)-utf8.UTFMax; i-- {
+		if utf8.RuneStart(content[i]) {
+			if !utf8.FullRune(content[i:]) {
+				return i
+			}
+			break
+		}
+	}
+	return len(content)
+}
+
+func isTextMimeType(mimeType MimeType) bool {
+	if mimeType.Type == "text" || strings.HasSuffix(mimeType.Subtype, "+xml") || strings.HasSuffix(mimeType.Subtype, "+json") {
+		return true
+	}
+	switch mimeType.Essence() {
+	case "application/xml", "application/json", "application/javascript", "application/ecmascript":
+		return true
+	}
+	return false
+}
+
+// HTML standard, section 13.2.3.2 ("prescan a byte stream to determine its encoding")
+func prescanForEncoding(content []byte) (string, bool) {
+	if len(content) > ENCODING_PRESCAN_LENGTH {
+		content = content[:ENCODING_PRESCAN_LENGTH]
+	}
+
+	p := 0
+	for p < len(content) {
+		rest := content[p:]
+		if bytes.HasPrefix(rest, []byte("<!--")) {
+			// the "-->" may share its dashes with the "<!--"
+			end := bytes.Index(content[p+2:], []byte("-->"))
+			if end == -1 {
+				break
+			}
+			p += 2 + end + 3
+		} else if hasPrefixFold(rest, "<meta") && len(rest) > 5 && isPrescanSpaceOrSlash(rest[5]) {
+			p += 6
+			encoding, next, ok := prescanMetaTag(content, p)
+			if ok {
+				return encoding, true
+			}
+			p = next
+		} else if len(rest) > 1 && rest[0] == '<' && (isAsciiLetter(rest[1]) || (rest[1] == '/' && len(rest) > 2 && isAsciiLetter(rest[2]))) {
+			// skip the tag name and attributes of any other tag
+			for p < len(content) && !isPrescanWhitespace(content[p]) && content[p] != '>' {
+				p++
+			}
+			for {
+				var ok bool
+				_, _, p, ok = prescanAttribute(content, p)
+				if !ok {
+					break
+				}
+			}
+		} else if bytes.HasPrefix(rest, []byte("<!")) || bytes.HasPrefix(rest, []byte("</")) || bytes.HasPrefix(rest, []byte("<?")) {
+			end := bytes.IndexByte(rest, '>')
+			if end == -1 {
+				break
+			}
+			p += end + 1
+		} else {
+			p++
+		}
+	}
+	return "", false
+}
+
+// reads the attributes of a <meta> tag, starting at `p`, and returns the encoding it declares (if any) and the position
+// after the tag
+func prescanMetaTag(content []byte, p int) (string, int, bool) {
+	seen := map[string]bool{}
+	gotPragma := false
+	// "null" in the standard's terms, when neither attribute has been seen
+	needPragma, needPragmaKnown := false, false
+	charset := ""
+
+	for {
+		name, value, next, ok := prescanAttribute(content, p)
+		p = next
+		if !ok {
+			break
+		}
+		if seen[name] {
+			continue
+		}
+		seen[name] = true
+
+		switch name {
+		case "http-equiv":
+			if value == "content-type" {
+				gotPragma = true
+			}
+		case "content":
+			if charset == "" {
+				if label, ok := extractCharsetFromContent(value); ok {
+					charset = label
+					needPragma, needPragmaKnown = true, true
+				}
+			}
+		case "charset":
+			charset = value
+			needPragma, needPragmaKnown = false, true
+		}
+	}
+
+	if !needPragmaKnown || (needPragma && !gotPragma) {
+		return "", p, false
+	}
+	encoding, ok := lookupEncoding(charset)
+	if !ok {
+		return "", p, false
+	}
+	// a document that could be read well enough to find the <meta> can't really be UTF-16
+	if encoding == UTF_16BE || encoding == UTF_16LE {
+		encoding = UTF_8
+	}
+	return encoding, p, true
+}
+
+// HTML standard, section 13.2.3.2 ("get an attribute"). Names and values are lowercased. Returns false if there are no
+// more attributes in the tag, or the input ends first.
+func prescanAttribute(content []byte, p int) (string, string, int, bool) {
+	for p < len(content) && (isPrescanSpaceOrSlash(content[p])) {
+		p++
+	}
+	if p >= len(content) || content[p] == '>' {
+		return "", "", p, false
+	}
+
+	var name, value []byte
+	for {
+		if p >= len(content) {
+			return "", "", p, false
+		}
+		c := content[p]
+		if c == '=' && len(name) > 0 {
+			p++
+			break
+		} else if isPrescanWhitespace(c) {
+			for p < len(content) && isPrescanWhitespace(content[p]) {
+				p++
+			}
+			if p >= len(content) || content[p] != '=' {
+				return string(name), "", p, true
+			}
+			p++
+			break
+		} else if c == '/' || c == '>' {
+			return string(name), "", p, true
+		}
+		name = append(name, toAsciiLower(c))
+		p++
+	}
+
+	for p < len(content) && isPrescanWhitespace(content[p]) {
+		p++
+	}
+	if p >= len(content) {
+		return "", "", p, false
+	}
+
+	if quote := content[p]; quote == '"' || quote == '\'' {
+		p++
+		for {
+			if p >= len(content) {
+				return "", "", p, false
+			}
+			if content[p] == quote {
+				return string(name), string(value), p + 1, true
+			}
+			value = append(value, toAsciiLower(content[p]))
+			p++
+		}
+	}
+
+	if content[p] == '>' {
+		return string(name), "", p, true
+	}
+	for p < len(content) && !isPrescanWhitespace(content[p]) && content[p] != '>' {
+		value = append(value, toAsciiLower(content[p]))
+		p++
+	}
+	if p >= len(content) {
+		return "", "", p, false
+	}
+	return string(name), string(value), p, true
+}
+
+// HTML standard, section 2.5.5 ("extracting a character encoding from a meta element"), for values like
+// "text/html; charset=iso-8859-2"
+func extractCharsetFromContent(value string) (string, bool) {
+	rest := value
+	for {
+		i := strings.Index(strings.ToLower(rest), "charset")
+		if i == -1 {
+			return "", false
+		}
+		rest = strings.TrimLeft(rest[i+len("charset"):], ASCII_WHITESPACE)
+		if strings.HasPrefix(rest, "=") {
+			break
+		}
+	}
+
+	rest = strings.TrimLeft(rest[1:], ASCII_WHITESPACE)
+	if rest == "" {
+		return "", false
+	}
+	if quote := rest[0]; quote == '"' || quote == '\'' {
+		end := strings.IndexByte(rest[1:], quote)
+		if end == -1 {
+			return "", false
+		}
+		return rest[1 : end+1], true
+	}
+
+	end := strings.IndexAny(rest, ASCII_WHITESPACE+";")
+	if end == -1 {
+		end = len(rest)
+	}
+	if end == 0 {
+		return "", false
+	}
+	return rest[:end], true
+}
+
+func hasPrefixFold(content []byte, prefix string) bool {
+	return len(content) >= len(prefix) && strings.EqualFold(string(content[:len(prefix)]), prefix)
+}
+
+func isPrescanWhitespace(c byte) bool {
+	return c == '\t' || c == '\n' || c == '\f' || c == '\r' || c == ' '
+}
+
+func isPrescanSpaceOrSlash(c byte) bool {
+	return isPrescanWhitespace(c) || c == '/'
+}
+
+func isAsciiLetter(c byte) bool {
+	return ('a' <= c && c <= 'z') || ('A' <= c && c <= 'Z')
+}
+
+func toAsciiLower(c byte) byte {
+	if 'A' <= c && c <= 'Z' {
+		return c + ('a' - 'A')
+	}
+	return c
+}
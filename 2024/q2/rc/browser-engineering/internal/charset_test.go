@@ -0,0 +1,159 @@
+package internal
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestSniffEncoding(t *testing.T) {
+	testCases := []struct {
+		content  string
+		charset  string
+		isHtml   bool
+		expected string
+	}{
+		// a byte order mark beats everything else
+		{"\xEF\xBB\xBFhello", "iso-8859-2", true, UTF_8},
+		{"\xFF\xFEh\x00", "", true, UTF_16LE},
+		{"\xFE\xFF\x00h", "utf-8", true, UTF_16BE},
+		{"<meta charset=iso-8859-5>", " Latin1 ", true, WINDOWS_1252},
+		{"<meta charset=iso-8859-5>", "shift_jis", true, "ISO-8859-5"},
+		{`<!DOCTYPE html><html><head><meta charset="ISO-8859-2">`, "", true, "ISO-8859-2"},
+		{`<meta http-equiv="Content-Type" content="text/html; charset='koi8-r'"><meta charset=latin2>`, "", true, "ISO-8859-2"},
+		{`<meta http-equiv="Content-Type" content="text/html; charset=iso-8859-7">`, "", true, "ISO-8859-7"},
+		{`<META CONTENT="text/html; charset=iso-8859-7" HTTP-EQUIV="content-type">`, "", true, "ISO-8859-7"},
+		// "content" without "http-equiv" is ignored
+		{`<meta content="text/html; charset=iso-8859-7">`, "", true, UTF_8},
+		{`<meta charset="utf-16le">`, "", true, UTF_8},
+		{`<!-- <meta charset="iso-8859-2"> --><meta charset="iso-8859-3">`, "", true, "ISO-8859-3"},
+		{`<div title="<meta charset=iso-8859-2>"></div><meta charset=iso-8859-4>`, "", true, "ISO-8859-4"},
+		{`<metadata charset="iso-8859-2">`, "", true, UTF_8},
+		{strings.Repeat(" ", ENCODING_PRESCAN_LENGTH) + `<meta charset="iso-8859-2">`, "", true, UTF_8},
+		{`<meta charset="iso-8859-2">`, "", false, UTF_8},
+		{"caf\xE9", "", true, WINDOWS_1252},
+		{"café", "", true, UTF_8},
+	}
+
+	for _, testCase := range testCases {
+		actual := sniffEncoding([]byte(testCase.content), testCase.charset, testCase.isHtml)
+		if actual != testCase.expected {
+			t.Errorf("sniffEncoding(%q, %q): got %s, expected %s", testCase.content, testCase.charset, actual, testCase.expected)
+		}
+	}
+}
+
+func TestDecodeText(t *testing.T) {
+	testCases := []struct {
+		content  string
+		encoding string
+		expected string
+	}{
+		{"caf\xC3\xA9", UTF_8, "café"},
+		{"\xEF\xBB\xBFcaf\xC3\xA9", UTF_8, "café"},
+		{"bad \xFF byte", UTF_8, "bad � byte"},
+		{"\xFF\xFEh\x00\xE9\x00\x3D\xD8\x00\xDE", UTF_8, "hé😀"},
+		{"\x00h\x00\xE9\xD8\x3D\xDE\x00\x00", UTF_16BE, "hé😀�"},
+		{"\x80 caf\xE9 \x9D", WINDOWS_1252, "€ café \u009D"},
+		{"\xB1\xE8", "ISO-8859-2", "ąč"},
+		{"\xBF\xE0\xD8\xD2\xD5\xE2", "ISO-8859-5", "Привет"},
+		{"\xF9\xE5\xED", "ISO-8859-8-I", "שום"},
+		{"\xA4", "ISO-8859-15", "€"},
+		{"\xA1", "ISO-8859-6", "�"},
+		{"\xDD\xFD", "windows-1254", "İı"},
+	}
+
+	for _, testCase := range testCases {
+		assertStrEqual(t, decodeText([]byte(testCase.content), testCase.encoding), testCase.expected)
+	}
+}
+
+func TestDecodeResponseText(t *testing.T) {
+	testCases := []struct {
+		contentType string
+		body        string
+		expected    string
+		encoding    string
+	}{
+		{"text/html; charset=ISO-8859-1", "<p>caf\xE9</p>", "<p>café</p>", WINDOWS_1252},
+		{"application/json", "{\"caf\xE9\": 1}", "{\"café\": 1}", WINDOWS_1252},
+		{"", "<meta charset=latin2><p>\xB1</p>", "<meta charset=latin2><p>ą</p>", "ISO-8859-2"},
+		// binary content is left alone
+		{"image/png", "\x89PNG\xE9", "\x89PNG\xE9", ""},
+	}
+
+	for _, testCase := range testCases {
+		response := &HttpResponse{Body: []byte(testCase.body)}
+		if testCase.contentType != "" {
+			response.Headers.Add("Content-Type", testCase.contentType)
+		}
+		text, encoding := DecodeText(response)
+		assertStrEqual(t, text, testCase.expected)
+		assertStrEqual(t, encoding, testCase.encoding)
+	}
+}
+
+func TestTextDecoder(t *testing.T) {
+	padding := strings.Repeat("x", ENCODING_PRESCAN_LENGTH)
+	testCases := []struct {
+		contentType string
+		body        string
+	}{
+		{"text/html", "caf\xC3\xA9 \xF0\x9F\x98\x80 " + padding + " \xE2\x9C\x93"},
+		{"text/html", "caf\xE9" + padding + "\xE9"},
+		{"text/html", "caf\xE9"},
+		{"text/html", "caf\xC3"},
+		{"text/plain; charset=utf-16le", "\xFF\xFEh\x00\xE9\x00\x3D\xD8\x00\xDE" + strings.Repeat("x\x00", ENCODING_PRESCAN_LENGTH) + "\x3D\xD8"},
+		{"", "<meta charset=latin2><p>\xB1</p>" + padding + "\xE8"},
+		{"image/png", "\x89PNG\xC3"},
+	}
+
+	for _, testCase := range testCases {
+		response := &HttpResponse{Body: []byte(testCase.body)}
+		if testCase.contentType != "" {
+			response.Headers.Add("Content-Type", testCase.contentType)
+		}
+		expected, expectedEncoding := DecodeText(response)
+
+		// one byte at a time, so that every character is split up
+		mimeType, hasType := response.GetContentType()
+		decoder := newTextDecoder(mimeType, hasType)
+		var text strings.Builder
+		for i := 0; i < len(testCase.body); i++ {
+			text.WriteString(decoder.Write([]byte{testCase.body[i]}))
+		}
+		text.WriteString(decoder.Flush())
+		assertStrEqual(t, text.String(), expected)
+		assertStrEqual(t, decoder.encoding, expectedEncoding)
+	}
+}
+
+func TestFetchLatin1Page(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/meta" {
+			w.Header().Set("Content-Type", "text/html")
+			w.Write([]byte("<meta charset=\"windows-1252\"><p>\x93quoted\x94</p>"))
+			return
+		}
+		w.Header().Set("Content-Type", "text/html; charset=iso-8859-1")
+		w.Write([]byte("<p>d\xE9j\xE0 vu</p>"))
+	}))
+	defer server.Close()
+
+	fetcher := NewUrlFetcher()
+	defer fetcher.Cleanup()
+
+	for _, testCase := range []struct{ path, expected string }{
+		{"/", "<p>déjà vu</p>"},
+		{"/meta", "<meta charset=\"windows-1252\"><p>“quoted”</p>"},
+	} {
+		url, err := ParseUrl(server.URL + testCase.path)
+		assertNoErr(t, err)
+		r, err := fetcher.Fetch(url)
+		assertNoErr(t, err)
+		text, encoding := DecodeText(r)
+		assertStrEqual(t, text, testCase.expected)
+		assertStrEqual(t, encoding, WINDOWS_1252)
+	}
+}
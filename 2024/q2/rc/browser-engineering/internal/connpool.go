@@ -0,0 +1,213 @@
+package internal
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// Connections are checked out of the pool for the duration of a single request and response, and then either checked
+// back in (if they can be reused) or closed. Nothing else may use a connection while it is checked out.
+type connPool struct {
+	mu sync.Mutex
+	// signalled whenever a connection is checked in or closed, so that goroutines waiting for a free slot can retry
+	cond *sync.Cond
+	// idle connections by address (see `connRoute.key`), least recently used first
+	idle map[string][]*httpConn
+	// number of checked-out connections by address
+	active map[string]int
+}
+
+// the buffered reader lives as long as the connection does, so that bytes read past the end of one response are not
+// lost before the next response is read
+type httpConn struct {
+	conn     net.Conn
+	reader   *bufio.Reader
+	lastUsed time.Time
+	// nil for plain TCP connections
+	tlsInfo *TlsInfo
+	// set if requests on this connection go to an HTTP proxy that forwards them, rather than to the server itself
+	forwardingProxy *Url
+}
+
+func newConnPool() *connPool {
+	pool := &connPool{idle: make(map[string][]*httpConn), active: make(map[string]int)}
+	pool.cond = sync.NewCond(&pool.mu)
+	return pool
+}
+
+// Cleanup closes all idle connections. Connections in use by in-progress fetches are unaffected.
+func (fetcher *UrlFetcher) Cleanup() {
+	pool := fetcher.conns
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+
+	for address, idle := range pool.idle {
+		for _, c := range idle {
+			c.conn.Close()
+		}
+		delete(pool.idle, address)
+	}
+}
+
+// Checks out an idle connection for `route` if there is one, or else opens a new one, waiting first if there are
+// already `MaxConnsPerHost` connections in use. The second return value is true if the connection was reused.
+//
+// The connection must be handed back with `releaseConnection` or `closeConnection`, using `route.key()` as the
+// address.
+func (fetcher *UrlFetcher) openConnection(ctx context.Context, route connRoute) (*httpConn, bool, error) {
+	pool := fetcher.conns
+	address := route.key()
+	// wake up the loop below if the context is cancelled while we're waiting
+	stop := context.AfterFunc(ctx, func() {
+		pool.mu.Lock()
+		pool.cond.Broadcast()
+		pool.mu.Unlock()
+	})
+	defer stop()
+
+	pool.mu.Lock()
+	for {
+		if ctx.Err() != nil {
+			pool.mu.Unlock()
+			return nil, false, ctx.Err()
+		}
+
+		c := fetcher.takeIdleConnection(address)
+		if c != nil {
+			pool.active[address]++
+			pool.mu.Unlock()
+			PrintVerbose(fmt.Sprintf("using cached connection to %s", address))
+			return c, true, nil
+		}
+
+		if fetcher.MaxConnsPerHost <= 0 || pool.active[address] < fetcher.MaxConnsPerHost {
+			break
+		}
+
+		PrintVerbose(fmt.Sprintf("%d connection(s) to %s already in use; waiting", pool.active[address], address))
+		pool.cond.Wait()
+	}
+	// reserve the slot before dialing so that other goroutines don't exceed the limit in the meantime
+	pool.active[address]++
+	pool.mu.Unlock()
+
+	c, err := fetcher.dialConnection(ctx, route)
+	if err != nil {
+		fetcher.closeConnection(address, nil)
+		return nil, false, err
+	}
+	return c, false, nil
+}
+
+func (fetcher *UrlFetcher) dialConnection(ctx context.Context, route connRoute) (*httpConn, error) {
+	address, isTls := route.address, route.isTls
+	if isTls {
+		PrintVerbose(fmt.Sprintf("opening TLS connection to %s", route.key()))
+	} else {
+		PrintVerbose(fmt.Sprintf("opening TCP connection to %s", route.key()))
+	}
+
+	var conn net.Conn
+	var err error
+	if route.proxy == nil {
+		dialer := net.Dialer{Timeout: fetcher.DialTimeout}
+		conn, err = dialer.DialContext(ctx, "tcp", address)
+		if err != nil {
+			return nil, classifyTimeout(ctx, err, TIMEOUT_DIAL, fetcher.DialTimeout)
+		}
+	} else {
+		conn, err = fetcher.dialThroughProxy(ctx, route)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if isTls {
+		host, _, _ := net.SplitHostPort(address)
+		tlsConn := tls.Client(conn, fetcher.tlsConfigFor(host))
+
+		handshakeCtx := ctx
+		if fetcher.TlsHandshakeTimeout != 0 {
+			var cancel context.CancelFunc
+			handshakeCtx, cancel = context.WithTimeout(ctx, fetcher.TlsHandshakeTimeout)
+			defer cancel()
+		}
+
+		err = tlsConn.HandshakeContext(handshakeCtx)
+		if err != nil {
+			conn.Close()
+			if ctx.Err() == nil && handshakeCtx.Err() != nil {
+				return nil, &TimeoutError{Phase: TIMEOUT_TLS_HANDSHAKE, Timeout: fetcher.TlsHandshakeTimeout}
+			}
+			err = classifyTimeout(ctx, err, TIMEOUT_TLS_HANDSHAKE, fetcher.TlsHandshakeTimeout)
+			return nil, classifyCertificateError(host, err)
+		}
+
+		tlsInfo := newTlsInfo(tlsConn.ConnectionState())
+		PrintVerbose(fmt.Sprintf("negotiated %s with %s (%s)", tlsInfo.VersionName(), address, tlsInfo.CipherSuiteName()))
+		return &httpConn{conn: tlsConn, reader: bufio.NewReader(tlsConn), tlsInfo: tlsInfo}, nil
+	}
+
+	c := &httpConn{conn: conn, reader: bufio.NewReader(conn)}
+	if route.isForwarding() {
+		c.forwardingProxy = route.proxy
+	}
+	return c, nil
+}
+
+// must be called with the pool's lock held
+func (fetcher *UrlFetcher) takeIdleConnection(address string) *httpConn {
+	pool := fetcher.conns
+	idle := pool.idle[address]
+	if len(idle) == 0 {
+		return nil
+	}
+
+	c := idle[len(idle)-1]
+	if time.Since(c.lastUsed) > fetcher.IdleTimeout {
+		// the most recently used connection has expired, so all the others have too
+		PrintVerbose(fmt.Sprintf("evicting %d idle connection(s) to %s", len(idle), address))
+		for _, c := range idle {
+			c.conn.Close()
+		}
+		delete(pool.idle, address)
+		return nil
+	}
+
+	pool.idle[address] = idle[:len(idle)-1]
+	return c
+}
+
+// checks a connection back in so that it can be reused
+func (fetcher *UrlFetcher) releaseConnection(address string, c *httpConn) {
+	pool := fetcher.conns
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+
+	c.lastUsed = time.Now()
+	pool.idle[address] = append(pool.idle[address], c)
+	pool.active[address]--
+	pool.cond.Broadcast()
+}
+
+// closes a checked-out connection, which may be nil if dialing failed
+func (fetcher *UrlFetcher) closeConnection(address string, c *httpConn) {
+	if c != nil {
+		c.conn.Close()
+	}
+
+	pool := fetcher.conns
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+
+	pool.active[address]--
+	if pool.active[address] == 0 {
+		delete(pool.active, address)
+	}
+	pool.cond.Broadcast()
+}
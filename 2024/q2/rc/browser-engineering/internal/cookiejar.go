@@ -0,0 +1,470 @@
+package internal
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RFC 6265 (with the SameSite attribute from draft-ietf-httpbis-rfc6265bis)
+type Cookie struct {
+	Name  string
+	Value string
+	// lowercase and in ASCII form, without a leading dot
+	Domain string
+	// if set, the cookie is only sent to `Domain` itself, not its subdomains
+	HostOnly bool
+	Path     string
+	// zero for session cookies, which are discarded when the browser exits
+	Expires  time.Time
+	Secure   bool
+	HttpOnly bool
+	// "Strict", "Lax", "None", or empty if the attribute was absent
+	SameSite string
+	Created  time.Time
+}
+
+func (cookie *Cookie) isPersistent() bool {
+	return !cookie.Expires.IsZero()
+}
+
+func (cookie *Cookie) isExpired(now time.Time) bool {
+	return cookie.isPersistent() && !cookie.Expires.After(now)
+}
+
+// RFC 6265, section 5.3, step 11: a new cookie replaces an old one with the same name, domain and path
+func (cookie *Cookie) key() string {
+	return cookie.Domain + ";" + cookie.Path + ";" + cookie.Name
+}
+
+// A CookieJar stores the cookies set by servers and decides which ones to send back. It is safe for concurrent use.
+//
+// All requests made by the fetcher are top-level navigations initiated by the user, so the restrictions that the
+// SameSite attribute places on cross-site requests never apply; the attribute is only recorded.
+type CookieJar struct {
+	mu      sync.Mutex
+	cookies map[string]*Cookie
+	// where persistent cookies are saved, or empty if they aren't
+	FilePath string
+}
+
+func NewCookieJar() *CookieJar {
+	return &CookieJar{cookies: map[string]*Cookie{}}
+}
+
+// Loads the cookies saved in `filePath`, which is where `Save` will write them back to. A file that doesn't exist yet
+// is treated as an empty jar.
+func LoadCookieJar(filePath string) (*CookieJar, error) {
+	jar := NewCookieJar()
+	jar.FilePath = filePath
+
+	data, err := os.ReadFile(filePath)
+	if errors.Is(err, os.ErrNotExist) {
+		return jar, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("could not read cookie file: %w", err)
+	}
+
+	var cookies []*Cookie
+	err = json.Unmarshal(data, &cookies)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse cookie file %s: %w", filePath, err)
+	}
+
+	now := time.Now()
+	for _, cookie := range cookies {
+		if cookie.isPersistent() && !cookie.isExpired(now) {
+			jar.cookies[cookie.key()] = cookie
+		}
+	}
+	return jar, nil
+}
+
+// Writes the jar's persistent cookies to its file. Session cookies are not saved.
+func (jar *CookieJar) Save() error {
+	if jar.FilePath == "" {
+		return nil
+	}
+
+	cookies := []*Cookie{}
+	now := time.Now()
+	for _, cookie := range jar.Cookies() {
+		if cookie.isPersistent() && !cookie.isExpired(now) {
+			cookies = append(cookies, &cookie)
+		}
+	}
+
+	data, err := json.MarshalIndent(cookies, "", "  ")
+	if err != nil {
+		return err
+	}
+	// cookies are often credentials, so the file shouldn't be readable by other users
+	return os.WriteFile(jar.FilePath, data, 0o600)
+}
+
+// Returns a copy of every unexpired cookie in the jar, ordered by domain, then path, then name.
+func (jar *CookieJar) Cookies() []Cookie {
+	jar.mu.Lock()
+	defer jar.mu.Unlock()
+
+	now := time.Now()
+	cookies := []Cookie{}
+	for _, cookie := range jar.cookies {
+		if !cookie.isExpired(now) {
+			cookies = append(cookies, *cookie)
+		}
+	}
+	sort.Slice(cookies, func(i, j int) bool {
+		return cookies[i].key() < cookies[j].key()
+	})
+	return cookies
+}
+
+// Stores the cookies from the values of the Set-Cookie headers in a response to a request for `url` (RFC 6265,
+// section 5.3). Invalid cookies are ignored.
+func (jar *CookieJar) SetCookies(url Url, headerValues []string, now time.Time) {
+	jar.mu.Lock()
+	defer jar.mu.Unlock()
+
+	for _, headerValue := range headerValues {
+		cookie, err := parseSetCookie(url, headerValue, now)
+		if err != nil {
+			PrintVerbose(fmt.Sprintf("ignoring cookie from %s (%s): %s", url.Host, err.Error(), headerValue))
+			continue
+		}
+
+		old, ok := jar.cookies[cookie.key()]
+		if ok {
+			cookie.Created = old.Created
+		}
+
+		// an expiration date in the past is how servers delete cookies
+		if cookie.isExpired(now) {
+			delete(jar.cookies, cookie.key())
+		} else {
+			jar.cookies[cookie.key()] = cookie
+		}
+	}
+}
+
+// The value of the Cookie header to send with a request for `url`, or the empty string if no cookies apply (RFC 6265,
+// section 5.4).
+func (jar *CookieJar) CookieHeader(url Url, now time.Time) string {
+	jar.mu.Lock()
+	defer jar.mu.Unlock()
+
+	host := strings.ToLower(url.Host)
+	matching := []*Cookie{}
+	for key, cookie := range jar.cookies {
+		if cookie.isExpired(now) {
+			delete(jar.cookies, key)
+			continue
+		}
+
+		if cookie.HostOnly {
+			if host != cookie.Domain {
+				continue
+			}
+		} else if !domainMatches(host, cookie.Domain) {
+			continue
+		}
+
+		if !pathMatches(requestPath(url), cookie.Path) {
+			continue
+		}
+		if cookie.Secure && url.Scheme != "https" {
+			continue
+		}
+		matching = append(matching, cookie)
+	}
+
+	// cookies with longer paths are listed first, and ties go to the oldest cookie (and, so that the order is
+	// deterministic, then to the key)
+	sort.Slice(matching, func(i, j int) bool {
+		if len(matching[i].Path) != len(matching[j].Path) {
+			return len(matching[i].Path) > len(matching[j].Path)
+		}
+		if !matching[i].Created.Equal(matching[j].Created) {
+			return matching[i].Created.Before(matching[j].Created)
+		}
+		return matching[i].key() < matching[j].key()
+	})
+
+	pairs := []string{}
+	for _, cookie := range matching {
+		pairs = append(pairs, cookie.Name+"="+cookie.Value)
+	}
+	return strings.Join(pairs, "; ")
+}
+
+// RFC 6265, section 5.2
+func parseSetCookie(url Url, headerValue string, now time.Time) (*Cookie, error) {
+	nameValuePair, unparsedAttributes, _ := strings.Cut(headerValue, ";")
+	name, value, ok := strings.Cut(nameValuePair, "=")
+	if !ok {
+		return nil, errors.New("missing '='")
+	}
+	name = strings.TrimSpace(name)
+	value = strings.TrimSpace(value)
+	if name == "" {
+		return nil, errors.New("empty name")
+	}
+
+	host := strings.ToLower(url.Host)
+	cookie := &Cookie{Name: name, Value: value, Created: now}
+	domainAttribute := ""
+	pathAttribute := ""
+	// Max-Age takes precedence over Expires regardless of the order they appear in
+	var maxAgeExpires, expiresExpires time.Time
+	hasMaxAge := false
+
+	for _, attribute := range strings.Split(unparsedAttributes, ";") {
+		attributeName, attributeValue, _ := strings.Cut(attribute, "=")
+		attributeName = strings.TrimSpace(attributeName)
+		attributeValue = strings.TrimSpace(attributeValue)
+
+		switch strings.ToLower(attributeName) {
+		case "expires":
+			expires, ok := parseCookieDate(attributeValue)
+			if ok {
+				expiresExpires = expires
+			}
+		case "max-age":
+			if attributeValue == "" || !(attributeValue[0] == '-' || isAsciiDigit(attributeValue[0])) {
+				continue
+			}
+			seconds, err := strconv.ParseInt(attributeValue, 10, 64)
+			if err != nil && !errors.Is(err, strconv.ErrRange) {
+				continue
+			}
+			hasMaxAge = true
+			if seconds <= 0 {
+				// "the earliest representable date and time"
+				maxAgeExpires = time.Unix(0, 0)
+			} else {
+				maxAgeExpires = now.Add(time.Duration(min(seconds, MAX_DELTA_SECONDS)) * time.Second)
+			}
+		case "domain":
+			// the last Domain attribute wins, and a leading dot is ignored
+			domainAttribute = strings.ToLower(strings.TrimPrefix(attributeValue, "."))
+		case "path":
+			if strings.HasPrefix(attributeValue, "/") {
+				pathAttribute = attributeValue
+			} else {
+				pathAttribute = ""
+			}
+		case "secure":
+			cookie.Secure = true
+		case "httponly":
+			cookie.HttpOnly = true
+		case "samesite":
+			switch strings.ToLower(attributeValue) {
+			case "strict":
+				cookie.SameSite = "Strict"
+			case "lax":
+				cookie.SameSite = "Lax"
+			case "none":
+				cookie.SameSite = "None"
+			}
+		}
+	}
+
+	if hasMaxAge {
+		cookie.Expires = maxAgeExpires
+	} else {
+		cookie.Expires = expiresExpires
+	}
+
+	if domainAttribute != "" {
+		domain, err := hostToAscii(domainAttribute)
+		if err != nil {
+			return nil, fmt.Errorf("invalid domain: %w", err)
+		}
+		if !domainMatches(host, domain) {
+			return nil, fmt.Errorf("domain %s does not match host %s", domain, host)
+		}
+		// TODO: use the public suffix list to reject domains like "co.uk"; for now we only reject top-level domains
+		if !strings.Contains(domain, ".") && domain != host {
+			return nil, fmt.Errorf("domain %s is a public suffix", domain)
+		}
+		cookie.Domain = domain
+	} else {
+		cookie.Domain = host
+		cookie.HostOnly = true
+	}
+
+	if pathAttribute != "" {
+		cookie.Path = pathAttribute
+	} else {
+		cookie.Path = defaultCookiePath(requestPath(url))
+	}
+
+	// draft-ietf-httpbis-rfc6265bis, section 5.7: insecure sites can't set secure cookies, and cookies that are sent
+	// cross-site must be secure
+	if cookie.Secure && url.Scheme != "https" {
+		return nil, errors.New("Secure cookie set by insecure URL")
+	}
+	if cookie.SameSite == "None" && !cookie.Secure {
+		return nil, errors.New("SameSite=None cookie without Secure")
+	}
+
+	return cookie, nil
+}
+
+func requestPath(url Url) string {
+	if url.Path == "" {
+		return "/"
+	}
+	return url.Path
+}
+
+// RFC 6265, section 5.1.3
+func domainMatches(host string, domain string) bool {
+	if host == domain {
+		return true
+	}
+	// IP addresses only match themselves
+	return strings.HasSuffix(host, "."+domain) && net.ParseIP(host) == nil
+}
+
+// RFC 6265, section 5.1.4
+func pathMatches(path string, cookiePath string) bool {
+	if path == cookiePath {
+		return true
+	}
+	if !strings.HasPrefix(path, cookiePath) {
+		return false
+	}
+	return strings.HasSuffix(cookiePath, "/") || path[len(cookiePath)] == '/'
+}
+
+// RFC 6265, section 5.1.4: the directory of the request path
+func defaultCookiePath(path string) string {
+	if !strings.HasPrefix(path, "/") {
+		return "/"
+	}
+	i := strings.LastIndexByte(path, '/')
+	if i == 0 {
+		return "/"
+	}
+	return path[:i]
+}
+
+var COOKIE_MONTHS = []string{"jan", "feb", "mar", "apr", "may", "jun", "jul", "aug", "sep", "oct", "nov", "dec"}
+
+// RFC 6265, section 5.1.1. This is much more lenient than the HTTP-date format, since servers send all sorts of
+// things in the Expires attribute.
+func parseCookieDate(text string) (time.Time, bool) {
+	foundTime, foundDayOfMonth, foundMonth, foundYear := false, false, false, false
+	var hour, minute, second, dayOfMonth, year int
+	var month time.Month
+
+	for _, token := range strings.FieldsFunc(text, isCookieDateDelimiter) {
+		if !foundTime {
+			h, m, s, ok := parseCookieTime(token)
+			if ok {
+				hour, minute, second = h, m, s
+				foundTime = true
+				continue
+			}
+		}
+
+		if !foundDayOfMonth {
+			n, ok := parseLeadingDigits(token, 1, 2)
+			if ok {
+				dayOfMonth = n
+				foundDayOfMonth = true
+				continue
+			}
+		}
+
+		if !foundMonth && len(token) >= 3 {
+			prefix := strings.ToLower(token[:3])
+			for i, name := range COOKIE_MONTHS {
+				if prefix == name {
+					month = time.Month(i + 1)
+					foundMonth = true
+					break
+				}
+			}
+			if foundMonth {
+				continue
+			}
+		}
+
+		if !foundYear {
+			n, ok := parseLeadingDigits(token, 2, 4)
+			if ok {
+				year = n
+				foundYear = true
+				continue
+			}
+		}
+	}
+
+	if year >= 70 && year <= 99 {
+		year += 1900
+	} else if year >= 0 && year <= 69 {
+		year += 2000
+	}
+
+	if !foundTime || !foundDayOfMonth || !foundMonth || !foundYear {
+		return time.Time{}, false
+	}
+	if dayOfMonth < 1 || dayOfMonth > 31 || year < 1601 || hour > 23 || minute > 59 || second > 59 {
+		return time.Time{}, false
+	}
+
+	t := time.Date(year, month, dayOfMonth, hour, minute, second, 0, time.UTC)
+	// e.g., February 30th
+	if t.Day() != dayOfMonth {
+		return time.Time{}, false
+	}
+	return t, true
+}
+
+func isCookieDateDelimiter(r rune) bool {
+	return r == 0x09 || (r >= 0x20 && r <= 0x2f) || (r >= 0x3b && r <= 0x40) || (r >= 0x5b && r <= 0x60) || (r >= 0x7b && r <= 0x7e)
+}
+
+// hms-time = time-field ":" time-field ":" time-field, where each field is 1 or 2 digits (and anything may follow)
+func parseCookieTime(token string) (int, int, int, bool) {
+	fields := strings.SplitN(token, ":", 3)
+	if len(fields) != 3 {
+		return 0, 0, 0, false
+	}
+
+	hour, ok1 := parseExactDigits(fields[0], 1, 2)
+	minute, ok2 := parseExactDigits(fields[1], 1, 2)
+	second, ok3 := parseLeadingDigits(fields[2], 1, 2)
+	return hour, minute, second, ok1 && ok2 && ok3
+}
+
+// parses a token that starts with between `minDigits` and `maxDigits` digits, followed by anything that isn't a digit
+func parseLeadingDigits(token string, minDigits int, maxDigits int) (int, bool) {
+	i := 0
+	for i < len(token) && isAsciiDigit(token[i]) {
+		i++
+	}
+	if i < minDigits || i > maxDigits {
+		return 0, false
+	}
+	n, _ := strconv.Atoi(token[:i])
+	return n, true
+}
+
+func parseExactDigits(token string, minDigits int, maxDigits int) (int, bool) {
+	n, ok := parseLeadingDigits(token, minDigits, maxDigits)
+	return n, ok && len(token) <= maxDigits && isAsciiDigit(token[len(token)-1])
+}
+
+func isAsciiDigit(b byte) bool {
+	return b >= '0' && b <= '9'
+}
@@ -0,0 +1,179 @@
+package internal
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseSetCookie(t *testing.T) {
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	url, err := ParseUrl("https://www.example.com/docs/page.html")
+	assertNoErr(t, err)
+
+	cookie, err := parseSetCookie(url, "id=a3fWa; Expires=Wed, 21 Oct 2099 07:28:00 GMT; Secure; HttpOnly; SameSite=lax", now)
+	assertNoErr(t, err)
+	assertStrEqual(t, cookie.Name, "id")
+	assertStrEqual(t, cookie.Value, "a3fWa")
+	assertStrEqual(t, cookie.Domain, "www.example.com")
+	assertStrEqual(t, cookie.Path, "/docs")
+	assertStrEqual(t, cookie.SameSite, "Lax")
+	assertStrEqual(t, cookie.Expires.Format(time.RFC3339), "2099-10-21T07:28:00Z")
+	if !cookie.HostOnly || !cookie.Secure || !cookie.HttpOnly {
+		t.Errorf("expected host-only, secure, HTTP-only cookie: %+v", cookie)
+	}
+
+	// Max-Age wins over Expires, even if it comes first
+	cookie, err = parseSetCookie(url, "a=b; Max-Age=60; Expires=Wed, 21 Oct 2099 07:28:00 GMT; Domain=.Example.com; Path=/", now)
+	assertNoErr(t, err)
+	assertStrEqual(t, cookie.Expires.Format(time.RFC3339), "2024-05-01T12:01:00Z")
+	assertStrEqual(t, cookie.Domain, "example.com")
+	assertStrEqual(t, cookie.Path, "/")
+	if cookie.HostOnly {
+		t.Errorf("cookie with Domain attribute should not be host-only")
+	}
+
+	invalid := []string{
+		"noequals",
+		"=value",
+		"a=b; Domain=other.com",
+		"a=b; Domain=com",
+		"a=b; SameSite=None",
+	}
+	for _, header := range invalid {
+		_, err := parseSetCookie(url, header, now)
+		if err == nil {
+			t.Errorf("expected %q to be rejected", header)
+		}
+	}
+
+	insecureUrl, err := ParseUrl("http://www.example.com/")
+	assertNoErr(t, err)
+	_, err = parseSetCookie(insecureUrl, "a=b; Secure", now)
+	if err == nil {
+		t.Errorf("expected Secure cookie from http: URL to be rejected")
+	}
+}
+
+func TestParseCookieDate(t *testing.T) {
+	testCases := []struct {
+		input    string
+		expected string
+	}{
+		{"Wed, 21 Oct 2015 07:28:00 GMT", "2015-10-21T07:28:00Z"},
+		{"Wednesday, 21-Oct-15 07:28:00 GMT", "2015-10-21T07:28:00Z"},
+		{"Wed Oct 21 07:28:00 2015", "2015-10-21T07:28:00Z"},
+		{"21 October 1999 7:8:9", "1999-10-21T07:08:09Z"},
+		{"Sat, 30 Feb 2015 07:28:00 GMT", ""},
+		{"Wed, 21 Oct 2015", ""},
+		{"tomorrow", ""},
+	}
+
+	for _, testCase := range testCases {
+		actual, ok := parseCookieDate(testCase.input)
+		if testCase.expected == "" {
+			if ok {
+				t.Errorf("expected %q to be invalid, got %s", testCase.input, actual)
+			}
+			continue
+		}
+		if !ok {
+			t.Errorf("could not parse %q", testCase.input)
+			continue
+		}
+		assertStrEqual(t, actual.Format(time.RFC3339), testCase.expected)
+	}
+}
+
+func TestCookieHeader(t *testing.T) {
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	setUrl, err := ParseUrl("https://www.example.com/docs/")
+	assertNoErr(t, err)
+
+	jar := NewCookieJar()
+	jar.SetCookies(setUrl, []string{
+		"host=1",
+		"domain=2; Domain=example.com; Path=/",
+		"deep=3; Path=/docs/api",
+		"secure=4; Secure; Path=/",
+		"short=5; Max-Age=10; Path=/",
+	}, now)
+
+	testCases := []struct {
+		url      string
+		elapsed  time.Duration
+		expected string
+	}{
+		{"https://www.example.com/docs/api/x", 0, "deep=3; host=1; domain=2; secure=4; short=5"},
+		{"https://www.example.com/docs", 0, "host=1; domain=2; secure=4; short=5"},
+		{"https://www.example.com/docsfoo", 0, "domain=2; secure=4; short=5"},
+		{"http://www.example.com/", 0, "domain=2; short=5"},
+		// only the cookie with a Domain attribute is sent to other hosts in the domain
+		{"https://sub.example.com/", 0, "domain=2"},
+		{"https://www.example.com/", time.Minute, "domain=2; secure=4"},
+		{"https://notexample.com/", 0, ""},
+	}
+
+	for _, testCase := range testCases {
+		url, err := ParseUrl(testCase.url)
+		assertNoErr(t, err)
+		actual := jar.CookieHeader(url, now.Add(testCase.elapsed))
+		if actual != testCase.expected {
+			t.Errorf("cookies for %s: expected %q, got %q", testCase.url, testCase.expected, actual)
+		}
+	}
+
+	// an expiration date in the past deletes the cookie
+	jar.SetCookies(setUrl, []string{"host=; Expires=Thu, 01 Jan 1970 00:00:00 GMT"}, now)
+	assertStrEqual(t, jar.CookieHeader(setUrl, now), "domain=2; secure=4")
+}
+
+func TestCookieJarPersistence(t *testing.T) {
+	filePath := filepath.Join(t.TempDir(), "cookies.json")
+	jar, err := LoadCookieJar(filePath)
+	assertNoErr(t, err)
+
+	url, err := ParseUrl("http://example.com/")
+	assertNoErr(t, err)
+	jar.SetCookies(url, []string{"session=1", "persistent=2; Max-Age=3600"}, time.Now())
+	assertNoErr(t, jar.Save())
+
+	jar, err = LoadCookieJar(filePath)
+	assertNoErr(t, err)
+	assertStrEqual(t, jar.CookieHeader(url, time.Now()), "persistent=2")
+}
+
+func TestCookiesAreSentBack(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/login":
+			w.Header().Add("Set-Cookie", "user=alice; Path=/")
+			w.Header().Add("Set-Cookie", "theme=dark; Expires=Wed, 21 Oct 2099 07:28:00 GMT; Path=/")
+			http.Redirect(w, r, "/whoami", http.StatusFound)
+		case "/whoami":
+			w.Write([]byte(r.Header.Get("Cookie")))
+		}
+	}))
+	defer server.Close()
+
+	fetcher := NewUrlFetcher()
+	fetcher.Cookies = NewCookieJar()
+	defer fetcher.Cleanup()
+
+	url, err := ParseUrl(server.URL + "/login")
+	assertNoErr(t, err)
+	r, err := fetcher.Fetch(url)
+	assertNoErr(t, err)
+	assertStrEqual(t, string(r.GetBody()), "theme=dark; user=alice")
+
+	aboutUrl, err := ParseUrl("about:cookies")
+	assertNoErr(t, err)
+	r, err = fetcher.Fetch(aboutUrl)
+	assertNoErr(t, err)
+	if !strings.Contains(string(r.GetBody()), "theme=dark\n  domain: 127.0.0.1\n  path: /\n  expires: Wed, 21 Oct 2099 07:28:00 UTC") {
+		t.Errorf("unexpected about:cookies page: %s", string(r.GetBody()))
+	}
+}
@@ -3,7 +3,9 @@ package internal
 import (
 	"fmt"
 	"os"
+	"strings"
 	"time"
+	"unicode/utf8"
 
 	"github.com/veandco/go-sdl2/img"
 	"github.com/veandco/go-sdl2/sdl"
@@ -17,6 +19,8 @@ type Gui struct {
 	engine      Engine
 	displayList DisplayList
 	window      *sdl.Window
+	// the page being shown, which may still be loading
+	loader *PageLoader
 }
 
 type DisplayList struct {
@@ -45,25 +49,28 @@ func (gui *Gui) Init() error {
 	return nil
 }
 
-// raw passed on to Layout()
-func (gui *Gui) ShowTextPage(text string, raw bool) error {
-	var htmlTree *HtmlElement
-	if raw {
-		htmlTree = &HtmlElement{Text: text}
-	} else {
-		var htmlParser HtmlParser
-		htmlTree = htmlParser.Parse(text)
-	}
-
-	gui.engine = Engine{htmlTree: htmlTree, raw: raw}
-	gui.displayList = gui.engine.Layout(gui.Width, gui.Height)
-	gui.Draw()
+// Shows the page that `loader` is loading, painting whatever has arrived so far, until the user closes the window.
+// Pressing Escape stops the load and shows the page as it is.
+func (gui *Gui) ShowPage(loader *PageLoader) error {
+	gui.loader = loader
+	gui.engine = Engine{raw: loader.raw}
+	gui.updatePage()
 
 	gui.window.UpdateSurface()
 	gui.eventLoop()
 	return nil
 }
 
+// while the page is loading, it is laid out and painted again at most this often
+const LOADING_REPAINT_INTERVAL = 200 * time.Millisecond
+
+// lays out and paints what has been loaded of the page
+func (gui *Gui) updatePage() {
+	gui.engine.htmlTree = gui.loader.Document()
+	gui.displayList = gui.engine.Layout(gui.Width, gui.Height)
+	gui.Draw()
+}
+
 func (gui *Gui) Draw() error {
 	start := time.Now()
 	surface, err := gui.window.GetSurface()
@@ -93,6 +100,9 @@ func (gui *Gui) Draw() error {
 	if gui.displayList.MaxY > gui.Height {
 		gui.drawScrollbar(surface)
 	}
+	if gui.loader != nil && !gui.loader.Done() && gui.loader.Progress() >= 0 {
+		gui.drawProgressBar(surface, gui.loader.Progress())
+	}
 
 	timeElapsed := time.Since(start)
 	PrintVerbose(fmt.Sprintf("gui: redraw time: %d ms", timeElapsed.Milliseconds()))
@@ -120,6 +130,15 @@ func (gui *Gui) drawScrollbar(surface *sdl.Surface) {
 	surface.FillRect(&rect, color)
 }
 
+const PROGRESS_BAR_HEIGHT int32 = 3
+
+// drawn along the top of the window while the page is loading
+func (gui *Gui) drawProgressBar(surface *sdl.Surface, progress float32) {
+	rect := sdl.Rect{X: 0, Y: 0, W: int32(float32(gui.Width) * progress), H: PROGRESS_BAR_HEIGHT}
+	var color uint32 = 0x0000FF
+	surface.FillRect(&rect, color)
+}
+
 const EMOJI_PATH string = "assets/openmoji/"
 
 func (gui *Gui) drawEmoji(surface *sdl.Surface, x int32, y int32, content DisplayListItemEmoji) {
@@ -191,9 +210,131 @@ func (gui *Gui) scrollUp() {
 	gui.Draw()
 }
 
+type credentialPrompt struct {
+	url             Url
+	realm           string
+	username        string
+	password        string
+	editingPassword bool
+}
+
+func (prompt *credentialPrompt) String() string {
+	var builder strings.Builder
+	fmt.Fprintf(&builder, "Sign in to %s\n", prompt.url.Origin())
+	if prompt.realm != "" {
+		fmt.Fprintf(&builder, "The site says: %q\n", prompt.realm)
+	}
+	if prompt.url.Scheme != "https" {
+		builder.WriteString("Warning: this connection is not secure, so others may be able to see your password.\n")
+	}
+
+	usernameCursor, passwordCursor := "_", ""
+	if prompt.editingPassword {
+		usernameCursor, passwordCursor = "", "_"
+	}
+	fmt.Fprintf(&builder, "\nUsername: %s%s\n", prompt.username, usernameCursor)
+	fmt.Fprintf(&builder, "Password: %s%s\n", strings.Repeat("*", utf8.RuneCountInString(prompt.password)), passwordCursor)
+	builder.WriteString("\nPress Tab to switch fields, Enter to sign in, or Escape to cancel.\n")
+	return builder.String()
+}
+
+// Asks the user to sign in, so that the GUI can be one of `UrlFetcher.CredentialProviders`. Returns false if they
+// cancel.
+func (gui *Gui) Credentials(url Url, realm string) (Credentials, bool) {
+	if gui.window == nil {
+		return Credentials{}, false
+	}
+
+	previous := gui.engine
+	defer gui.restoreAfterPrompt(previous)
+
+	prompt := credentialPrompt{url: url, realm: realm}
+	sdl.StartTextInput()
+	defer sdl.StopTextInput()
+	gui.showPrompt(&prompt)
+
+	for {
+		for event := sdl.PollEvent(); event != nil; event = sdl.PollEvent() {
+			switch t := event.(type) {
+			case *sdl.TextInputEvent:
+				if prompt.editingPassword {
+					prompt.password += t.GetText()
+				} else {
+					prompt.username += t.GetText()
+				}
+			case *sdl.KeyboardEvent:
+				if t.State != sdl.PRESSED {
+					continue
+				}
+				switch t.Keysym.Scancode {
+				case sdl.SCANCODE_BACKSPACE:
+					if prompt.editingPassword {
+						prompt.password = trimLastRune(prompt.password)
+					} else {
+						prompt.username = trimLastRune(prompt.username)
+					}
+				case sdl.SCANCODE_TAB:
+					prompt.editingPassword = !prompt.editingPassword
+				case sdl.SCANCODE_RETURN:
+					if prompt.editingPassword {
+						return Credentials{Username: prompt.username, Password: prompt.password}, true
+					}
+					prompt.editingPassword = true
+				case sdl.SCANCODE_ESCAPE:
+					return Credentials{}, false
+				}
+			case *sdl.QuitEvent:
+				return Credentials{}, false
+			case *sdl.WindowEvent:
+				if t.Event == sdl.WINDOWEVENT_RESIZED {
+					gui.Width = t.Data1
+					gui.Height = t.Data2
+				}
+			}
+			gui.showPrompt(&prompt)
+		}
+		gui.window.UpdateSurface()
+		sdl.Delay(33)
+	}
+}
+
+// puts back what was shown before a prompt, which may be nothing if the prompt came up before any page was shown
+func (gui *Gui) restoreAfterPrompt(previous Engine) {
+	gui.engine = previous
+	if previous.htmlTree == nil {
+		gui.displayList = DisplayList{}
+		return
+	}
+	gui.displayList = gui.engine.Layout(gui.Width, gui.Height)
+}
+
+func (gui *Gui) showPrompt(prompt *credentialPrompt) {
+	gui.engine = Engine{htmlTree: &HtmlElement{Text: prompt.String()}, raw: true}
+	gui.Scroll = 0
+	gui.displayList = gui.engine.Layout(gui.Width, gui.Height)
+	gui.Draw()
+}
+
+func trimLastRune(s string) string {
+	_, size := utf8.DecodeLastRuneInString(s)
+	return s[:len(s)-size]
+}
+
 func (gui *Gui) eventLoop() {
+	// the page has changed since it was last painted
+	pageChanged := false
+	lastUpdate := time.Now()
 	running := true
 	for running {
+		if gui.loader != nil && gui.loader.Poll() {
+			pageChanged = true
+		}
+		if pageChanged && (gui.loader.Done() || time.Since(lastUpdate) >= LOADING_REPAINT_INTERVAL) {
+			gui.updatePage()
+			pageChanged = false
+			lastUpdate = time.Now()
+		}
+
 		for event := sdl.PollEvent(); event != nil; event = sdl.PollEvent() {
 			switch t := event.(type) {
 			case *sdl.KeyboardEvent:
@@ -203,6 +344,11 @@ func (gui *Gui) eventLoop() {
 					gui.scrollDown()
 				} else if t.Keysym.Scancode == sdl.SCANCODE_UP {
 					gui.scrollUp()
+				} else if t.Keysym.Scancode == sdl.SCANCODE_ESCAPE && t.State == sdl.PRESSED && !gui.loader.Done() {
+					// show the page as it is, without waiting for the rest
+					gui.loader.Stop()
+					gui.updatePage()
+					pageChanged = false
 				}
 			case *sdl.MouseWheelEvent:
 				// TODO: consider magnitude of Y (works fairly well even with this naive impl though)
@@ -0,0 +1,17 @@
+package internal
+
+import "testing"
+
+// the first credential prompt can come up while the page is still being fetched, before `ShowPage`
+func TestRestoreAfterPromptBeforePage(t *testing.T) {
+	gui := &Gui{Width: 800, Height: 600}
+	previous := gui.engine
+	gui.engine = Engine{htmlTree: &HtmlElement{Text: "Sign in"}, raw: true}
+	gui.restoreAfterPrompt(previous)
+	if gui.engine.htmlTree != nil || len(gui.displayList.Items) != 0 {
+		t.Errorf("expected nothing to be shown, got %d item(s)", len(gui.displayList.Items))
+	}
+
+	engine := Engine{}
+	assertIntEqual(t, len(engine.Layout(800, 600).Items), 0)
+}
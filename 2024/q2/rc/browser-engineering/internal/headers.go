@@ -0,0 +1,106 @@
+package internal
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// A header field as it appeared in the message, with the name's original casing.
+type HeaderField struct {
+	Name  string
+	Value string
+}
+
+// The header fields of an HTTP message, in the order they were received. A name can occur more than once, and names
+// are compared case-insensitively (RFC 9110, section 5.1).
+type Headers []HeaderField
+
+// Returns the value of the first field named `name`, or the empty string if there is none. For fields that are
+// comma-separated lists (like Cache-Control), use `GetList` so that repeated fields aren't missed.
+func (headers Headers) Get(name string) string {
+	value, _ := headers.Lookup(name)
+	return value
+}
+
+// Like `Get`, but also reports whether the field was present at all.
+func (headers Headers) Lookup(name string) (string, bool) {
+	for _, field := range headers {
+		if strings.EqualFold(field.Name, name) {
+			return field.Value, true
+		}
+	}
+	return "", false
+}
+
+func (headers Headers) Has(name string) bool {
+	_, ok := headers.Lookup(name)
+	return ok
+}
+
+// Returns the values of every field named `name`, in order.
+func (headers Headers) Values(name string) []string {
+	values := []string{}
+	for _, field := range headers {
+		if strings.EqualFold(field.Name, name) {
+			values = append(values, field.Value)
+		}
+	}
+	return values
+}
+
+// RFC 9110, section 5.3: repeated fields are equivalent to a single field whose value is the comma-separated list of
+// their values. This must not be used for Set-Cookie, whose values can contain commas.
+func (headers Headers) GetList(name string) string {
+	return strings.Join(headers.Values(name), ", ")
+}
+
+// Returns every field, in order.
+func (headers Headers) All() []HeaderField {
+	return headers
+}
+
+func (headers *Headers) Add(name string, value string) {
+	*headers = append(*headers, HeaderField{Name: name, Value: value})
+}
+
+// Replaces any fields named `name` with a single field. The new field takes the place of the first old one, if there
+// was one.
+func (headers *Headers) Set(name string, value string) {
+	for i, field := range *headers {
+		if strings.EqualFold(field.Name, name) {
+			(*headers)[i] = HeaderField{Name: name, Value: value}
+			*headers = slices.Concat((*headers)[:i+1], (*headers)[i+1:].without(name))
+			return
+		}
+	}
+	headers.Add(name, value)
+}
+
+func (headers *Headers) Del(name string) {
+	*headers = headers.without(name)
+}
+
+func (headers Headers) without(name string) Headers {
+	r := Headers{}
+	for _, field := range headers {
+		if !strings.EqualFold(field.Name, name) {
+			r = append(r, field)
+		}
+	}
+	return r
+}
+
+// a copy that can be modified without affecting the original
+func (headers Headers) Clone() Headers {
+	return slices.Clone(headers)
+}
+
+// Formats the fields as they would appear on the wire, one per line.
+func (headers Headers) String() string {
+	var builder strings.Builder
+	for _, field := range headers {
+		fmt.Fprintf(&builder, "%s: %s\r\n", field.Name, field.Value)
+	}
+	return builder.String()
+}
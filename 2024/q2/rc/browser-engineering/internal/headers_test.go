@@ -0,0 +1,69 @@
+package internal
+
+import (
+	"bufio"
+	"strings"
+	"testing"
+)
+
+func TestHeaders(t *testing.T) {
+	headers := Headers{}
+	headers.Add("Content-Type", "text/html")
+	headers.Add("Set-Cookie", "a=1")
+	headers.Add("Vary", "Accept")
+	headers.Add("set-cookie", "b=2; Expires=Wed, 21 Oct 2099 07:28:00 GMT")
+	headers.Add("VARY", "Cookie")
+
+	assertStrEqual(t, headers.Get("content-type"), "text/html")
+	assertStrEqual(t, headers.Get("vary"), "Accept")
+	assertStrEqual(t, headers.GetList("vary"), "Accept, Cookie")
+	assertStrEqual(t, strings.Join(headers.Values("SET-COOKIE"), "|"), "a=1|b=2; Expires=Wed, 21 Oct 2099 07:28:00 GMT")
+	assertIntEqual(t, len(headers.Values("missing")), 0)
+	if headers.Has("missing") {
+		t.Errorf("expected header to be missing")
+	}
+
+	headers.Set("set-cookie", "c=3")
+	headers.Del("vary")
+	assertStrEqual(t, headers.String(), "Content-Type: text/html\r\nset-cookie: c=3\r\n")
+}
+
+func TestReadHttpHeaders(t *testing.T) {
+	input := "Content-Type: text/html\r\nX-Folded: one\r\n  two\r\nSet-Cookie: a=1\r\nset-cookie:b=2 \r\n\r\n"
+	headers, err := readHttpHeaders(bufio.NewReader(strings.NewReader(input)), ResponseLimits{})
+	assertNoErr(t, err)
+
+	assertIntEqual(t, len(headers), 4)
+	assertStrEqual(t, headers[0].Name, "Content-Type")
+	assertStrEqual(t, headers[1].Value, "one two")
+	assertStrEqual(t, headers[3].Name, "set-cookie")
+	assertStrEqual(t, headers[3].Value, "b=2")
+
+	malformed := []string{
+		"no colon here\r\n\r\n",
+		"Space Before : colon\r\n\r\n",
+		" continuation first\r\n\r\n",
+		": empty name\r\n\r\n",
+	}
+	for _, input := range malformed {
+		_, err := readHttpHeaders(bufio.NewReader(strings.NewReader(input)), ResponseLimits{})
+		if err == nil {
+			t.Errorf("expected error for %q", input)
+		}
+	}
+}
+
+func TestParseContentLength(t *testing.T) {
+	n, err := parseContentLength([]string{"42", "42, 42"})
+	assertNoErr(t, err)
+	assertIntEqual(t, n, 42)
+
+	_, err = parseContentLength([]string{"42", "43"})
+	if err == nil {
+		t.Errorf("expected error for conflicting Content-Length values")
+	}
+	_, err = parseContentLength([]string{"-1"})
+	if err == nil {
+		t.Errorf("expected error for negative Content-Length")
+	}
+}
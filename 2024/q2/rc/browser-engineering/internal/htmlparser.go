@@ -46,30 +46,100 @@ type HtmlParser struct {
 	tb                  TreeBuilder
 	disableImplicitTags bool
 	inScriptTag         bool
+	// set once the whole document has been fed to the parser
+	finished bool
+	// set when the parser runs into the end of the input (see `readTag`)
+	exhausted bool
 }
 
+// Parse parses a complete document. To parse a document as it arrives instead, pass each part of it to `Feed` and
+// then call `Finish`.
 func (p *HtmlParser) Parse(htmlText string) *HtmlElement {
-	p.text = htmlText
+	p.text = ""
 	p.index = 0
 	p.start = 0
 	p.tb = TreeBuilder{}
+	p.finished = false
+	p.Feed(htmlText)
+	return p.Finish()
+}
+
+// Feed parses the next part of a document. Anything at the end that can't be parsed yet, like a tag whose closing
+// bracket hasn't arrived, is held over until the next call.
+func (p *HtmlParser) Feed(chunk string) {
+	// everything before `start` is already in the tree
+	p.text = p.text[p.start:] + chunk
+	p.index -= p.start
+	p.start = 0
+	p.parse()
+}
+
+// Finish parses whatever is left of the document and returns it.
+func (p *HtmlParser) Finish() *HtmlElement {
+	p.finished = true
+	p.parse()
+	p.implicitTags("")
+	p.tb.Text(p.text[p.start:])
+	return p.tb.Tree()
+}
 
+// Snapshot returns a copy of the document as parsed so far, including any text that has been read but not yet added
+// to the tree. The parser can still be fed afterwards.
+func (p *HtmlParser) Snapshot() *HtmlElement {
+	root := copyTree(p.tb.root)
+	if len(p.tb.stack) > 0 {
+		// each open element is the last child of the one before it
+		current := &root
+		for range p.tb.stack[1:] {
+			current = &current.Children[len(current.Children)-1]
+		}
+		if text := p.text[p.start:p.index]; strings.TrimSpace(text) != "" {
+			current.Children = append(current.Children, HtmlElement{Text: text})
+		}
+	}
+	setParents(&root)
+	return &root
+}
+
+func (p *HtmlParser) parse() {
 	for !p.done() {
 		i := p.index
 		runeValue := p.ch()
-		if runeValue == '<' && (!p.inScriptTag || p.startsWith("/script>")) {
-			p.implicitTags("")
-			p.tb.Text(p.text[p.start:i])
-			p.readTag()
+		if runeValue != '<' {
+			continue
+		}
+
+		if p.inScriptTag && !p.startsWith("/script>") {
+			if !p.finished && strings.HasPrefix("/script>", p.text[p.index:]) {
+				// the rest of the closing tag may be in the next chunk
+				p.index = i
+				return
+			}
+			continue
+		}
+
+		p.implicitTags("")
+		p.tb.Text(p.text[p.start:i])
+		p.start = i
+		if !p.readTag() {
+			p.start = i
+			p.index = i
+			return
 		}
 	}
-	p.implicitTags("")
-	p.tb.Text(p.text[p.start:])
-	return p.tb.Tree()
 }
 
 func (p *HtmlParser) done() bool {
-	return p.index >= len(p.text)
+	if p.index >= len(p.text) {
+		p.exhausted = true
+		return true
+	}
+	return false
+}
+
+// whether the input ran out while reading the current tag, and more of it is still to come
+func (p *HtmlParser) cutOff() bool {
+	return p.exhausted && !p.finished
 }
 
 var SELF_CLOSING_TAGS = map[string]bool{
@@ -101,20 +171,26 @@ var HEAD_TAGS = map[string]bool{
 }
 
 // invariant: p.index sits on the character *after* the opening bracket
-func (p *HtmlParser) readTag() {
+//
+// Returns false, without touching the tree, if the tag is cut off by the end of the input.
+func (p *HtmlParser) readTag() bool {
+	p.exhausted = false
 	if p.startsWith("!--") {
 		p.readComment()
-		return
+		return !p.cutOff()
 	}
 
 	isClosing := p.chIf('/')
 	tag := p.readTagName()
 	attrs := p.readTagAttrs()
+	if p.cutOff() {
+		return false
+	}
 	p.start = p.index
 
 	// ignore <!doctype> declaration and comments
 	if strings.HasPrefix(tag, "!") {
-		return
+		return true
 	}
 
 	if tag == "script" {
@@ -130,6 +206,7 @@ func (p *HtmlParser) readTag() {
 			p.tb.Close(tag)
 		}
 	}
+	return true
 }
 
 func (p *HtmlParser) readComment() {
@@ -170,6 +247,9 @@ func (p *HtmlParser) readTagAttrs() map[string]string {
 	r := map[string]string{}
 	for {
 		p.skipWhitespace()
+		if p.done() {
+			break
+		}
 		isOver := p.chIf('>')
 		if isOver {
 			break
@@ -321,7 +401,7 @@ func (p *HtmlParser) startsWith(prefix string) bool {
 }
 
 func (p *HtmlParser) decodeOne() (rune, int) {
-	// TODO: don't assume UTF-8 encoding
+	// the document has already been decoded to UTF-8 (see `DecodeText` and `textDecoder`)
 	return utf8.DecodeRuneInString(p.text[p.index:])
 }
 
@@ -439,6 +519,15 @@ func (tb *TreeBuilder) findLastOpenTag(tagToSearch string, stopAt []string) int
 	return -1
 }
 
+func copyTree(elem HtmlElement) HtmlElement {
+	children := make([]HtmlElement, len(elem.Children))
+	for i, child := range elem.Children {
+		children[i] = copyTree(child)
+	}
+	elem.Children = children
+	return elem
+}
+
 func setParents(elem *HtmlElement) {
 	for i := range elem.Children {
 		elem.Children[i].Parent = elem
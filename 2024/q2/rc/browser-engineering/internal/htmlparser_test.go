@@ -128,6 +128,58 @@ func TestQuotedAttributes(t *testing.T) {
 	assertStrEqual(t, root.String(), "<div data-whatever=\"arbitrary data and <tag>s\"></div>")
 }
 
+func TestParseInChunks(t *testing.T) {
+	documents := []string{
+		"<!doctype html><html><head><title>Café</title></head><body><p class=\"x\">Hello<!-- a <b>comment</b> --> world</p></body></html>",
+		"<div data-whatever=\"arbitrary data and <tag>s\"><p>one<p>two ✓</div>",
+		"<script>x < 5 && x > 0</script><p>after</p>",
+		"<ul><li>one<li>two</ul>trailing text",
+	}
+
+	for _, document := range documents {
+		var parser HtmlParser
+		expected := parser.Parse(document).String()
+
+		// split the document at every possible place
+		for i := range document {
+			parser = HtmlParser{}
+			parser.Feed(document[:i])
+			parser.Snapshot()
+			parser.Feed(document[i:])
+			assertStrEqual(t, parser.Finish().String(), expected)
+		}
+
+		// and one character at a time
+		parser = HtmlParser{}
+		for _, r := range document {
+			parser.Feed(string(r))
+		}
+		assertStrEqual(t, parser.Finish().String(), expected)
+	}
+}
+
+func TestParseSnapshot(t *testing.T) {
+	parser := HtmlParser{disableImplicitTags: true}
+	parser.Feed("<div><p>Hello <b>wor")
+	snapshot := parser.Snapshot()
+	assertStrEqual(t, snapshot.String(), "<div><p>Hello <b>wor</b></p></div>")
+	bold := &snapshot.Children[0].Children[1]
+	assertParentEqual(t, bold, &snapshot.Children[0])
+
+	// a tag that's cut off is left out until the rest of it arrives
+	parser.Feed("ld</b></p><p class=\"gre")
+	assertStrEqual(t, parser.Snapshot().String(), "<div><p>Hello <b>world</b></p></div>")
+	assertStrEqual(t, snapshot.String(), "<div><p>Hello <b>wor</b></p></div>")
+
+	parser.Feed("eting\">Bye")
+	root := parser.Finish()
+	assertStrEqual(t, root.String(), "<div><p>Hello <b>world</b></p><p class=\"greeting\">Bye</p></div>")
+
+	// at the end of the document, a tag that was cut off is taken as it is
+	root = parser.Parse("<p>Hello<b")
+	assertStrEqual(t, root.String(), "<p>Hello<b></b></p>")
+}
+
 func assertIsHtml(t *testing.T, elem *HtmlElement, tag string) {
 	t.Helper()
 	if elem.Tag == "" {
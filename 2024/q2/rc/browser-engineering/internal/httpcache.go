@@ -0,0 +1,419 @@
+package internal
+
+import (
+	"crypto/sha256"
+	"encoding/gob"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// An HttpCache stores responses so that they can be reused without going to the network. It is only responsible for
+// storage; the decision of what to store and when a stored response can be used (RFC 9111) is made by the
+// `UrlFetcher`. Implementations must be safe for concurrent use.
+type HttpCache interface {
+	Get(key string) (*CacheEntry, bool)
+	Put(key string, entry *CacheEntry) error
+	Delete(key string)
+}
+
+type CacheEntry struct {
+	Response *HttpResponse
+	// when the request that produced the response was sent, and when the response was received (RFC 9111,
+	// section 4.2.3)
+	RequestTime  time.Time
+	ResponseTime time.Time
+	// the request's values for the header fields that the response's Vary header names (RFC 9111, section 4.1)
+	VaryHeaders Headers
+}
+
+// RFC 9111, section 4.2.1: responses with these statuses can be stored even without explicit freshness information
+var HEURISTICALLY_CACHEABLE_STATUSES = map[int]bool{
+	200: true, 203: true, 204: true, 300: true, 301: true, 308: true, 404: true, 405: true, 410: true, 414: true, 501: true,
+}
+
+// RFC 9111, section 3.2: header fields that a 304 response must not overwrite in the stored response
+var CACHE_UPDATE_EXCLUDED_HEADERS = map[string]bool{
+	"content-length":    true,
+	"content-encoding":  true,
+	"transfer-encoding": true,
+}
+
+// the fraction of the time since Last-Modified that a response is heuristically fresh for (RFC 9111, section 4.2.2)
+const HEURISTIC_FRESHNESS_FRACTION = 10
+
+// the cache key for a GET request; the fragment is never sent so it doesn't distinguish responses
+func cacheKey(url Url) string {
+	return url.withoutFragment().String()
+}
+
+// Parses a Cache-Control header (RFC 9111, section 5.2) into a map from lowercased directive name to its argument
+// (or the empty string if there isn't one).
+func parseCacheControl(headerValue string) map[string]string {
+	directives := map[string]string{}
+	for _, part := range strings.Split(headerValue, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+
+		name, value, _ := strings.Cut(part, "=")
+		name = strings.ToLower(strings.TrimSpace(name))
+		value = strings.TrimSpace(value)
+		if len(value) >= 2 && value[0] == '"' && value[len(value)-1] == '"' {
+			value = value[1 : len(value)-1]
+		}
+
+		// RFC 9111, section 4.2.1: when a directive is repeated, the first occurrence wins
+		if _, ok := directives[name]; !ok {
+			directives[name] = value
+		}
+	}
+	return directives
+}
+
+// Parses an HTTP-date in any of the three formats of RFC 9110, section 5.6.7.
+func parseHttpDate(text string) (time.Time, bool) {
+	formats := []string{
+		"Mon, 02 Jan 2006 15:04:05 GMT",
+		"Monday, 02-Jan-06 15:04:05 GMT",
+		"Mon Jan _2 15:04:05 2006",
+	}
+	for _, format := range formats {
+		t, err := time.Parse(format, strings.TrimSpace(text))
+		if err == nil {
+			return t, true
+		}
+	}
+	return time.Time{}, false
+}
+
+// RFC 9111, section 1.2.2: values too large to represent are treated as this
+const MAX_DELTA_SECONDS = 1 << 31
+
+// a delta-seconds value, or -1 if it's invalid
+func parseDeltaSeconds(text string) time.Duration {
+	seconds, err := strconv.ParseInt(text, 10, 64)
+	if err != nil && !errors.Is(err, strconv.ErrRange) {
+		return -1
+	}
+	if seconds < 0 {
+		return -1
+	}
+	return time.Duration(min(seconds, MAX_DELTA_SECONDS)) * time.Second
+}
+
+// RFC 9111, section 3: whether a response to a GET request may be stored. `shared` is true for caches that serve more
+// than one user, which must not store responses marked private.
+func isStorableResponse(response *HttpResponse, shared bool) bool {
+	directives := parseCacheControl(response.Headers.GetList("cache-control"))
+	if _, ok := directives["no-store"]; ok {
+		return false
+	}
+	if _, ok := directives["private"]; ok && shared {
+		return false
+	}
+	if response.Status < 200 || response.Status == 206 || response.Status == 304 {
+		return false
+	}
+
+	// RFC 9111, section 4.1: "Vary: *" means the response can never be reused. Other Vary headers are handled by
+	// `CacheEntry.matchesVary`.
+	if strings.TrimSpace(response.Headers.GetList("vary")) == "*" {
+		return false
+	}
+
+	if HEURISTICALLY_CACHEABLE_STATUSES[response.Status] {
+		return true
+	}
+	hasExpires := response.Headers.Has("expires")
+	_, hasMaxAge := directives["max-age"]
+	_, hasSMaxAge := directives["s-maxage"]
+	_, hasPublic := directives["public"]
+	return hasExpires || hasMaxAge || (shared && hasSMaxAge) || hasPublic
+}
+
+// the names of the request header fields that select between representations of the response (RFC 9110, section
+// 12.5.5)
+func varyFieldNames(response *HttpResponse) []string {
+	names := []string{}
+	for _, name := range strings.Split(response.Headers.GetList("vary"), ",") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name != "" {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// RFC 9111, section 4.1: a stored response can only be used for a request that has the same values as the original
+// request for the header fields named by Vary. `requestHeader` returns the value that a request would send.
+func (entry *CacheEntry) matchesVary(requestHeader func(name string) (string, bool)) bool {
+	for _, name := range varyFieldNames(entry.Response) {
+		value, ok := requestHeader(name)
+		stored, storedOk := entry.VaryHeaders.Lookup(name)
+		if ok != storedOk || normalizeVaryValue(value) != normalizeVaryValue(stored) {
+			return false
+		}
+	}
+	return true
+}
+
+// the request's values for the header fields named by the response's Vary header
+func selectVaryHeaders(response *HttpResponse, requestHeader func(name string) (string, bool)) Headers {
+	headers := Headers{}
+	for _, name := range varyFieldNames(response) {
+		if value, ok := requestHeader(name); ok {
+			headers.Add(name, value)
+		}
+	}
+	return headers
+}
+
+// RFC 9111, section 4.1: whitespace is ignored when comparing values
+func normalizeVaryValue(value string) string {
+	return strings.Join(strings.Fields(value), " ")
+}
+
+// RFC 9111, section 3.5: a shared cache may only store a response to a request with credentials if the response says
+// that it's meant for everyone
+func isStorableWithAuthorization(response *HttpResponse) bool {
+	directives := parseCacheControl(response.Headers.GetList("cache-control"))
+	for _, name := range []string{"must-revalidate", "public", "s-maxage"} {
+		if _, ok := directives[name]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// RFC 9111, section 4.2.1
+func (entry *CacheEntry) freshnessLifetime(shared bool) time.Duration {
+	headers := entry.Response.Headers
+	directives := parseCacheControl(headers.GetList("cache-control"))
+
+	if shared {
+		if value, ok := directives["s-maxage"]; ok {
+			if lifetime := parseDeltaSeconds(value); lifetime >= 0 {
+				return lifetime
+			}
+		}
+	}
+
+	if value, ok := directives["max-age"]; ok {
+		if lifetime := parseDeltaSeconds(value); lifetime >= 0 {
+			return lifetime
+		}
+	}
+
+	date := entry.date()
+	if value, ok := headers.Lookup("expires"); ok {
+		expires, ok := parseHttpDate(value)
+		if !ok {
+			// an invalid date (like "0") means the response is already expired
+			return 0
+		}
+		return expires.Sub(date)
+	}
+
+	// RFC 9111, section 4.2.2: without explicit freshness, a lifetime can be guessed from how long ago the resource
+	// last changed
+	if value, ok := headers.Lookup("last-modified"); ok && HEURISTICALLY_CACHEABLE_STATUSES[entry.Response.Status] {
+		lastModified, ok := parseHttpDate(value)
+		if ok && lastModified.Before(date) {
+			return date.Sub(lastModified) / HEURISTIC_FRESHNESS_FRACTION
+		}
+	}
+	return 0
+}
+
+// the Date header of the response, or when we received it if the header is missing or invalid
+func (entry *CacheEntry) date() time.Time {
+	date, ok := parseHttpDate(entry.Response.Headers.Get("date"))
+	if !ok {
+		return entry.ResponseTime
+	}
+	return date
+}
+
+// RFC 9111, section 4.2.3
+func (entry *CacheEntry) currentAge(now time.Time) time.Duration {
+	apparentAge := max(0, entry.ResponseTime.Sub(entry.date()))
+
+	ageValue := time.Duration(0)
+	if value, ok := entry.Response.Headers.Lookup("age"); ok {
+		ageValue = max(0, parseDeltaSeconds(strings.TrimSpace(value)))
+	}
+	responseDelay := entry.ResponseTime.Sub(entry.RequestTime)
+	correctedAgeValue := ageValue + responseDelay
+
+	correctedInitialAge := max(apparentAge, correctedAgeValue)
+	residentTime := now.Sub(entry.ResponseTime)
+	return correctedInitialAge + residentTime
+}
+
+// whether the stored response can be used without contacting the server (RFC 9111, section 4.2)
+func (entry *CacheEntry) isFresh(now time.Time, shared bool) bool {
+	// "no-cache" means the response can be stored but must be revalidated every time
+	if _, ok := parseCacheControl(entry.Response.Headers.GetList("cache-control"))["no-cache"]; ok {
+		return false
+	}
+	return entry.freshnessLifetime(shared) > entry.currentAge(now)
+}
+
+// the conditional request headers to revalidate the stored response (RFC 9110, section 13.1), or nil if it has no
+// validators
+func (entry *CacheEntry) validators() Headers {
+	headers := Headers{}
+	if etag, ok := entry.Response.Headers.Lookup("etag"); ok {
+		headers.Add("If-None-Match", etag)
+	}
+	if lastModified, ok := entry.Response.Headers.Lookup("last-modified"); ok {
+		headers.Add("If-Modified-Since", lastModified)
+	}
+	if len(headers) == 0 {
+		return nil
+	}
+	return headers
+}
+
+// RFC 9111, section 4.3.4: a 304 response refreshes the stored response with its header fields
+func (entry *CacheEntry) update(notModified *HttpResponse, requestTime time.Time, responseTime time.Time) {
+	response := entry.Response.clone()
+	updated := map[string]bool{}
+	for _, field := range notModified.Headers {
+		name := strings.ToLower(field.Name)
+		if CACHE_UPDATE_EXCLUDED_HEADERS[name] {
+			continue
+		}
+		// all of the stored fields with the name are replaced by all of the new ones
+		if !updated[name] {
+			response.Headers.Del(name)
+			updated[name] = true
+		}
+		response.Headers.Add(field.Name, field.Value)
+	}
+	entry.Response = response
+	entry.RequestTime = requestTime
+	entry.ResponseTime = responseTime
+}
+
+// a copy of the response that can be modified without affecting the original
+func (response *HttpResponse) clone() *HttpResponse {
+	c := *response
+	c.Headers = response.Headers.Clone()
+	c.RedirectChain = nil
+	c.body = nil
+	return &c
+}
+
+// A MemoryCache keeps responses in memory for the lifetime of the process.
+type MemoryCache struct {
+	mu      sync.Mutex
+	entries map[string]*CacheEntry
+}
+
+func NewMemoryCache() *MemoryCache {
+	return &MemoryCache{entries: map[string]*CacheEntry{}}
+}
+
+func (cache *MemoryCache) Get(key string) (*CacheEntry, bool) {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	entry, ok := cache.entries[key]
+	if !ok {
+		return nil, false
+	}
+	c := *entry
+	return &c, true
+}
+
+func (cache *MemoryCache) Put(key string, entry *CacheEntry) error {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	c := *entry
+	cache.entries[key] = &c
+	return nil
+}
+
+func (cache *MemoryCache) Delete(key string) {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	delete(cache.entries, key)
+}
+
+// A DiskCache stores each response in its own file under a directory, so that responses survive between runs.
+type DiskCache struct {
+	Directory string
+}
+
+func NewDiskCache(directory string) (*DiskCache, error) {
+	err := os.MkdirAll(directory, 0o700)
+	if err != nil {
+		return nil, fmt.Errorf("could not create cache directory: %w", err)
+	}
+	return &DiskCache{Directory: directory}, nil
+}
+
+// keys are hashed since URLs can contain characters that aren't allowed in file names
+func (cache *DiskCache) pathForKey(key string) string {
+	hash := sha256.Sum256([]byte(key))
+	return filepath.Join(cache.Directory, hex.EncodeToString(hash[:])+".gob")
+}
+
+func (cache *DiskCache) Get(key string) (*CacheEntry, bool) {
+	f, err := os.Open(cache.pathForKey(key))
+	if err != nil {
+		return nil, false
+	}
+	defer f.Close()
+
+	var entry diskCacheEntry
+	err = gob.NewDecoder(f).Decode(&entry)
+	if err != nil {
+		PrintVerbose(fmt.Sprintf("ignoring unreadable cache entry for %s: %s", key, err.Error()))
+		return nil, false
+	}
+	// two keys could only collide if SHA-256 did, but a file could have been copied into the wrong place
+	if entry.Key != key {
+		return nil, false
+	}
+	return &entry.Entry, true
+}
+
+func (cache *DiskCache) Put(key string, entry *CacheEntry) error {
+	// write to a temporary file and rename it so that concurrent readers never see a partially-written entry
+	f, err := os.CreateTemp(cache.Directory, "tmp-*")
+	if err != nil {
+		return err
+	}
+
+	err = gob.NewEncoder(f).Encode(diskCacheEntry{Key: key, Entry: *entry})
+	closeErr := f.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), cache.pathForKey(key))
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	return nil
+}
+
+func (cache *DiskCache) Delete(key string) {
+	os.Remove(cache.pathForKey(key))
+}
+
+type diskCacheEntry struct {
+	Key   string
+	Entry CacheEntry
+}
@@ -0,0 +1,237 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestParseCacheControl(t *testing.T) {
+	directives := parseCacheControl(`max-age=60, No-Cache, private="set-cookie", max-age=5`)
+	assertStrEqual(t, directives["max-age"], "60")
+	assertStrEqual(t, directives["private"], "set-cookie")
+	_, ok := directives["no-cache"]
+	if !ok {
+		t.Errorf("expected no-cache directive")
+	}
+}
+
+func TestCacheFreshness(t *testing.T) {
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	date := now.Format("Mon, 02 Jan 2006 15:04:05 GMT")
+	hourAgo := now.Add(-time.Hour).Format("Mon, 02 Jan 2006 15:04:05 GMT")
+	tenHoursAgo := now.Add(-10 * time.Hour).Format("Mon, 02 Jan 2006 15:04:05 GMT")
+	inAnHour := now.Add(time.Hour).Format("Mon, 02 Jan 2006 15:04:05 GMT")
+
+	testCases := []struct {
+		headers  Headers
+		elapsed  time.Duration
+		shared   bool
+		expected bool
+	}{
+		{Headers{{"cache-control", "max-age=60"}}, 30 * time.Second, false, true},
+		{Headers{{"cache-control", "max-age=60"}}, 90 * time.Second, false, false},
+		// the Age header counts against the lifetime
+		{Headers{{"cache-control", "max-age=60"}, {"age", "45"}}, 30 * time.Second, false, false},
+		{Headers{{"cache-control", "max-age=60, no-cache"}}, 0, false, false},
+		// max-age takes precedence over Expires
+		{Headers{{"cache-control", "max-age=0"}, {"expires", inAnHour}}, 0, false, false},
+		{Headers{{"expires", inAnHour}}, 30 * time.Minute, false, true},
+		{Headers{{"expires", "0"}}, 0, false, false},
+		{Headers{{"cache-control", "max-age=0, s-maxage=60"}}, 0, true, true},
+		{Headers{{"cache-control", "max-age=0, s-maxage=60"}}, 0, false, false},
+		// heuristic freshness: 10% of the time since the last modification
+		{Headers{{"last-modified", tenHoursAgo}}, 30 * time.Minute, false, true},
+		{Headers{{"last-modified", hourAgo}}, 30 * time.Minute, false, false},
+		{Headers{}, 0, false, false},
+		// repeated fields are combined
+		{Headers{{"cache-control", "max-age=60"}, {"Cache-Control", "no-cache"}}, 0, false, false},
+	}
+
+	for _, testCase := range testCases {
+		testCase.headers.Add("date", date)
+		entry := CacheEntry{
+			Response:     &HttpResponse{Status: 200, Headers: testCase.headers},
+			RequestTime:  now,
+			ResponseTime: now,
+		}
+		actual := entry.isFresh(now.Add(testCase.elapsed), testCase.shared)
+		if actual != testCase.expected {
+			t.Errorf("headers %v after %s: expected fresh=%v, got %v", testCase.headers, testCase.elapsed, testCase.expected, actual)
+		}
+	}
+}
+
+func TestIsStorableResponse(t *testing.T) {
+	testCases := []struct {
+		status   int
+		headers  Headers
+		shared   bool
+		expected bool
+	}{
+		{200, Headers{}, false, true},
+		{200, Headers{{"cache-control", "no-store"}}, false, false},
+		{200, Headers{{"cache-control", "private"}}, false, true},
+		{200, Headers{{"cache-control", "private"}}, true, false},
+		{200, Headers{{"vary", "*"}}, false, false},
+		{302, Headers{}, false, false},
+		{302, Headers{{"cache-control", "max-age=60"}}, false, true},
+		{500, Headers{{"expires", "0"}}, false, true},
+	}
+
+	for _, testCase := range testCases {
+		response := &HttpResponse{Status: testCase.status, Headers: testCase.headers}
+		actual := isStorableResponse(response, testCase.shared)
+		if actual != testCase.expected {
+			t.Errorf("%d with headers %v (shared=%v): expected storable=%v, got %v", testCase.status, testCase.headers, testCase.shared, testCase.expected, actual)
+		}
+	}
+}
+
+func TestCachedFetch(t *testing.T) {
+	server, requests := launchCacheServer(t)
+	defer server.Close()
+
+	for _, cache := range []HttpCache{NewMemoryCache(), newTestDiskCache(t)} {
+		requests.Store(0)
+		fetcher := NewUrlFetcher()
+		fetcher.Cache = cache
+
+		// served from the cache without contacting the server
+		r := fetchHttpForTest(t, &fetcher, server.URL+"/fresh#top")
+		assertStrEqual(t, string(r.Body), "fresh 1")
+		if r.FromCache {
+			t.Errorf("first response should not come from the cache")
+		}
+		r = fetchHttpForTest(t, &fetcher, server.URL+"/fresh")
+		assertStrEqual(t, string(r.Body), "fresh 1")
+		if !r.FromCache {
+			t.Errorf("second response should come from the cache")
+		}
+		assertIntEqual(t, int(requests.Load()), 1)
+
+		// revalidated with If-None-Match, and the 304 is answered from the cache
+		r = fetchHttpForTest(t, &fetcher, server.URL+"/etag")
+		assertStrEqual(t, string(r.Body), "etag 2")
+		r = fetchHttpForTest(t, &fetcher, server.URL+"/etag")
+		assertStrEqual(t, string(r.Body), "etag 2")
+		assertIntEqual(t, r.Status, 200)
+		if !r.FromCache {
+			t.Errorf("revalidated response should come from the cache")
+		}
+		// the 304's headers replace the stored ones
+		assertStrEqual(t, r.Headers.Get("x-revalidated"), "yes")
+		assertIntEqual(t, int(requests.Load()), 3)
+
+		// revalidated with If-Modified-Since
+		fetchHttpForTest(t, &fetcher, server.URL+"/last-modified")
+		r = fetchHttpForTest(t, &fetcher, server.URL+"/last-modified")
+		assertStrEqual(t, string(r.Body), "last-modified 4")
+		assertIntEqual(t, int(requests.Load()), 5)
+
+		// never stored
+		fetchHttpForTest(t, &fetcher, server.URL+"/no-store")
+		r = fetchHttpForTest(t, &fetcher, server.URL+"/no-store")
+		assertStrEqual(t, string(r.Body), "no-store 7")
+		assertIntEqual(t, int(requests.Load()), 7)
+
+		fetcher.Cleanup()
+	}
+}
+
+func TestDiskCachePersists(t *testing.T) {
+	server, requests := launchCacheServer(t)
+	defer server.Close()
+
+	directory := t.TempDir()
+	for i := 0; i < 2; i++ {
+		cache, err := NewDiskCache(directory)
+		assertNoErr(t, err)
+		fetcher := NewUrlFetcher()
+		fetcher.Cache = cache
+		r := fetchHttpForTest(t, &fetcher, server.URL+"/fresh")
+		assertStrEqual(t, string(r.Body), "fresh 1")
+		fetcher.Cleanup()
+	}
+	assertIntEqual(t, int(requests.Load()), 1)
+}
+
+func newTestDiskCache(t *testing.T) *DiskCache {
+	cache, err := NewDiskCache(t.TempDir())
+	assertNoErr(t, err)
+	return cache
+}
+
+// Each response body includes the number of requests the server has handled so far, so that tests can tell whether a
+// response came from the cache.
+func TestCacheVary(t *testing.T) {
+	server, requests := launchCacheServer(t)
+	defer server.Close()
+
+	url, err := ParseUrl(server.URL + "/vary")
+	assertNoErr(t, err)
+	for _, cache := range []HttpCache{NewMemoryCache(), newTestDiskCache(t)} {
+		requests.Store(0)
+		fetcher := NewUrlFetcher()
+		fetcher.Cache = cache
+
+		fetch := func(language string) *HttpResponse {
+			t.Helper()
+			request := NewRequest("GET", url, nil)
+			if language != "" {
+				request.Headers.Set("Accept-Language", language)
+			}
+			r, err := fetcher.FetchRequest(context.Background(), request)
+			assertNoErr(t, err)
+			return r.(*HttpResponse)
+		}
+
+		// the fetcher's default Accept-Language is what the response varies on
+		assertStrEqual(t, string(fetch("").Body), "vary 1")
+		assertStrEqual(t, string(fetch(DEFAULT_ACCEPT_LANGUAGE).Body), "vary 1")
+		// a different language can't be answered from the cache
+		assertStrEqual(t, string(fetch("fr").Body), "vary 2")
+		assertStrEqual(t, string(fetch("fr").Body), "vary 2")
+		assertStrEqual(t, string(fetch("").Body), "vary 3")
+		assertIntEqual(t, int(requests.Load()), 3)
+		fetcher.Cleanup()
+	}
+}
+
+func launchCacheServer(t *testing.T) (*httptest.Server, *atomic.Int32) {
+	var requests atomic.Int32
+	lastModified := time.Now().UTC().Add(-time.Minute).Format(http.TimeFormat)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := requests.Add(1)
+		switch r.URL.Path {
+		case "/fresh":
+			w.Header().Set("Cache-Control", "max-age=3600")
+		case "/etag":
+			w.Header().Set("Cache-Control", "no-cache")
+			w.Header().Set("ETag", `"v1"`)
+			if r.Header.Get("If-None-Match") == `"v1"` {
+				w.Header().Set("X-Revalidated", "yes")
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+		case "/last-modified":
+			w.Header().Set("Cache-Control", "max-age=0")
+			w.Header().Set("Last-Modified", lastModified)
+			if r.Header.Get("If-Modified-Since") == lastModified {
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+		case "/no-store":
+			w.Header().Set("Cache-Control", "no-store")
+		case "/vary":
+			w.Header().Set("Cache-Control", "max-age=3600")
+			w.Header().Set("Vary", "Accept-Language")
+		}
+		fmt.Fprintf(w, "%s %d", r.URL.Path[1:], n)
+	}))
+	return server, &requests
+}
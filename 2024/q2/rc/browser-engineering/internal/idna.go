@@ -0,0 +1,159 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"unicode/utf8"
+)
+
+// Converts a hostname to its ASCII-compatible encoding (RFC 5891), e.g. "bücher.example" becomes
+// "xn--bcher-kva.example".
+//
+// This implements only the parts of UTS #46 processing that matter in practice: labels are lowercased and non-ASCII
+// labels are punycode-encoded.
+//
+// TODO: Unicode normalization (NFC) and the full UTS #46 mapping table
+func hostToAscii(host string) (string, error) {
+	if !utf8.ValidString(host) {
+		return "", fmt.Errorf("invalid URL: host is not valid UTF-8: %q", host)
+	}
+
+	labels := strings.Split(strings.ToLower(host), ".")
+	for i, label := range labels {
+		if isAscii(label) {
+			continue
+		}
+
+		encoded, err := punycodeEncode(label)
+		if err != nil {
+			return "", fmt.Errorf("invalid URL: could not encode host label %q: %s", label, err.Error())
+		}
+		labels[i] = "xn--" + encoded
+	}
+	return strings.Join(labels, "."), nil
+}
+
+func isAscii(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= utf8.RuneSelf {
+			return false
+		}
+	}
+	return true
+}
+
+// parameters from RFC 3492, section 5
+const (
+	PUNYCODE_BASE         = 36
+	PUNYCODE_TMIN         = 1
+	PUNYCODE_TMAX         = 26
+	PUNYCODE_SKEW         = 38
+	PUNYCODE_DAMP         = 700
+	PUNYCODE_INITIAL_BIAS = 72
+	PUNYCODE_INITIAL_N    = 128
+)
+
+var errPunycodeOverflow = errors.New("punycode overflow")
+
+// RFC 3492, section 6.3
+func punycodeEncode(input string) (string, error) {
+	runes := []rune(input)
+
+	var output strings.Builder
+	for _, r := range runes {
+		if r < utf8.RuneSelf {
+			output.WriteRune(r)
+		}
+	}
+
+	basicCount := output.Len()
+	handled := basicCount
+	if basicCount > 0 {
+		output.WriteByte('-')
+	}
+
+	n := rune(PUNYCODE_INITIAL_N)
+	delta := 0
+	bias := PUNYCODE_INITIAL_BIAS
+	for handled < len(runes) {
+		// the next code point to insert is the smallest one that has not been handled yet
+		m := rune(utf8.MaxRune)
+		for _, r := range runes {
+			if r >= n && r < m {
+				m = r
+			}
+		}
+
+		if int(m-n) > (1<<31-1-delta)/(handled+1) {
+			return "", errPunycodeOverflow
+		}
+		delta += int(m-n) * (handled + 1)
+		n = m
+
+		for _, r := range runes {
+			if r < n {
+				delta++
+				if delta < 0 {
+					return "", errPunycodeOverflow
+				}
+			}
+
+			if r == n {
+				q := delta
+				for k := PUNYCODE_BASE; ; k += PUNYCODE_BASE {
+					t := punycodeThreshold(k, bias)
+					if q < t {
+						break
+					}
+					output.WriteByte(punycodeDigit(t + (q-t)%(PUNYCODE_BASE-t)))
+					q = (q - t) / (PUNYCODE_BASE - t)
+				}
+				output.WriteByte(punycodeDigit(q))
+				bias = punycodeAdapt(delta, handled+1, handled == basicCount)
+				delta = 0
+				handled++
+			}
+		}
+
+		delta++
+		n++
+	}
+
+	return output.String(), nil
+}
+
+func punycodeThreshold(k int, bias int) int {
+	if k <= bias {
+		return PUNYCODE_TMIN
+	} else if k >= bias+PUNYCODE_TMAX {
+		return PUNYCODE_TMAX
+	} else {
+		return k - bias
+	}
+}
+
+func punycodeDigit(d int) byte {
+	if d < 26 {
+		return byte('a' + d)
+	} else {
+		return byte('0' + d - 26)
+	}
+}
+
+// RFC 3492, section 6.1
+func punycodeAdapt(delta int, numPoints int, firstTime bool) int {
+	if firstTime {
+		delta /= PUNYCODE_DAMP
+	} else {
+		delta /= 2
+	}
+	delta += delta / numPoints
+
+	k := 0
+	for delta > ((PUNYCODE_BASE-PUNYCODE_TMIN)*PUNYCODE_TMAX)/2 {
+		delta /= PUNYCODE_BASE - PUNYCODE_TMIN
+		k += PUNYCODE_BASE
+	}
+	return k + (PUNYCODE_BASE-PUNYCODE_TMIN+1)*delta/(delta+PUNYCODE_SKEW)
+}
@@ -56,7 +56,10 @@ func (engine *Engine) Layout(width int32, height int32) DisplayList {
 	engine.maxY = 0
 	engine.cursorX = 0
 	engine.cursorY = 0
-	engine.fonts = make(map[int]*ttf.Font)
+	if engine.fonts == nil {
+		// kept across layouts, since a page that is still loading is laid out over and over
+		engine.fonts = make(map[int]*ttf.Font)
+	}
 
 	var tf TreeFlattener
 	for _, elem := range tf.FlattenTree(engine.htmlTree) {
@@ -247,6 +250,10 @@ func (tf *TreeFlattener) FlattenTree(tree *HtmlElement) []LineElement {
 	tf.fontSize = DEFAULT_FONT_SIZE
 	tf.fontSizeRestore = tf.fontSize
 
+	// e.g., nothing of the page has arrived yet
+	if tree == nil {
+		return tf.lineElements
+	}
 	walkTree(tree, tf)
 
 	return tf.lineElements
@@ -314,6 +321,8 @@ func replaceEntityRefs(text string) string {
 			return ">"
 		} else if code == "&lt;" {
 			return "<"
+		} else if code == "&amp;" {
+			return "&"
 		} else {
 			return code
 		}
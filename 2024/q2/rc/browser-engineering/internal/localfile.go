@@ -0,0 +1,119 @@
+package internal
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// reads a local file, or lists the contents of a local directory
+func (fetcher *UrlFetcher) fetchFile(url Url) (*FileResponse, error) {
+	// `ParseUrl` has already turned "localhost" into an empty host
+	if url.Host != "" {
+		return nil, fmt.Errorf("cannot fetch file from remote host: %s", url.Host)
+	}
+
+	path := url.FilePath()
+	PrintVerbose(fmt.Sprintf("reading local file: %s", path))
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if info.IsDir() {
+		listing, err := listDirectory(url, path)
+		if err != nil {
+			return nil, err
+		}
+		return &FileResponse{Body: []byte(listing), MimeType: TEXT_HTML_UTF8}, nil
+	}
+
+	maxLength := fetcher.Limits.MaxBodyLength
+	if maxLength != 0 && info.Size() > int64(maxLength) {
+		return nil, &LimitError{Limit: LIMIT_BODY_LENGTH, Max: maxLength}
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	// the file may have grown since it was stat'd
+	data, err := io.ReadAll(limitBody(file, maxLength))
+	if err != nil {
+		return nil, err
+	}
+
+	mimeType, ok := mimeTypeForExtension(path)
+	if !ok {
+		mimeType = sniffMimeType(data)
+	}
+	return &FileResponse{Body: data, MimeType: mimeType}, nil
+}
+
+// the HTML index page of a directory, with a line for each entry
+func listDirectory(url Url, path string) (string, error) {
+	entries, err := os.ReadDir(path)
+	if err != nil {
+		return "", err
+	}
+
+	// links are absolute so that they work whether or not the URL of the directory ends in a slash
+	base := url.Path
+	if !strings.HasSuffix(base, "/") {
+		base += "/"
+	}
+
+	var builder strings.Builder
+	title := escapeHtmlText(percentDecode(base))
+	fmt.Fprintf(&builder, "<!DOCTYPE html>\n<html>\n<head>\n<meta charset=\"utf-8\">\n<title>Index of %s</title>\n</head>\n", title)
+	fmt.Fprintf(&builder, "<body>\n<p><big><b>Index of %s</b></big></p>\n<p>\n", title)
+	if base != "/" {
+		parent := base[:strings.LastIndex(strings.TrimSuffix(base, "/"), "/")+1]
+		fmt.Fprintf(&builder, "<a href=\"%s\">../</a><br>\n", parent)
+	}
+
+	for _, entry := range entries {
+		info, err := entry.Info()
+		if err != nil {
+			// the entry was removed after the directory was read
+			continue
+		}
+
+		name := entry.Name()
+		size := formatFileSize(info.Size())
+		if entry.IsDir() {
+			name += "/"
+			size = "-"
+		}
+		href := base + percentEncode(name, isFileNamePercentEncoded)
+		modified := info.ModTime().Format("2006-01-02 15:04")
+		fmt.Fprintf(&builder, "<a href=\"%s\">%s</a> %s %s<br>\n", href, escapeHtmlText(name), size, modified)
+	}
+	builder.WriteString("</p>\n</body>\n</html>\n")
+	return builder.String(), nil
+}
+
+// file names may contain characters that would otherwise end the path or start a percent escape
+func isFileNamePercentEncoded(b byte) bool {
+	return isPathPercentEncoded(b) || b == '%' || b == '&' || b == '\''
+}
+
+func escapeHtmlText(text string) string {
+	return strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;").Replace(text)
+}
+
+func formatFileSize(size int64) string {
+	if size < 1024 {
+		return fmt.Sprintf("%d B", size)
+	}
+	value := float64(size) / 1024
+	units := []string{"KB", "MB", "GB"}
+	i := 0
+	for value >= 1024 && i < len(units)-1 {
+		value /= 1024
+		i++
+	}
+	return fmt.Sprintf("%.1f %s", value, units[i])
+}
@@ -0,0 +1,111 @@
+package internal
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestFetchFile(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"page.html":    "<p>hello</p>",
+		"notes.txt":    "<p>not html</p>",
+		"no-extension": "<!DOCTYPE html><p>sniffed</p>",
+		"data.bin":     "\x00\x01\x02",
+		"a b&c%20.txt": "odd name",
+	}
+	for name, content := range files {
+		assertNoErr(t, os.WriteFile(filepath.Join(dir, name), []byte(content), 0o644))
+	}
+
+	fetcher := NewUrlFetcher()
+	defer fetcher.Cleanup()
+
+	testCases := []struct {
+		url      string
+		mimeType string
+		body     string
+	}{
+		{"file://" + dir + "/page.html", "text/html", "<p>hello</p>"},
+		{"file://" + dir + "/notes.txt", "text/plain", "<p>not html</p>"},
+		{"file://" + dir + "/no-extension", "text/html", "<!DOCTYPE html><p>sniffed</p>"},
+		{"file://" + dir + "/data.bin", "application/octet-stream", "\x00\x01\x02"},
+		{"file://localhost" + dir + "/page.html", "text/html", "<p>hello</p>"},
+		{"file://" + dir + "/a%20b%26c%2520.txt", "text/plain", "odd name"},
+	}
+
+	for _, testCase := range testCases {
+		url, err := ParseUrl(testCase.url)
+		assertNoErr(t, err)
+		r, err := fetcher.Fetch(url)
+		assertNoErr(t, err)
+		assertStrEqual(t, string(r.GetBody()), testCase.body)
+		mimeType, ok := r.GetContentType()
+		if !ok || mimeType.Essence() != testCase.mimeType {
+			t.Errorf("unexpected content type for %s: %v", testCase.url, mimeType)
+		}
+	}
+
+	url, err := ParseUrl("file://example.com" + dir + "/page.html")
+	assertNoErr(t, err)
+	_, err = fetcher.Fetch(url)
+	if err == nil {
+		t.Errorf("expected error fetching file from remote host")
+	}
+
+	fetcher.Limits.MaxBodyLength = 5
+	url, err = ParseUrl("file://" + dir + "/page.html")
+	assertNoErr(t, err)
+	_, err = fetcher.Fetch(url)
+	var limitErr *LimitError
+	if !errors.As(err, &limitErr) || limitErr.Limit != LIMIT_BODY_LENGTH {
+		t.Errorf("expected body length limit error, got %v", err)
+	}
+}
+
+func TestFetchDirectory(t *testing.T) {
+	dir := t.TempDir()
+	assertNoErr(t, os.WriteFile(filepath.Join(dir, "small.txt"), []byte("hello"), 0o644))
+	assertNoErr(t, os.WriteFile(filepath.Join(dir, "<big>.txt"), make([]byte, 2048), 0o644))
+	assertNoErr(t, os.Mkdir(filepath.Join(dir, "sub dir"), 0o755))
+
+	fetcher := NewUrlFetcher()
+	defer fetcher.Cleanup()
+
+	// with and without a trailing slash
+	for _, suffix := range []string{"", "/"} {
+		url, err := ParseUrl("file://" + dir + suffix)
+		assertNoErr(t, err)
+		r, err := fetcher.Fetch(url)
+		assertNoErr(t, err)
+		mimeType, ok := r.GetContentType()
+		if !ok || !mimeType.IsHtml() {
+			t.Errorf("unexpected content type: %v", mimeType)
+		}
+
+		listing := string(r.GetBody())
+		parent := filepath.Dir(dir) + "/"
+		for _, expected := range []string{
+			"<title>Index of " + dir + "/</title>",
+			"<a href=\"" + parent + "\">../</a>",
+			"<a href=\"" + dir + "/small.txt\">small.txt</a> 5 B ",
+			"<a href=\"" + dir + "/%3Cbig%3E.txt\">&lt;big&gt;.txt</a> 2.0 KB ",
+			"<a href=\"" + dir + "/sub%20dir/\">sub dir/</a> - ",
+		} {
+			if !strings.Contains(listing, expected) {
+				t.Errorf("expected directory listing to contain %q:\n%s", expected, listing)
+			}
+		}
+	}
+}
+
+func TestFormatFileSize(t *testing.T) {
+	assertStrEqual(t, formatFileSize(0), "0 B")
+	assertStrEqual(t, formatFileSize(1023), "1023 B")
+	assertStrEqual(t, formatFileSize(1536), "1.5 KB")
+	assertStrEqual(t, formatFileSize(5*1024*1024), "5.0 MB")
+	assertStrEqual(t, formatFileSize(3*1024*1024*1024*1024), "3072.0 GB")
+}
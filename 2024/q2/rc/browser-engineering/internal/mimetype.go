@@ -0,0 +1,329 @@
+package internal
+
+import (
+	"bytes"
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+type MimeType struct {
+	Type       string
+	Subtype    string
+	Parameters []MimeTypeParameter // in the order they appeared
+}
+
+type MimeTypeParameter struct {
+	Name  string
+	Value string
+}
+
+const ASCII_WHITESPACE = "\t\n\f\r "
+const HTTP_WHITESPACE = "\t\n\r "
+
+// Parameter returns the value of the parameter with the given (lowercase) name.
+func (mimeType MimeType) Parameter(name string) (string, bool) {
+	for _, parameter := range mimeType.Parameters {
+		if parameter.Name == name {
+			return parameter.Value, true
+		}
+	}
+	return "", false
+}
+
+// Charset returns the value of the `charset` parameter, or an empty string if there is none.
+func (mimeType MimeType) Charset() string {
+	charset, _ := mimeType.Parameter("charset")
+	return charset
+}
+
+// Essence returns the type and subtype without any parameters, e.g. "text/html".
+func (mimeType MimeType) Essence() string {
+	return fmt.Sprintf("%s/%s", mimeType.Type, mimeType.Subtype)
+}
+
+func (mimeType MimeType) IsHtml() bool {
+	return mimeType.Essence() == "text/html"
+}
+
+// WHATWG MIME Sniffing standard, section 4.6 ("serialize a MIME type")
+func (mimeType MimeType) String() string {
+	var sb strings.Builder
+	sb.WriteString(mimeType.Essence())
+	for _, parameter := range mimeType.Parameters {
+		sb.WriteString(";")
+		sb.WriteString(parameter.Name)
+		sb.WriteString("=")
+		if parameter.Value == "" || !isHttpToken(parameter.Value) {
+			sb.WriteString("\"")
+			for _, r := range parameter.Value {
+				if r == '"' || r == '\\' {
+					sb.WriteRune('\\')
+				}
+				sb.WriteRune(r)
+			}
+			sb.WriteString("\"")
+		} else {
+			sb.WriteString(parameter.Value)
+		}
+	}
+	return sb.String()
+}
+
+// WHATWG MIME Sniffing standard, section 4.4 ("parse a MIME type")
+//
+// Malformed parameters are skipped rather than treated as errors, and if a parameter appears more than once, the
+// first occurrence wins.
+func parseMimeType(text string) (MimeType, error) {
+	text = strings.Trim(text, HTTP_WHITESPACE)
+
+	slash := strings.Index(text, "/")
+	if slash == -1 {
+		return MimeType{}, fmt.Errorf("invalid MIME type: %q", text)
+	}
+
+	typ := text[:slash]
+	rest := text[slash+1:]
+
+	subtype := rest
+	semicolon := strings.Index(rest, ";")
+	if semicolon != -1 {
+		subtype = rest[:semicolon]
+		rest = rest[semicolon:]
+	} else {
+		rest = ""
+	}
+	subtype = strings.TrimRight(subtype, HTTP_WHITESPACE)
+
+	if !isHttpToken(typ) || !isHttpToken(subtype) {
+		return MimeType{}, fmt.Errorf("invalid MIME type: %q", text)
+	}
+
+	mimeType := MimeType{Type: strings.ToLower(typ), Subtype: strings.ToLower(subtype)}
+
+	// invariant: `rest` is either empty or starts with a semicolon
+	for rest != "" {
+		rest = strings.TrimLeft(rest[1:], HTTP_WHITESPACE)
+
+		nameEnd := strings.IndexAny(rest, ";=")
+		if nameEnd == -1 {
+			break
+		}
+		name := strings.ToLower(rest[:nameEnd])
+		rest = rest[nameEnd:]
+		if rest[0] == ';' {
+			continue
+		}
+		rest = rest[1:]
+
+		var value string
+		if strings.HasPrefix(rest, "\"") {
+			value, rest = readHttpQuotedString(rest)
+			// anything between the closing quote and the next semicolon is ignored
+			if i := strings.Index(rest, ";"); i != -1 {
+				rest = rest[i:]
+			} else {
+				rest = ""
+			}
+		} else {
+			valueEnd := strings.Index(rest, ";")
+			if valueEnd == -1 {
+				value = rest
+				rest = ""
+			} else {
+				value = rest[:valueEnd]
+				rest = rest[valueEnd:]
+			}
+			value = strings.TrimRight(value, HTTP_WHITESPACE)
+			if value == "" {
+				continue
+			}
+		}
+
+		_, exists := mimeType.Parameter(name)
+		if name != "" && isHttpToken(name) && isHttpQuotedStringValue(value) && !exists {
+			mimeType.Parameters = append(mimeType.Parameters, MimeTypeParameter{Name: name, Value: value})
+		}
+	}
+
+	return mimeType, nil
+}
+
+// reads a quoted string (starting with the opening quote) and returns the unescaped value and the remaining text
+//
+// an unterminated string extends to the end of the input
+func readHttpQuotedString(text string) (string, string) {
+	var sb strings.Builder
+	i := 1
+	for i < len(text) {
+		c := text[i]
+		if c == '"' {
+			return sb.String(), text[i+1:]
+		} else if c == '\\' && i+1 < len(text) {
+			sb.WriteByte(text[i+1])
+			i += 2
+		} else {
+			sb.WriteByte(c)
+			i++
+		}
+	}
+	return sb.String(), ""
+}
+
+// RFC 9110, section 5.6.2
+func isHttpToken(s string) bool {
+	if s == "" {
+		return false
+	}
+
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		isAlnum := ('a' <= c && c <= 'z') || ('A' <= c && c <= 'Z') || ('0' <= c && c <= '9')
+		if !isAlnum && !strings.ContainsRune("!#$%&'*+-.^_`|~", rune(c)) {
+			return false
+		}
+	}
+	return true
+}
+
+func isHttpQuotedStringValue(s string) bool {
+	for _, r := range s {
+		if !(r == '\t' || (r >= 0x20 && r <= 0x7e) || (r >= 0x80 && r <= 0xff)) {
+			return false
+		}
+	}
+	return true
+}
+
+// MIME types of local files, by lowercase extension
+var MIME_TYPES_BY_EXTENSION = map[string]string{
+	".css":   "text/css",
+	".csv":   "text/csv",
+	".gif":   "image/gif",
+	".htm":   "text/html",
+	".html":  "text/html",
+	".ico":   "image/x-icon",
+	".jpeg":  "image/jpeg",
+	".jpg":   "image/jpeg",
+	".js":    "text/javascript",
+	".json":  "application/json",
+	".md":    "text/markdown",
+	".mjs":   "text/javascript",
+	".pdf":   "application/pdf",
+	".png":   "image/png",
+	".svg":   "image/svg+xml",
+	".txt":   "text/plain",
+	".webp":  "image/webp",
+	".xht":   "application/xhtml+xml",
+	".xhtml": "application/xhtml+xml",
+	".xml":   "text/xml",
+	".zip":   "application/zip",
+}
+
+// mimeTypeForExtension looks up the MIME type of a file by the extension of its name.
+func mimeTypeForExtension(path string) (MimeType, bool) {
+	essence, ok := MIME_TYPES_BY_EXTENSION[strings.ToLower(filepath.Ext(path))]
+	if !ok {
+		return MimeType{}, false
+	}
+	return mimeTypeFromEssence(essence), true
+}
+
+func mimeTypeFromEssence(essence string) MimeType {
+	type_, subtype, _ := strings.Cut(essence, "/")
+	return MimeType{Type: type_, Subtype: subtype}
+}
+
+// WHATWG MIME Sniffing standard, section 5.2 ("reading the resource header"): no more than this much of a resource is
+// examined
+const SNIFF_LENGTH = 1445
+
+type sniffPattern struct {
+	pattern []byte
+	// bytes of the resource are ANDed with the mask before they're compared; no mask means an exact match
+	mask []byte
+	// the result for a resource that starts with `pattern`
+	essence string
+}
+
+// section 7.1, steps 1 and 2: compared case-insensitively after leading whitespace, and must be followed by a space or
+// '>'
+var HTML_SNIFF_PATTERNS = []string{
+	"<!DOCTYPE HTML", "<HTML", "<HEAD", "<SCRIPT", "<IFRAME", "<H1", "<DIV", "<FONT", "<TABLE", "<A", "<STYLE",
+	"<TITLE", "<B", "<BODY", "<BR", "<P", "<!--",
+}
+
+// sections 7.1, 6.1 and 6.4
+var SNIFF_PATTERNS = []sniffPattern{
+	{[]byte("<?xml"), nil, "text/xml"},
+	{[]byte("%PDF-"), nil, "application/pdf"},
+	{[]byte("%!PS-Adobe-"), nil, "application/postscript"},
+	// a byte order mark means text, whatever the encoding
+	{[]byte("\xFE\xFF"), nil, "text/plain"},
+	{[]byte("\xFF\xFE"), nil, "text/plain"},
+	{[]byte("\xEF\xBB\xBF"), nil, "text/plain"},
+	{[]byte("\x00\x00\x01\x00"), nil, "image/x-icon"},
+	{[]byte("\x00\x00\x02\x00"), nil, "image/x-icon"},
+	{[]byte("BM"), nil, "image/bmp"},
+	{[]byte("GIF87a"), nil, "image/gif"},
+	{[]byte("GIF89a"), nil, "image/gif"},
+	{[]byte("RIFF\x00\x00\x00\x00WEBPVP"), []byte("\xFF\xFF\xFF\xFF\x00\x00\x00\x00\xFF\xFF\xFF\xFF\xFF\xFF"), "image/webp"},
+	{[]byte("\x89PNG\r\n\x1A\n"), nil, "image/png"},
+	{[]byte("\xFF\xD8\xFF"), nil, "image/jpeg"},
+	{[]byte("\x1F\x8B\x08"), nil, "application/x-gzip"},
+	{[]byte("PK\x03\x04"), nil, "application/zip"},
+	{[]byte("Rar!\x1A\x07\x00"), nil, "application/x-rar-compressed"},
+}
+
+// sniffMimeType guesses the MIME type of a resource from its first few bytes (WHATWG MIME Sniffing standard, section
+// 7.1, "identifying a resource with an unknown MIME type").
+func sniffMimeType(content []byte) MimeType {
+	if len(content) > SNIFF_LENGTH {
+		content = content[:SNIFF_LENGTH]
+	}
+
+	trimmed := bytes.TrimLeft(content, "\t\n\f\r ")
+	for _, pattern := range HTML_SNIFF_PATTERNS {
+		if len(trimmed) > len(pattern) && bytes.EqualFold(trimmed[:len(pattern)], []byte(pattern)) {
+			if next := trimmed[len(pattern)]; next == ' ' || next == '>' {
+				return mimeTypeFromEssence("text/html")
+			}
+		}
+	}
+
+	for _, pattern := range SNIFF_PATTERNS {
+		if pattern.matches(content) {
+			return mimeTypeFromEssence(pattern.essence)
+		}
+	}
+
+	// section 7.1, step 9
+	for _, b := range content {
+		if isBinaryDataByte(b) {
+			return mimeTypeFromEssence("application/octet-stream")
+		}
+	}
+	return mimeTypeFromEssence("text/plain")
+}
+
+// section 6 ("pattern matching algorithm")
+func (pattern sniffPattern) matches(content []byte) bool {
+	if len(content) < len(pattern.pattern) {
+		return false
+	}
+	for i, b := range pattern.pattern {
+		actual := content[i]
+		if pattern.mask != nil {
+			actual &= pattern.mask[i]
+		}
+		if actual != b {
+			return false
+		}
+	}
+	return true
+}
+
+// section 3 ("binary data byte")
+func isBinaryDataByte(b byte) bool {
+	return b <= 0x08 || b == 0x0B || (b >= 0x0E && b <= 0x1A) || (b >= 0x1C && b <= 0x1F)
+}
@@ -0,0 +1,94 @@
+package internal
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseMimeType(t *testing.T) {
+	mtype, err := parseMimeType("application/octet-stream")
+	assertNoErr(t, err)
+	assertStrEqual(t, mtype.Type, "application")
+	assertStrEqual(t, mtype.Subtype, "octet-stream")
+	assertIntEqual(t, len(mtype.Parameters), 0)
+
+	mtype, err = parseMimeType("text/plain;charset=utf-8")
+	assertNoErr(t, err)
+	assertStrEqual(t, mtype.Type, "text")
+	assertStrEqual(t, mtype.Subtype, "plain")
+	assertStrEqual(t, mtype.Charset(), "utf-8")
+
+	mtype, err = parseMimeType("Text/HTML; Charset=\"UTF-8\"; foo=bar ;foo=baz; q=\"a \\\"b\\\"\"")
+	assertNoErr(t, err)
+	assertStrEqual(t, mtype.Essence(), "text/html")
+	assertIntEqual(t, len(mtype.Parameters), 3)
+	assertStrEqual(t, mtype.Parameters[0].Name, "charset")
+	assertStrEqual(t, mtype.Parameters[0].Value, "UTF-8")
+	assertStrEqual(t, mtype.Parameters[1].Name, "foo")
+	assertStrEqual(t, mtype.Parameters[1].Value, "bar")
+	assertStrEqual(t, mtype.Parameters[2].Name, "q")
+	assertStrEqual(t, mtype.Parameters[2].Value, "a \"b\"")
+	assertStrEqual(t, mtype.String(), "text/html;charset=UTF-8;foo=bar;q=\"a \\\"b\\\"\"")
+
+	// malformed parameters are skipped
+	mtype, err = parseMimeType("text/plain;;noequals;=x;empty=;ok=1")
+	assertNoErr(t, err)
+	assertStrEqual(t, mtype.String(), "text/plain;ok=1")
+
+	_, err = parseMimeType("text")
+	if err == nil {
+		t.Errorf("expected error for MIME type without subtype")
+	}
+
+	_, err = parseMimeType("te xt/plain")
+	if err == nil {
+		t.Errorf("expected error for MIME type with invalid characters")
+	}
+}
+
+func TestSniffMimeType(t *testing.T) {
+	testCases := []struct {
+		content  string
+		expected string
+	}{
+		{"  \n<!doctype html><p>hi", "text/html"},
+		{"<HTML>", "text/html"},
+		{"<p class=x>", "text/html"},
+		{"<!-- comment -->", "text/html"},
+		// HTML tags must be followed by a space or '>'
+		{"<pre>text</pre>", "text/plain"},
+		{"<?xml version=\"1.0\"?>", "text/xml"},
+		{"%PDF-1.7", "application/pdf"},
+		{"\xEF\xBB\xBFhello", "text/plain"},
+		{"\xFF\xFEh\x00i\x00", "text/plain"},
+		{"\x89PNG\r\n\x1A\n\x00\x00", "image/png"},
+		{"GIF89a\x01\x00", "image/gif"},
+		{"RIFF\x10\x20\x30\x40WEBPVP8 ", "image/webp"},
+		{"\x1F\x8B\x08\x00", "application/x-gzip"},
+		{"just some text\n", "text/plain"},
+		{"", "text/plain"},
+		{"text\x00with a NUL", "application/octet-stream"},
+	}
+
+	for _, testCase := range testCases {
+		assertStrEqual(t, sniffMimeType([]byte(testCase.content)).Essence(), testCase.expected)
+	}
+
+	// only the start of the resource is examined
+	assertStrEqual(t, sniffMimeType([]byte(strings.Repeat("a", SNIFF_LENGTH)+"\x00")).Essence(), "text/plain")
+}
+
+func TestMimeTypeForExtension(t *testing.T) {
+	mimeType, ok := mimeTypeForExtension("/tmp/Index.HTML")
+	if !ok || mimeType.Essence() != "text/html" {
+		t.Errorf("unexpected MIME type: %v", mimeType)
+	}
+	mimeType, ok = mimeTypeForExtension("notes.txt")
+	if !ok || mimeType.Essence() != "text/plain" {
+		t.Errorf("unexpected MIME type: %v", mimeType)
+	}
+	_, ok = mimeTypeForExtension("Makefile")
+	if ok {
+		t.Errorf("expected no MIME type for file without an extension")
+	}
+}
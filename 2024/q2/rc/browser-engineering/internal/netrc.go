@@ -0,0 +1,120 @@
+package internal
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+// Credentials from a netrc file, as used by curl and ftp: "machine HOST login USER password PASSWORD" entries, plus
+// an optional "default" entry for every other host. Macros ("macdef") are skipped.
+type Netrc struct {
+	machines map[string]Credentials
+	// nil if there is no "default" entry
+	fallback *Credentials
+}
+
+func LoadNetrc(path string) (*Netrc, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not read netrc file: %w", err)
+	}
+	netrc, err := parseNetrc(string(data))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return netrc, nil
+}
+
+// The realm is ignored, since netrc files have no notion of it.
+func (netrc *Netrc) Credentials(url Url, realm string) (Credentials, bool) {
+	credentials, ok := netrc.machines[strings.ToLower(url.Host)]
+	if ok {
+		return credentials, true
+	}
+	if netrc.fallback != nil {
+		return *netrc.fallback, true
+	}
+	return Credentials{}, false
+}
+
+func parseNetrc(text string) (*Netrc, error) {
+	netrc := &Netrc{machines: make(map[string]Credentials)}
+
+	// the entry being read, which is added once the next one starts
+	var host string
+	var credentials *Credentials
+	isDefault := false
+	finishEntry := func() {
+		if credentials == nil {
+			return
+		}
+		if isDefault {
+			netrc.fallback = credentials
+		} else if _, exists := netrc.machines[host]; !exists {
+			// as with curl, the first entry for a host wins
+			netrc.machines[host] = *credentials
+		}
+	}
+
+	rest := text
+	for {
+		var token string
+		token, rest = readNetrcToken(rest)
+		if token == "" {
+			break
+		}
+
+		switch token {
+		case "machine", "default":
+			finishEntry()
+			isDefault = token == "default"
+			if !isDefault {
+				host, rest = readNetrcToken(rest)
+				if host == "" {
+					return nil, fmt.Errorf("expected host name after 'machine'")
+				}
+				host = strings.ToLower(host)
+			}
+			credentials = &Credentials{}
+		case "login", "password", "account":
+			var value string
+			value, rest = readNetrcToken(rest)
+			if credentials == nil {
+				return nil, fmt.Errorf("'%s' outside of a machine entry", token)
+			}
+			if token == "login" {
+				credentials.Username = value
+			} else if token == "password" {
+				credentials.Password = value
+			}
+		case "macdef":
+			// the macro's name is on the same line, and its body continues until a blank line
+			end := strings.Index(rest, "\n\n")
+			if end == -1 {
+				rest = ""
+			} else {
+				rest = rest[end+2:]
+			}
+		default:
+			return nil, fmt.Errorf("unexpected token in netrc file: %q", token)
+		}
+	}
+	finishEntry()
+	return netrc, nil
+}
+
+// Tokens are separated by whitespace, or quoted with backslash escapes (a curl extension, for passwords with spaces).
+// Returns an empty token at the end of the input.
+func readNetrcToken(text string) (string, string) {
+	rest := strings.TrimLeft(text, ASCII_WHITESPACE)
+	if strings.HasPrefix(rest, "\"") {
+		return readHttpQuotedString(rest)
+	}
+
+	end := strings.IndexAny(rest, ASCII_WHITESPACE)
+	if end == -1 {
+		return rest, ""
+	}
+	return rest[:end], rest[end:]
+}
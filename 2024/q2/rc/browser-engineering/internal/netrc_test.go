@@ -0,0 +1,80 @@
+package internal
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestParseNetrc(t *testing.T) {
+	text := `
+machine example.com login alice password secret
+machine Example.com login ignored password ignored
+
+macdef init
+cd /pub
+machine not-a-real-entry
+
+machine other.example
+  login bob
+  password "two words"
+  account unused
+default login anonymous password guest@
+`
+	netrc, err := parseNetrc(text)
+	assertNoErr(t, err)
+
+	testCases := []struct {
+		url      string
+		username string
+		password string
+	}{
+		{"http://example.com/", "alice", "secret"},
+		{"https://EXAMPLE.com:8443/", "alice", "secret"},
+		{"http://other.example/", "bob", "two words"},
+		{"http://not-a-real-entry/", "anonymous", "guest@"},
+	}
+	for _, testCase := range testCases {
+		url, err := ParseUrl(testCase.url)
+		assertNoErr(t, err)
+		credentials, ok := netrc.Credentials(url, "")
+		if !ok {
+			t.Errorf("expected credentials for %s", testCase.url)
+			continue
+		}
+		assertStrEqual(t, credentials.Username, testCase.username)
+		assertStrEqual(t, credentials.Password, testCase.password)
+	}
+
+	netrc, err = parseNetrc("machine example.com login alice")
+	assertNoErr(t, err)
+	url, err := ParseUrl("http://example.org/")
+	assertNoErr(t, err)
+	_, ok := netrc.Credentials(url, "")
+	if ok {
+		t.Errorf("expected no credentials without a default entry")
+	}
+
+	_, err = parseNetrc("login alice")
+	if err == nil {
+		t.Errorf("expected error for login outside of an entry")
+	}
+}
+
+func TestLoadNetrc(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "netrc")
+	assertNoErr(t, os.WriteFile(path, []byte("machine example.com login alice password secret\n"), 0o600))
+	netrc, err := LoadNetrc(path)
+	assertNoErr(t, err)
+	url, err := ParseUrl("http://example.com/")
+	assertNoErr(t, err)
+	credentials, ok := netrc.Credentials(url, "")
+	if !ok || credentials.Password != "secret" {
+		t.Errorf("unexpected credentials: %+v", credentials)
+	}
+
+	_, err = LoadNetrc(filepath.Join(t.TempDir(), "missing"))
+	if err == nil {
+		t.Errorf("expected error for missing netrc file")
+	}
+}
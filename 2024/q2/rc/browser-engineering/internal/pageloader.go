@@ -0,0 +1,207 @@
+package internal
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// A PageLoader reads the body of a response in the background and turns it into a document bit by bit, so that the
+// page can be shown while it is still arriving (see `Gui.ShowPage`). Apart from `Finished`, its methods must all be
+// called from the same goroutine.
+type PageLoader struct {
+	// called by `Close`, if set, to interrupt a read that is waiting on the network, e.g., by cancelling the context
+	// of the fetch
+	Cancel func()
+
+	// the body is shown as-is rather than parsed as HTML
+	raw      bool
+	chunks   chan pageChunk
+	finished chan struct{}
+	stop     chan struct{}
+
+	decoder  *textDecoder
+	parser   HtmlParser
+	text     strings.Builder
+	document *HtmlElement
+	received int
+	expected int
+	done     bool
+	err      error
+}
+
+type pageChunk struct {
+	data []byte
+	// how much of the body has arrived so far, as it came over the wire
+	received int
+	// set on the last chunk: io.EOF if the whole body was read
+	err error
+}
+
+// how much of the body is read at a time
+const PAGE_LOADER_CHUNK_SIZE = 16 * 1024
+
+// StartPageLoader starts reading the body of `response`. `raw` is passed on to `Engine`.
+func StartPageLoader(response GenericResponse, raw bool) *PageLoader {
+	mimeType, hasType := response.GetContentType()
+	loader := &PageLoader{
+		raw:      raw,
+		chunks:   make(chan pageChunk),
+		finished: make(chan struct{}),
+		stop:     make(chan struct{}),
+		decoder:  newTextDecoder(mimeType, hasType),
+		expected: expectedBodyLength(response),
+	}
+
+	httpResponse, isHttp := response.(*HttpResponse)
+	// only a body that is still on the network has its progress counted before content codings are removed
+	countEncoded := isHttp && httpResponse.body != nil
+	body := response.OpenBody()
+	go loader.read(body, func(n int) int {
+		if countEncoded {
+			return httpResponse.EncodedLength
+		}
+		return n
+	})
+	return loader
+}
+
+// `received` says how much of the body has arrived, given how many bytes have been read from `body`
+func (loader *PageLoader) read(body io.ReadCloser, received func(int) int) {
+	defer close(loader.finished)
+	defer body.Close()
+
+	total := 0
+	buffer := make([]byte, PAGE_LOADER_CHUNK_SIZE)
+	for {
+		n, err := body.Read(buffer)
+		total += n
+		if n == 0 && err == nil {
+			continue
+		}
+
+		chunk := pageChunk{data: bytes.Clone(buffer[:n]), received: received(total), err: err}
+		select {
+		case loader.chunks <- chunk:
+		case <-loader.stop:
+			return
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// Poll takes whatever has arrived since the last call, without waiting for more, and reports whether the document
+// changed.
+func (loader *PageLoader) Poll() bool {
+	changed := false
+	for !loader.done {
+		select {
+		case chunk := <-loader.chunks:
+			loader.handle(chunk)
+			changed = true
+		default:
+			return changed
+		}
+	}
+	return changed
+}
+
+func (loader *PageLoader) handle(chunk pageChunk) {
+	loader.received = chunk.received
+	text := loader.decoder.Write(chunk.data)
+	if chunk.err != nil {
+		text += loader.decoder.Flush()
+		loader.done = true
+		if chunk.err != io.EOF {
+			loader.err = chunk.err
+		}
+	}
+
+	if loader.raw {
+		loader.text.WriteString(text)
+	} else {
+		loader.parser.Feed(text)
+		if loader.done {
+			loader.document = loader.parser.Finish()
+		}
+	}
+}
+
+// Document returns the document as loaded so far.
+func (loader *PageLoader) Document() *HtmlElement {
+	if loader.raw {
+		return &HtmlElement{Text: loader.text.String()}
+	}
+	if loader.document != nil {
+		return loader.document
+	}
+	return loader.parser.Snapshot()
+}
+
+// Done reports whether the whole body has been read, or reading it failed (see `Err`).
+func (loader *PageLoader) Done() bool {
+	return loader.done
+}
+
+// Err returns the error that stopped the body from being read, if any.
+func (loader *PageLoader) Err() error {
+	return loader.err
+}
+
+// Progress returns the fraction of the body that has arrived, or -1 if the size of the body isn't known in advance.
+func (loader *PageLoader) Progress() float32 {
+	if loader.expected <= 0 {
+		return -1
+	}
+	return min(float32(loader.received)/float32(loader.expected), 1)
+}
+
+// Finished returns a channel that is closed once the loader has stopped reading the body.
+func (loader *PageLoader) Finished() <-chan struct{} {
+	return loader.finished
+}
+
+// Close stops reading the body. A read that is already waiting on the network is only interrupted by `Cancel`, or
+// when the context of the fetch is otherwise done.
+func (loader *PageLoader) Close() {
+	select {
+	case <-loader.stop:
+	default:
+		close(loader.stop)
+		if loader.Cancel != nil {
+			loader.Cancel()
+		}
+	}
+}
+
+// Stop gives up on the rest of the body, e.g., because the user is tired of waiting, and treats what has arrived so
+// far as the whole page. It does nothing once the page is done.
+func (loader *PageLoader) Stop() {
+	if loader.done {
+		return
+	}
+	loader.Close()
+	PrintVerbose(fmt.Sprintf("stopped loading page after %d bytes", loader.received))
+	loader.handle(pageChunk{received: loader.received, err: io.EOF})
+}
+
+// the size of the body as it will come over the wire, or -1 if it isn't known in advance
+func expectedBodyLength(response GenericResponse) int {
+	httpResponse, ok := response.(*HttpResponse)
+	if !ok || httpResponse.body == nil {
+		return len(response.GetBody())
+	}
+
+	headers := httpResponse.Headers
+	if headers.Has("transfer-encoding") || !headers.Has("content-length") {
+		return -1
+	}
+	length, err := parseContentLength(headers.Values("content-length"))
+	if err != nil {
+		return -1
+	}
+	return length
+}
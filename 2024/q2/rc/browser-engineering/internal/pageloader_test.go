@@ -0,0 +1,131 @@
+package internal
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPageLoader(t *testing.T) {
+	first := "<html><body><p>caf\xE9</p><p>" + strings.Repeat("x", ENCODING_PRESCAN_LENGTH) + "</p><p>Loa"
+	second := "ding</p></body></html>"
+	release := make(chan struct{})
+	server, _ := launchGoServer(t, func(server *http.Server) {
+		server.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "text/html")
+			w.Header().Set("Content-Length", "2000")
+			w.Write([]byte(first))
+			w.(http.Flusher).Flush()
+			<-release
+			w.Write([]byte(second + strings.Repeat(" ", 2000-len(first)-len(second))))
+		})
+	})
+	defer server.Close()
+
+	fetcher := NewUrlFetcher()
+	defer fetcher.Cleanup()
+
+	url, err := ParseUrl(server.URL)
+	assertNoErr(t, err)
+	r, err := fetcher.FetchStream(context.Background(), NewRequest("GET", url, nil))
+	assertNoErr(t, err)
+	loader := StartPageLoader(r, false)
+	defer loader.Close()
+
+	// the start of the page is shown before the rest has arrived
+	pollUntil(t, loader, func() bool { return strings.Contains(loader.Document().String(), "<p>Loa</p>") })
+	if loader.Done() {
+		t.Fatalf("loader should not be done before the server has finished")
+	}
+	if progress := loader.Progress(); progress <= 0 || progress >= 1 {
+		t.Errorf("unexpected progress: %f", progress)
+	}
+	if !strings.Contains(loader.Document().String(), "<p>café</p>") {
+		t.Errorf("unexpected partial document: %s", loader.Document().String())
+	}
+
+	close(release)
+	pollUntil(t, loader, loader.Done)
+	assertNoErr(t, loader.Err())
+	if !strings.Contains(loader.Document().String(), "<p>Loading</p>") {
+		t.Errorf("unexpected document: %s", loader.Document().String())
+	}
+	assertStrEqual(t, loader.decoder.encoding, "windows-1252")
+	<-loader.Finished()
+}
+
+func TestPageLoaderStop(t *testing.T) {
+	release := make(chan struct{})
+	server, _ := launchGoServer(t, func(server *http.Server) {
+		server.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "text/html")
+			w.Header().Set("Content-Length", "1000")
+			w.Write([]byte("<p>partial"))
+			w.(http.Flusher).Flush()
+			<-release
+		})
+	})
+	defer server.Close()
+	defer close(release)
+
+	fetcher := NewUrlFetcher()
+	defer fetcher.Cleanup()
+
+	url, err := ParseUrl(server.URL)
+	assertNoErr(t, err)
+	ctx, cancel := context.WithCancel(context.Background())
+	r, err := fetcher.FetchStream(ctx, NewRequest("GET", url, nil))
+	assertNoErr(t, err)
+	loader := StartPageLoader(r, false)
+	loader.Cancel = cancel
+	defer loader.Close()
+
+	// too little has arrived for the encoding to be settled, so stopping must flush it
+	pollUntil(t, loader, func() bool { return loader.Progress() > 0 })
+	loader.Stop()
+	if !loader.Done() {
+		t.Errorf("loader should be done once stopped")
+	}
+	assertNoErr(t, loader.Err())
+	if !strings.Contains(loader.Document().String(), "<p>partial</p>") {
+		t.Errorf("unexpected document: %s", loader.Document().String())
+	}
+
+	// the read that was waiting on the server is interrupted
+	select {
+	case <-loader.Finished():
+	case <-time.After(5 * time.Second):
+		t.Fatalf("loader kept reading after being stopped")
+	}
+}
+
+func TestPageLoaderRaw(t *testing.T) {
+	url, err := ParseUrl("data:text/plain,<p>not html</p>")
+	assertNoErr(t, err)
+	fetcher := NewUrlFetcher()
+	defer fetcher.Cleanup()
+	r, err := fetcher.Fetch(url)
+	assertNoErr(t, err)
+
+	loader := StartPageLoader(r, true)
+	defer loader.Close()
+	pollUntil(t, loader, loader.Done)
+	assertStrEqual(t, loader.Document().Text, "<p>not html</p>")
+	if loader.Progress() != 1 {
+		t.Errorf("unexpected progress: %f", loader.Progress())
+	}
+}
+
+func pollUntil(t *testing.T, loader *PageLoader, condition func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatalf("gave up waiting for page loader")
+		}
+		loader.Poll()
+		time.Sleep(time.Millisecond)
+	}
+}
@@ -0,0 +1,354 @@
+package internal
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestHttpProxy(t *testing.T) {
+	// a forwarding proxy that answers for every server itself
+	proxyServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "%s %s host=%s auth=%s", r.Method, r.RequestURI, r.Host, r.Header.Get("Proxy-Authorization"))
+	}))
+	defer proxyServer.Close()
+
+	proxy, err := ParseProxyUrl(strings.Replace(proxyServer.URL, "http://", "http://alice:s%40cret@", 1))
+	assertNoErr(t, err)
+	fetcher := NewUrlFetcher()
+	fetcher.Proxy = &ProxyConfig{HttpProxy: proxy}
+	defer fetcher.Cleanup()
+
+	url, err := ParseUrl("http://example.com:8080/path?q=1#fragment")
+	assertNoErr(t, err)
+	r, err := fetcher.Fetch(url)
+	assertNoErr(t, err)
+	// "alice:s@cret"
+	assertStrEqual(t, string(r.GetBody()), "GET http://example.com:8080/path?q=1 host=example.com:8080 auth=Basic YWxpY2U6c0BjcmV0")
+
+	// requests for different servers share the connection to the proxy
+	url, err = ParseUrl("http://example.org/")
+	assertNoErr(t, err)
+	r, err = fetcher.Fetch(url)
+	assertNoErr(t, err)
+	assertStrEqual(t, string(r.GetBody()), "GET http://example.org/ host=example.org auth=Basic YWxpY2U6c0BjcmV0")
+	assertIntEqual(t, len(fetcher.conns.idle), 1)
+}
+
+func TestConnectProxy(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("tunnelled"))
+	}))
+	defer server.Close()
+
+	proxyAddress, tunnels := launchConnectProxy(t, "Basic Ym9iOmh1bnRlcjI=")
+
+	url, err := ParseUrl(server.URL)
+	assertNoErr(t, err)
+
+	fetcher := fetcherWithTlsOptions(t, TlsOptions{Insecure: true})
+	proxy, err := ParseProxyUrl("bob:hunter2@" + proxyAddress)
+	assertNoErr(t, err)
+	fetcher.Proxy = &ProxyConfig{HttpsProxy: proxy}
+	r, err := fetcher.Fetch(url)
+	assertNoErr(t, err)
+	assertStrEqual(t, string(r.GetBody()), "tunnelled")
+	if r.(*HttpResponse).Tls == nil {
+		t.Errorf("expected TLS info for a tunnelled connection")
+	}
+
+	// the tunnel is reused
+	_, err = fetcher.Fetch(url)
+	assertNoErr(t, err)
+	assertIntEqual(t, len(tunnels()), 1)
+	assertStrEqual(t, tunnels()[0], strings.TrimPrefix(server.URL, "https://"))
+	fetcher.Cleanup()
+
+	fetcher = fetcherWithTlsOptions(t, TlsOptions{Insecure: true})
+	proxy, err = ParseProxyUrl("http://" + proxyAddress)
+	assertNoErr(t, err)
+	fetcher.Proxy = &ProxyConfig{HttpsProxy: proxy}
+	_, err = fetcher.Fetch(url)
+	if err == nil || !strings.Contains(err.Error(), "proxy requires authentication") {
+		t.Errorf("expected proxy authentication error, got %v", err)
+	}
+	fetcher.Cleanup()
+}
+
+func TestSocks5Proxy(t *testing.T) {
+	server := launchEchoServer(t)
+	defer server.Close()
+	_, port, err := net.SplitHostPort(strings.TrimPrefix(server.URL, "http://"))
+	assertNoErr(t, err)
+
+	testCases := []struct {
+		proxy       string
+		url         string
+		credentials string
+		destination string
+	}{
+		{"socks5://%s", "http://127.0.0.1:" + port + "/a", "", "127.0.0.1:" + port},
+		// the proxy resolves the name
+		{"socks5h://%s", "http://localhost:" + port + "/b", "", "localhost:" + port},
+		{"socks5h://carol:pw@%s", "http://localhost:" + port + "/c", "carol:pw", "localhost:" + port},
+	}
+
+	for _, testCase := range testCases {
+		proxyAddress, destinations := launchSocks5Proxy(t, testCase.credentials)
+		proxy, err := ParseProxyUrl(fmt.Sprintf(testCase.proxy, proxyAddress))
+		assertNoErr(t, err)
+
+		fetcher := NewUrlFetcher()
+		fetcher.Proxy = &ProxyConfig{HttpProxy: proxy}
+		url, err := ParseUrl(testCase.url)
+		assertNoErr(t, err)
+		r, err := fetcher.Fetch(url)
+		assertNoErr(t, err)
+		assertStrEqual(t, string(r.GetBody()), "GET "+url.Path+" length=0 type= body=")
+		assertIntEqual(t, len(destinations()), 1)
+		assertStrEqual(t, destinations()[0], testCase.destination)
+		fetcher.Cleanup()
+	}
+
+	proxyAddress, _ := launchSocks5Proxy(t, "carol:pw")
+	proxy, err := ParseProxyUrl("socks5://carol:wrong@" + proxyAddress)
+	assertNoErr(t, err)
+	fetcher := NewUrlFetcher()
+	defer fetcher.Cleanup()
+	fetcher.Proxy = &ProxyConfig{HttpProxy: proxy}
+	url, err := ParseUrl(server.URL)
+	assertNoErr(t, err)
+	_, err = fetcher.Fetch(url)
+	if err == nil || !strings.Contains(err.Error(), "rejected our credentials") {
+		t.Errorf("expected SOCKS authentication error, got %v", err)
+	}
+}
+
+func TestProxyConfig(t *testing.T) {
+	t.Setenv("http_proxy", "proxy.example:3128")
+	t.Setenv("HTTPS_PROXY", "socks5h://user@socks.example")
+	t.Setenv("no_proxy", "internal.example, .corp.example,10.0.0.0/8,[::1],localhost:8080")
+
+	config, err := ProxyConfigFromEnvironment()
+	assertNoErr(t, err)
+
+	testCases := []struct {
+		url      string
+		expected string
+	}{
+		{"http://example.com/", "http://proxy.example:3128"},
+		{"https://example.com/", "socks5h://user@socks.example:1080"},
+		{"http://internal.example/", ""},
+		{"https://www.internal.example/", ""},
+		{"http://notinternal.example/", "http://proxy.example:3128"},
+		{"http://corp.example/", ""},
+		{"http://a.b.corp.example/", ""},
+		{"http://10.1.2.3/", ""},
+		{"http://11.1.2.3/", "http://proxy.example:3128"},
+		{"http://[::1]:8000/", ""},
+		{"http://localhost:8080/", ""},
+		{"http://localhost:8081/", "http://proxy.example:3128"},
+	}
+
+	for _, testCase := range testCases {
+		url, err := ParseUrl(testCase.url)
+		assertNoErr(t, err)
+		proxy := config.proxyFor(url)
+		actual := ""
+		if proxy != nil {
+			actual = fmt.Sprintf("%s://%s", proxy.Scheme, proxy.hostAndPort())
+			if proxy.Username != "" {
+				actual = fmt.Sprintf("%s://%s@%s", proxy.Scheme, proxy.Username, proxy.hostAndPort())
+			}
+		}
+		if actual != testCase.expected {
+			t.Errorf("proxy for %s: expected %q, got %q", testCase.url, testCase.expected, actual)
+		}
+	}
+
+	t.Setenv("no_proxy", "*")
+	config, err = ProxyConfigFromEnvironment()
+	assertNoErr(t, err)
+	url, err := ParseUrl("http://example.com/")
+	assertNoErr(t, err)
+	if config.proxyFor(url) != nil {
+		t.Errorf("expected no_proxy=* to disable the proxy")
+	}
+
+	for _, text := range []string{"ftp://proxy.example", "https://proxy.example", "http://proxy.example/path", "http://"} {
+		_, err := ParseProxyUrl(text)
+		if err == nil {
+			t.Errorf("expected error for proxy URL %q", text)
+		}
+	}
+}
+
+// A proxy that only supports CONNECT, requiring `authorization` if it isn't empty. The second return value lists
+// the addresses that tunnels were opened to.
+func launchConnectProxy(t *testing.T, authorization string) (string, func() []string) {
+	t.Helper()
+	var mu sync.Mutex
+	tunnels := []string{}
+
+	listener := launchTcpServer(t, func(conn net.Conn) {
+		reader := bufio.NewReader(conn)
+		request, err := http.ReadRequest(reader)
+		if err != nil {
+			return
+		}
+		if request.Method != "CONNECT" {
+			io.WriteString(conn, "HTTP/1.1 405 Method Not Allowed\r\nContent-Length: 0\r\n\r\n")
+			return
+		}
+		if authorization != "" && request.Header.Get("Proxy-Authorization") != authorization {
+			io.WriteString(conn, "HTTP/1.1 407 Proxy Authentication Required\r\nProxy-Authenticate: Basic\r\nContent-Length: 0\r\n\r\n")
+			return
+		}
+
+		server, err := net.Dial("tcp", request.Host)
+		if err != nil {
+			io.WriteString(conn, "HTTP/1.1 502 Bad Gateway\r\nContent-Length: 0\r\n\r\n")
+			return
+		}
+		defer server.Close()
+		mu.Lock()
+		tunnels = append(tunnels, request.Host)
+		mu.Unlock()
+
+		io.WriteString(conn, "HTTP/1.1 200 Connection Established\r\n\r\n")
+		pipe(conn, server)
+	})
+
+	return listener.Addr().String(), func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]string{}, tunnels...)
+	}
+}
+
+// A SOCKS5 proxy, requiring `credentials` (as "user:password") if it isn't empty. The second return value lists the
+// destinations that clients asked for.
+func launchSocks5Proxy(t *testing.T, credentials string) (string, func() []string) {
+	t.Helper()
+	var mu sync.Mutex
+	destinations := []string{}
+
+	listener := launchTcpServer(t, func(conn net.Conn) {
+		reader := bufio.NewReader(conn)
+		head := make([]byte, 2)
+		if _, err := io.ReadFull(reader, head); err != nil {
+			return
+		}
+		methods := make([]byte, head[1])
+		if _, err := io.ReadFull(reader, methods); err != nil {
+			return
+		}
+
+		if credentials == "" {
+			conn.Write([]byte{5, 0})
+		} else {
+			if !strings.Contains(string(methods), "\x02") {
+				conn.Write([]byte{5, 0xff})
+				return
+			}
+			conn.Write([]byte{5, 2})
+			version, _ := reader.ReadByte()
+			length, _ := reader.ReadByte()
+			username := make([]byte, length)
+			io.ReadFull(reader, username)
+			length, _ = reader.ReadByte()
+			password := make([]byte, length)
+			io.ReadFull(reader, password)
+			if version != 1 || string(username)+":"+string(password) != credentials {
+				conn.Write([]byte{1, 1})
+				return
+			}
+			conn.Write([]byte{1, 0})
+		}
+
+		request := make([]byte, 4)
+		if _, err := io.ReadFull(reader, request); err != nil {
+			return
+		}
+		var host string
+		switch request[3] {
+		case 1:
+			ip := make([]byte, 4)
+			io.ReadFull(reader, ip)
+			host = net.IP(ip).String()
+		case 3:
+			length, _ := reader.ReadByte()
+			name := make([]byte, length)
+			io.ReadFull(reader, name)
+			host = string(name)
+		default:
+			conn.Write([]byte{5, 8, 0, 1, 0, 0, 0, 0, 0, 0})
+			return
+		}
+		port := make([]byte, 2)
+		io.ReadFull(reader, port)
+		destination := net.JoinHostPort(host, fmt.Sprint(binary.BigEndian.Uint16(port)))
+
+		server, err := net.Dial("tcp", destination)
+		if err != nil {
+			conn.Write([]byte{5, 5, 0, 1, 0, 0, 0, 0, 0, 0})
+			return
+		}
+		defer server.Close()
+		mu.Lock()
+		destinations = append(destinations, destination)
+		mu.Unlock()
+
+		conn.Write([]byte{5, 0, 0, 1, 127, 0, 0, 1, 0, 0})
+		pipe(conn, server)
+	})
+
+	return listener.Addr().String(), func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]string{}, destinations...)
+	}
+}
+
+// runs `handle` on each connection in its own goroutine, until the test ends
+func launchTcpServer(t *testing.T, handle func(conn net.Conn)) net.Listener {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assertNoErr(t, err)
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				handle(conn)
+			}()
+		}
+	}()
+	return listener
+}
+
+// copies data in both directions until either side closes
+func pipe(a net.Conn, b net.Conn) {
+	done := make(chan struct{}, 2)
+	go func() {
+		io.Copy(a, b)
+		done <- struct{}{}
+	}()
+	go func() {
+		io.Copy(b, a)
+		done <- struct{}{}
+	}()
+	<-done
+}
@@ -0,0 +1,81 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// The zero value follows no redirects at all, i.e. 3xx responses are returned to the caller as-is.
+type RedirectPolicy struct {
+	// maximum number of redirects to follow before giving up
+	MaxRedirects int
+	// refuse to follow redirects to a different scheme, host or port
+	SameOriginOnly bool
+	// allow redirects from https to plain http, which would expose the rest of the exchange to eavesdroppers
+	AllowDowngrade bool
+}
+
+type RedirectHop struct {
+	// the URL that responded with a redirect
+	Url    Url
+	Status int
+}
+
+// same as the WHATWG Fetch standard
+const DEFAULT_MAX_REDIRECTS = 20
+
+var ErrTooManyRedirects = errors.New("too many redirects")
+var ErrRedirectLoop = errors.New("redirect loop")
+var ErrCrossOriginRedirect = errors.New("cross-origin redirect not allowed")
+var ErrInsecureRedirect = errors.New("redirect from https to http not allowed")
+
+func isRedirectStatus(status int) bool {
+	return status == 301 || status == 302 || status == 303 || status == 307 || status == 308
+}
+
+func (policy RedirectPolicy) check(from Url, to Url) error {
+	if to.Scheme != "http" && to.Scheme != "https" {
+		return fmt.Errorf("redirect to unsupported scheme: %s", to.Original)
+	}
+
+	if policy.SameOriginOnly && from.Origin() != to.Origin() {
+		return fmt.Errorf("%w: %s to %s", ErrCrossOriginRedirect, from.Original, to.Original)
+	}
+
+	if !policy.AllowDowngrade && from.Scheme == "https" && to.Scheme == "http" {
+		return fmt.Errorf("%w: %s to %s", ErrInsecureRedirect, from.Original, to.Original)
+	}
+
+	return nil
+}
+
+// identifies a request for the purposes of loop detection. Coming back to the same URL isn't a loop if the method or
+// the cookies have changed in the meantime, e.g., a POST that redirects (303) to a GET of the same URL, or a redirect
+// that sets a cookie and bounces back to where it came from.
+func (fetcher *UrlFetcher) redirectKey(request *Request) string {
+	url := request.Url.withoutFragment()
+	cookies, ok := request.Headers.Lookup("cookie")
+	if !ok && fetcher.Cookies != nil {
+		cookies = fetcher.Cookies.CookieHeader(url, time.Now())
+	}
+	return request.Method + " " + url.String() + "\n" + cookies
+}
+
+// Returns the method to use for the redirected request. If the method changes, the request body should be dropped.
+//
+// 303 always means "go GET the result". For historical reasons, browsers also turn a POST into a GET on 301 and 302,
+// even though RFC 9110 says they shouldn't. 307 and 308 exist precisely so that the method is preserved.
+func redirectMethod(status int, method string) string {
+	switch status {
+	case 301, 302:
+		if method == "POST" {
+			return "GET"
+		}
+	case 303:
+		if method != "GET" && method != "HEAD" {
+			return "GET"
+		}
+	}
+	return method
+}
@@ -0,0 +1,191 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestFollowRedirects(t *testing.T) {
+	server := launchRedirectServer(t)
+	defer server.Close()
+
+	fetcher := NewUrlFetcher()
+	defer fetcher.Cleanup()
+
+	url, err := ParseUrl(server.URL + "/a#sec")
+	assertNoErr(t, err)
+	r, err := fetcher.Fetch(url)
+	assertNoErr(t, err)
+
+	httpResponse := r.(*HttpResponse)
+	assertStrEqual(t, string(httpResponse.Body), "done")
+	assertStrEqual(t, httpResponse.Url.Path, "/c")
+	// the fragment carries over from the original URL
+	assertStrEqual(t, httpResponse.Url.Fragment, "sec")
+	assertIntEqual(t, len(httpResponse.RedirectChain), 2)
+	assertStrEqual(t, httpResponse.RedirectChain[0].Url.Path, "/a")
+	assertIntEqual(t, httpResponse.RedirectChain[0].Status, 301)
+	assertStrEqual(t, httpResponse.RedirectChain[1].Url.Path, "/b")
+	assertIntEqual(t, httpResponse.RedirectChain[1].Status, 302)
+
+	fetcher.RedirectPolicy.MaxRedirects = 1
+	_, err = fetcher.Fetch(url)
+	if !errors.Is(err, ErrTooManyRedirects) {
+		t.Errorf("expected ErrTooManyRedirects, got %v", err)
+	}
+
+	fetcher.RedirectPolicy.MaxRedirects = 0
+	r, err = fetcher.Fetch(url)
+	assertNoErr(t, err)
+	assertIntEqual(t, r.(*HttpResponse).Status, 301)
+	assertIntEqual(t, len(r.(*HttpResponse).RedirectChain), 0)
+}
+
+func TestRedirectLoop(t *testing.T) {
+	server := launchRedirectServer(t)
+	defer server.Close()
+
+	fetcher := NewUrlFetcher()
+	defer fetcher.Cleanup()
+
+	url, err := ParseUrl(server.URL + "/loop1")
+	assertNoErr(t, err)
+	_, err = fetcher.Fetch(url)
+	if !errors.Is(err, ErrRedirectLoop) {
+		t.Errorf("expected ErrRedirectLoop, got %v", err)
+	}
+}
+
+// returning to a URL with a different method or different cookies isn't a loop
+func TestRedirectBackToSameUrl(t *testing.T) {
+	server := launchRedirectServer(t)
+	defer server.Close()
+
+	fetcher := NewUrlFetcher()
+	defer fetcher.Cleanup()
+
+	url, err := ParseUrl(server.URL + "/form")
+	assertNoErr(t, err)
+	r, err := fetcher.FetchRequest(context.Background(), NewRequest("POST", url, strings.NewReader("x=1")))
+	assertNoErr(t, err)
+	assertStrEqual(t, string(r.GetBody()), "form")
+	assertIntEqual(t, len(r.(*HttpResponse).RedirectChain), 1)
+
+	fetcher.Cookies = NewCookieJar()
+	url, err = ParseUrl(server.URL + "/bounce")
+	assertNoErr(t, err)
+	r, err = fetcher.Fetch(url)
+	assertNoErr(t, err)
+	assertStrEqual(t, string(r.GetBody()), "welcome back")
+	assertIntEqual(t, len(r.(*HttpResponse).RedirectChain), 2)
+}
+
+func TestSameOriginRedirectPolicy(t *testing.T) {
+	other := launchRedirectServer(t)
+	defer other.Close()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, other.URL+"/c", http.StatusFound)
+	}))
+	defer server.Close()
+
+	fetcher := NewUrlFetcher()
+	defer fetcher.Cleanup()
+
+	url, err := ParseUrl(server.URL)
+	assertNoErr(t, err)
+	r, err := fetcher.Fetch(url)
+	assertNoErr(t, err)
+	assertStrEqual(t, string(r.GetBody()), "done")
+
+	fetcher.RedirectPolicy.SameOriginOnly = true
+	_, err = fetcher.Fetch(url)
+	if !errors.Is(err, ErrCrossOriginRedirect) {
+		t.Errorf("expected ErrCrossOriginRedirect, got %v", err)
+	}
+}
+
+func TestRedirectDowngrade(t *testing.T) {
+	from, err := ParseUrl("https://example.com/login")
+	assertNoErr(t, err)
+	to, err := ParseUrl("http://example.com/home")
+	assertNoErr(t, err)
+
+	policy := RedirectPolicy{MaxRedirects: DEFAULT_MAX_REDIRECTS}
+	err = policy.check(from, to)
+	if !errors.Is(err, ErrInsecureRedirect) {
+		t.Errorf("expected ErrInsecureRedirect, got %v", err)
+	}
+
+	policy.AllowDowngrade = true
+	assertNoErr(t, policy.check(from, to))
+
+	// upgrades are always fine
+	policy.AllowDowngrade = false
+	assertNoErr(t, policy.check(to, from))
+}
+
+func TestRedirectMethod(t *testing.T) {
+	cases := []struct {
+		status   int
+		method   string
+		expected string
+	}{
+		{301, "GET", "GET"},
+		{301, "POST", "GET"},
+		{301, "PUT", "PUT"},
+		{302, "POST", "GET"},
+		{303, "POST", "GET"},
+		{303, "PUT", "GET"},
+		{303, "HEAD", "HEAD"},
+		{307, "POST", "POST"},
+		{308, "PUT", "PUT"},
+	}
+
+	for _, c := range cases {
+		assertStrEqual(t, redirectMethod(c.status, c.method), c.expected)
+	}
+}
+
+// /a redirects (301) to /b, which redirects (302) to /c; /loop1 and /loop2 redirect to each other; a POST to /form
+// redirects (303) to a GET of /form; /bounce redirects to /set-cookie, which sets a cookie and redirects back
+func launchRedirectServer(t *testing.T) *httptest.Server {
+	t.Helper()
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/a":
+			http.Redirect(w, r, "/b", http.StatusMovedPermanently)
+		case "/b":
+			// relative to the current path
+			http.Redirect(w, r, "c", http.StatusFound)
+		case "/c":
+			fmt.Fprint(w, "done")
+		case "/loop1":
+			http.Redirect(w, r, "/loop2", http.StatusTemporaryRedirect)
+		case "/loop2":
+			http.Redirect(w, r, "/loop1", http.StatusPermanentRedirect)
+		case "/form":
+			if r.Method == "POST" {
+				http.Redirect(w, r, "/form", http.StatusSeeOther)
+			} else {
+				fmt.Fprint(w, "form")
+			}
+		case "/bounce":
+			if _, err := r.Cookie("visited"); err == nil {
+				fmt.Fprint(w, "welcome back")
+			} else {
+				http.Redirect(w, r, "/set-cookie", http.StatusFound)
+			}
+		case "/set-cookie":
+			http.SetCookie(w, &http.Cookie{Name: "visited", Value: "1"})
+			http.Redirect(w, r, "/bounce", http.StatusFound)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+}
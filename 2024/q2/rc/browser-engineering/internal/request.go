@@ -0,0 +1,107 @@
+package internal
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+// An HTTP request, for `UrlFetcher.FetchRequest`. Non-HTTP URLs only support GET.
+type Request struct {
+	Method string
+	Url    Url
+	// sent in addition to the fetcher's own headers, replacing any with the same name. Content-Length is computed
+	// from the body, so it (and Transfer-Encoding) can't be set here.
+	Headers Headers
+	// nil for a request without a body. It is read in full before the request is sent, so that the request can be
+	// sent again after a redirect or a retry.
+	Body io.Reader
+
+	// the contents of `Body`, once it has been read
+	body []byte
+}
+
+func NewRequest(method string, url Url, body io.Reader) *Request {
+	return &Request{Method: method, Url: url, Body: body}
+}
+
+// how long to wait for a "100 Continue" response before sending the body anyway (RFC 9110, section 10.1.1)
+const EXPECT_CONTINUE_TIMEOUT = 1 * time.Second
+
+// WHATWG Fetch standard, section 4.4: headers that describe the body, and so are dropped along with it when a
+// redirect changes the method
+var REQUEST_BODY_HEADERS = []string{"content-encoding", "content-language", "content-location", "content-type"}
+
+// reads `Body` into memory and returns a copy of the request that is ready to send
+func (request *Request) prepare() (*Request, error) {
+	if !isHttpToken(request.Method) {
+		return nil, fmt.Errorf("invalid HTTP method: %q", request.Method)
+	}
+
+	r := request.clone()
+	if request.Body != nil {
+		body, err := io.ReadAll(request.Body)
+		if err != nil {
+			return nil, fmt.Errorf("could not read request body: %w", err)
+		}
+		r.body = body
+		r.Body = nil
+	}
+	return r, nil
+}
+
+// a copy of the request whose headers can be modified without affecting the original
+func (request *Request) clone() *Request {
+	r := *request
+	r.Headers = request.Headers.Clone()
+	return &r
+}
+
+// the request for the same resource with a different method and no body
+func (request *Request) withMethod(method string) *Request {
+	r := request.clone()
+	r.Method = method
+	r.body = nil
+	for _, name := range REQUEST_BODY_HEADERS {
+		r.Headers.Del(name)
+	}
+	return r
+}
+
+// the value of the Content-Length header, or false if the request shouldn't have one
+func (request *Request) contentLength() (int, bool) {
+	if request.body != nil {
+		return len(request.body), true
+	}
+	// RFC 9110, section 8.6: a POST or PUT without a body should still say so, since those methods normally have one
+	if request.Method == "POST" || request.Method == "PUT" {
+		return 0, true
+	}
+	return 0, false
+}
+
+func (request *Request) expectsContinue() bool {
+	return len(request.body) > 0 && hasHttpToken(request.Headers.GetList("expect"), "100-continue")
+}
+
+// whether the request carries its own validators or range, in which case the caller wants to see the server's
+// response (e.g., a 304) rather than have the cache answer for it
+func (request *Request) isConditional() bool {
+	for _, name := range []string{"if-none-match", "if-modified-since", "if-match", "if-unmodified-since", "if-range", "range"} {
+		if request.Headers.Has(name) {
+			return true
+		}
+	}
+	return false
+}
+
+// RFC 9110, section 9.2.1
+func isSafeMethod(method string) bool {
+	switch strings.ToUpper(method) {
+	case "GET", "HEAD", "OPTIONS", "TRACE":
+		return true
+	default:
+		return false
+	}
+}
@@ -0,0 +1,230 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestPostRequest(t *testing.T) {
+	server := launchEchoServer(t)
+	defer server.Close()
+
+	fetcher := NewUrlFetcher()
+	defer fetcher.Cleanup()
+
+	url, err := ParseUrl(server.URL + "/echo")
+	assertNoErr(t, err)
+	request := NewRequest("POST", url, strings.NewReader("a=1&b=2"))
+	request.Headers.Add("Content-Type", "application/x-www-form-urlencoded")
+	// ignored in favor of the actual length
+	request.Headers.Add("Content-Length", "1000")
+
+	r, err := fetcher.FetchRequest(context.Background(), request)
+	assertNoErr(t, err)
+	assertStrEqual(t, string(r.GetBody()), "POST /echo length=7 type=application/x-www-form-urlencoded body=a=1&b=2")
+
+	request = NewRequest("PUT", url, strings.NewReader(`{"x": 1}`))
+	r, err = fetcher.FetchRequest(context.Background(), request)
+	assertNoErr(t, err)
+	assertStrEqual(t, string(r.GetBody()), `PUT /echo length=8 type= body={"x": 1}`)
+}
+
+func TestHeadRequest(t *testing.T) {
+	server := launchEchoServer(t)
+	defer server.Close()
+
+	fetcher := NewUrlFetcher()
+	defer fetcher.Cleanup()
+
+	url, err := ParseUrl(server.URL + "/echo")
+	assertNoErr(t, err)
+	r, err := fetcher.FetchRequest(context.Background(), NewRequest("HEAD", url, nil))
+	assertNoErr(t, err)
+	httpResponse := r.(*HttpResponse)
+	assertIntEqual(t, httpResponse.Status, 200)
+	assertStrEqual(t, string(httpResponse.Body), "")
+
+	// the connection is still usable afterwards
+	r, err = fetcher.Fetch(url)
+	assertNoErr(t, err)
+	assertStrEqual(t, string(r.GetBody()), "GET /echo length=0 type= body=")
+}
+
+func TestRedirectDropsBody(t *testing.T) {
+	server := launchEchoServer(t)
+	defer server.Close()
+
+	fetcher := NewUrlFetcher()
+	defer fetcher.Cleanup()
+
+	testCases := []struct {
+		status   int
+		expected string
+	}{
+		{303, "GET /echo length=0 type= body="},
+		{302, "GET /echo length=0 type= body="},
+		{307, "POST /echo length=5 type=text/plain body=hello"},
+		{308, "POST /echo length=5 type=text/plain body=hello"},
+	}
+
+	for _, testCase := range testCases {
+		url, err := ParseUrl(fmt.Sprintf("%s/redirect?status=%d", server.URL, testCase.status))
+		assertNoErr(t, err)
+		request := NewRequest("POST", url, strings.NewReader("hello"))
+		request.Headers.Add("Content-Type", "text/plain")
+
+		r, err := fetcher.FetchRequest(context.Background(), request)
+		assertNoErr(t, err)
+		assertStrEqual(t, string(r.GetBody()), testCase.expected)
+	}
+}
+
+func TestExpectContinue(t *testing.T) {
+	server := launchEchoServer(t)
+	defer server.Close()
+
+	fetcher := NewUrlFetcher()
+	defer fetcher.Cleanup()
+
+	url, err := ParseUrl(server.URL + "/echo")
+	assertNoErr(t, err)
+	request := NewRequest("POST", url, strings.NewReader("big upload"))
+	request.Headers.Add("Expect", "100-continue")
+	r, err := fetcher.FetchRequest(context.Background(), request)
+	assertNoErr(t, err)
+	assertStrEqual(t, string(r.GetBody()), "POST /echo length=10 type= body=big upload")
+
+	// the server answers without reading the body, so it's never sent
+	url, err = ParseUrl(server.URL + "/reject")
+	assertNoErr(t, err)
+	request = NewRequest("POST", url, strings.NewReader("big upload"))
+	request.Headers.Add("Expect", "100-continue")
+	r, err = fetcher.FetchRequest(context.Background(), request)
+	assertNoErr(t, err)
+	assertIntEqual(t, r.(*HttpResponse).Status, 413)
+
+	r, err = fetcher.Fetch(url)
+	assertNoErr(t, err)
+	assertIntEqual(t, r.(*HttpResponse).Status, 413)
+}
+
+func TestUnsupportedMethodForScheme(t *testing.T) {
+	fetcher := NewUrlFetcher()
+	defer fetcher.Cleanup()
+
+	url, err := ParseUrl("data:,hello")
+	assertNoErr(t, err)
+	_, err = fetcher.FetchRequest(context.Background(), NewRequest("POST", url, nil))
+	if err == nil {
+		t.Errorf("expected error for POST to data: URL")
+	}
+
+	url, err = ParseUrl("http://example.com/")
+	assertNoErr(t, err)
+	_, err = fetcher.FetchRequest(context.Background(), NewRequest("BAD METHOD", url, nil))
+	if err == nil {
+		t.Errorf("expected error for invalid method")
+	}
+}
+
+func TestUnsafeRequestInvalidatesCache(t *testing.T) {
+	server, requests := launchCacheServer(t)
+	defer server.Close()
+
+	fetcher := NewUrlFetcher()
+	fetcher.Cache = NewMemoryCache()
+	defer fetcher.Cleanup()
+
+	r := fetchHttpForTest(t, &fetcher, server.URL+"/fresh")
+	assertStrEqual(t, string(r.Body), "fresh 1")
+
+	url, err := ParseUrl(server.URL + "/fresh")
+	assertNoErr(t, err)
+	_, err = fetcher.FetchRequest(context.Background(), NewRequest("POST", url, strings.NewReader("update")))
+	assertNoErr(t, err)
+
+	r = fetchHttpForTest(t, &fetcher, server.URL+"/fresh")
+	assertStrEqual(t, string(r.Body), "fresh 3")
+	assertIntEqual(t, int(requests.Load()), 3)
+}
+
+// a server that describes the request it received
+func launchEchoServer(t *testing.T) *httptest.Server {
+	t.Helper()
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/redirect":
+			w.Header().Set("Location", "/echo")
+			var status int
+			fmt.Sscanf(r.URL.Query().Get("status"), "%d", &status)
+			w.WriteHeader(status)
+		case "/reject":
+			w.WriteHeader(http.StatusRequestEntityTooLarge)
+		default:
+			body, _ := io.ReadAll(r.Body)
+			fmt.Fprintf(w, "%s %s length=%d type=%s body=%s", r.Method, r.URL.Path, r.ContentLength, r.Header.Get("Content-Type"), body)
+		}
+	}))
+}
+
+func TestRequestHeaderOrder(t *testing.T) {
+	url, err := ParseUrl("http://example.com:8080/path?q#frag")
+	assertNoErr(t, err)
+
+	request := NewRequest("POST", url, nil)
+	request.Headers.Add("X-Custom", "1")
+	request.Headers.Add("accept", "text/plain")
+	request.Headers.Add("X-Custom", "2")
+	prepared, err := request.prepare()
+	assertNoErr(t, err)
+
+	defaults := Headers{{"User-Agent", "test"}, {"Accept", "*/*"}, {"Accept-Language", "fr"}}
+	expected := "POST /path?q HTTP/1.1\r\n" +
+		"Host: example.com:8080\r\n" +
+		"Connection: keep-alive\r\n" +
+		"User-Agent: test\r\n" +
+		"Accept-Language: fr\r\n" +
+		"X-Custom: 1\r\n" +
+		"accept: text/plain\r\n" +
+		"X-Custom: 2\r\n" +
+		"Content-Length: 0\r\n" +
+		"\r\n"
+
+	// the output is the same every time
+	for i := 0; i < 10; i++ {
+		var buffer bytes.Buffer
+		assertNoErr(t, sendHttpRequestHead(prepared, defaults, nil, &buffer))
+		assertStrEqual(t, buffer.String(), expected)
+	}
+}
+
+func TestDefaultHeaders(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "%s|%s|%s", r.Header.Get("User-Agent"), r.Header.Get("Accept-Language"), r.Header.Get("X-Api-Key"))
+	}))
+	defer server.Close()
+
+	fetcher := NewUrlFetcher()
+	defer fetcher.Cleanup()
+	fetcher.DefaultHeaders.Set("User-Agent", "custom/1.0")
+	fetcher.DefaultHeaders.Add("X-Api-Key", "secret")
+
+	url, err := ParseUrl(server.URL)
+	assertNoErr(t, err)
+	r, err := fetcher.Fetch(url)
+	assertNoErr(t, err)
+	assertStrEqual(t, string(r.GetBody()), "custom/1.0|"+DEFAULT_ACCEPT_LANGUAGE+"|secret")
+
+	// overridden for a single fetch
+	request := NewRequest("GET", url, nil)
+	request.Headers.Add("user-agent", "other/2.0")
+	r, err = fetcher.FetchRequest(context.Background(), request)
+	assertNoErr(t, err)
+	assertStrEqual(t, string(r.GetBody()), "other/2.0|"+DEFAULT_ACCEPT_LANGUAGE+"|secret")
+}
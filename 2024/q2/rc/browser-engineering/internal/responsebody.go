@@ -0,0 +1,415 @@
+package internal
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+// The body of an HTTP response is read from the connection as the caller consumes it, rather than all at once, so
+// that large responses don't have to be held in memory and pages can be shown while they are still arriving.
+
+// RFC 9112, section 6.3
+//
+// Returns a reader for the body of `response`, with any content coding removed. `reader` must be positioned at the
+// start of the body. Nothing is read from it until the body itself is read.
+func openHttpResponseBody(reader *bufio.Reader, response *HttpResponse, method string, limits ResponseLimits) (io.Reader, error) {
+	responseHeaders := response.Headers
+	var body io.Reader
+	if !hasResponseBody(method, response.Status) {
+		return bytes.NewReader(nil), nil
+	} else if responseHeaders.Has("transfer-encoding") {
+		// Transfer-Encoding takes precedence over Content-Length
+		transferEncoding := responseHeaders.GetList("transfer-encoding")
+		if !isChunkedTransferEncoding(transferEncoding) {
+			return nil, fmt.Errorf("unsupported transfer encoding: %q", transferEncoding)
+		}
+
+		body = &chunkedReader{reader: reader, limits: limits, onTrailers: func(trailers Headers) {
+			mergeTrailers(&response.Headers, trailers)
+		}}
+	} else if responseHeaders.Has("content-length") {
+		contentLength, err := parseContentLength(responseHeaders.Values("content-length"))
+		if err != nil {
+			return nil, err
+		}
+		// no need to wait until we've read that much to find out that it's too much
+		if limits.MaxBodyLength > 0 && contentLength > limits.MaxBodyLength {
+			return nil, &LimitError{Limit: LIMIT_BODY_LENGTH, Max: limits.MaxBodyLength}
+		}
+		body = &lengthReader{reader: reader, remaining: int64(contentLength)}
+	} else {
+		// with neither header, the body extends until the server closes the connection
+		body = reader
+		response.closeDelimited = true
+	}
+
+	body = &countingReader{reader: body, count: &response.EncodedLength}
+	body = limitBody(body, limits.MaxBodyLength)
+	contentEncoding, ok := responseHeaders.Lookup("content-encoding")
+	if ok {
+		decoded, err := decodeContent(body, contentEncoding)
+		if err != nil {
+			return nil, err
+		}
+		return limitBody(decoded, limits.MaxBodyLength), nil
+	}
+	return body, nil
+}
+
+// `contentEncoding` lists codings in the order they were applied, so they are undone in reverse (RFC 9110,
+// section 8.4)
+func decodeContent(body io.Reader, contentEncoding string) (io.Reader, error) {
+	codings := strings.Split(contentEncoding, ",")
+	for i := len(codings) - 1; i >= 0; i-- {
+		coding := strings.ToLower(strings.TrimSpace(codings[i]))
+		switch coding {
+		case "", "identity":
+			continue
+		case "gzip", "x-gzip", "deflate":
+			body = &contentDecoder{coding: coding, source: body}
+		default:
+			return nil, fmt.Errorf("unsupported content encoding: %q", coding)
+		}
+	}
+	return body, nil
+}
+
+// Undoes a single content coding. The decompressor is only created on the first read, since creating it reads the
+// start of the compressed data.
+type contentDecoder struct {
+	coding  string
+	source  io.Reader
+	decoder io.Reader
+	// set if the decompressor couldn't be created
+	err error
+}
+
+func (d *contentDecoder) Read(p []byte) (int, error) {
+	if d.err != nil {
+		return 0, d.err
+	}
+	if d.decoder == nil {
+		var decoder io.Reader
+		var err error
+		if d.coding == "deflate" {
+			decoder, err = inflate(d.source)
+		} else {
+			// not assigned straight to `d.decoder`, since on error it would be a nil *gzip.Reader
+			decoder, err = gzip.NewReader(d.source)
+		}
+		if err != nil {
+			d.err = fmt.Errorf("could not decode %s content: %s", d.coding, err.Error())
+			return 0, d.err
+		}
+		d.decoder = decoder
+	}
+
+	n, err := d.decoder.Read(p)
+	if err == io.EOF {
+		// anything after the end of the compressed data is ignored, but it must still be read so that the connection
+		// is positioned at the end of the message
+		_, err = io.Copy(io.Discard, d.source)
+		if err == nil {
+			err = io.EOF
+		}
+	} else if err != nil {
+		err = fmt.Errorf("could not decode %s content: %s", d.coding, err.Error())
+	}
+	return n, err
+}
+
+// "deflate" is supposed to mean zlib-wrapped data (RFC 1950), but some servers send a raw deflate stream (RFC 1951)
+// instead, so we accept both as browsers do
+func inflate(source io.Reader) (io.Reader, error) {
+	buffered := bufio.NewReader(source)
+	header, err := buffered.Peek(2)
+	// RFC 1950, section 2.2: the compression method is 8 (deflate) and the header is a multiple of 31
+	if err == nil && header[0]&0x0f == 8 && (uint16(header[0])<<8|uint16(header[1]))%31 == 0 {
+		return zlib.NewReader(buffered)
+	}
+	return flate.NewReader(buffered), nil
+}
+
+// RFC 9112, section 7.1
+//
+// Chunk extensions are ignored. Once the last chunk has been read, the trailer fields are passed to `onTrailers` and
+// the underlying reader is positioned just after the end of the message, so the connection can be reused.
+type chunkedReader struct {
+	reader     *bufio.Reader
+	limits     ResponseLimits
+	onTrailers func(Headers)
+	// bytes left in the current chunk
+	remaining int64
+	// the CRLF after the current chunk's data hasn't been read yet
+	needCrlf bool
+	err      error
+}
+
+func (r *chunkedReader) Read(p []byte) (int, error) {
+	if r.err != nil {
+		return 0, r.err
+	}
+
+	if r.remaining == 0 {
+		last, err := r.nextChunk()
+		if err == io.EOF {
+			// the connection can't close cleanly until the message is over
+			err = io.ErrUnexpectedEOF
+		} else if err == nil && last {
+			err = io.EOF
+		}
+		if err != nil {
+			r.err = err
+			return 0, err
+		}
+	}
+
+	if int64(len(p)) > r.remaining {
+		p = p[:r.remaining]
+	}
+	n, err := r.reader.Read(p)
+	r.remaining -= int64(n)
+	if r.remaining == 0 {
+		r.needCrlf = true
+	}
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		r.err = err
+	}
+	return n, err
+}
+
+// Reads up to the start of the next chunk's data. If it's the last chunk, the trailer fields are read as well, and
+// true is returned.
+func (r *chunkedReader) nextChunk() (bool, error) {
+	maxLength := limitOrMax(r.limits.MaxLineLength)
+	if r.needCrlf {
+		line, err := r.readLine(maxLength)
+		if err != nil {
+			return false, err
+		}
+		if line != "" {
+			return false, errors.New("chunk data is not followed by CRLF")
+		}
+		r.needCrlf = false
+	}
+
+	line, err := r.readLine(maxLength)
+	if err != nil {
+		return false, err
+	}
+
+	sizeStr := line
+	if i := strings.Index(line, ";"); i != -1 {
+		sizeStr = line[:i]
+	}
+	sizeStr = strings.TrimRight(sizeStr, " \t")
+
+	size, err := parseChunkSize(sizeStr)
+	if err != nil {
+		return false, err
+	}
+
+	if size == 0 {
+		trailers, err := readHttpHeaders(r.reader, r.limits)
+		if err != nil {
+			return false, err
+		}
+		r.onTrailers(trailers)
+		return true, nil
+	}
+	r.remaining = size
+	return false, nil
+}
+
+func (r *chunkedReader) readLine(maxLength int) (string, error) {
+	line, err := readHttpLine(r.reader, maxLength)
+	if err == errLineTooLong {
+		return "", &LimitError{Limit: LIMIT_LINE_LENGTH, Max: r.limits.MaxLineLength}
+	}
+	return line, err
+}
+
+// Like `io.LimitReader`, except that it's an error for the input to end before `remaining` bytes have been read.
+type lengthReader struct {
+	reader    io.Reader
+	remaining int64
+}
+
+func (r *lengthReader) Read(p []byte) (int, error) {
+	if r.remaining <= 0 {
+		return 0, io.EOF
+	}
+
+	if int64(len(p)) > r.remaining {
+		p = p[:r.remaining]
+	}
+	n, err := r.reader.Read(p)
+	r.remaining -= int64(n)
+	if err == io.EOF && r.remaining > 0 {
+		err = io.ErrUnexpectedEOF
+	} else if err == io.EOF {
+		err = nil
+	}
+	return n, err
+}
+
+// fails with a `LimitError` once more than `maxLength` bytes have been read, if `maxLength` isn't zero
+func limitBody(body io.Reader, maxLength int) io.Reader {
+	if maxLength <= 0 {
+		return body
+	}
+	return &maxLengthReader{reader: body, remaining: maxLength, max: maxLength}
+}
+
+type maxLengthReader struct {
+	reader    io.Reader
+	remaining int
+	max       int
+}
+
+func (r *maxLengthReader) Read(p []byte) (int, error) {
+	// read one byte more than allowed, so that a body of exactly the maximum length isn't mistaken for a longer one
+	if len(p) > r.remaining+1 {
+		p = p[:r.remaining+1]
+	}
+	n, err := r.reader.Read(p)
+	if n > r.remaining {
+		return r.remaining, &LimitError{Limit: LIMIT_BODY_LENGTH, Max: r.max}
+	}
+	r.remaining -= n
+	return n, err
+}
+
+type countingReader struct {
+	reader io.Reader
+	count  *int
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	*r.count += n
+	return n, err
+}
+
+// The body of a response that is still on its connection. Once the body has been read to the end, the connection is
+// checked back in to the pool; if it's closed early or a read fails, the connection is closed instead, since we no
+// longer know where the next response on it would start. Not safe for concurrent use.
+type httpBody struct {
+	reader   io.Reader
+	response *HttpResponse
+	fetcher  *UrlFetcher
+	address  string
+	conn     *httpConn
+	ctx      context.Context
+	// stops `ctx` from interrupting reads on the connection; returns false if it already has (see `roundTrip`)
+	stop func() bool
+	// set once the body is finished with: io.EOF if it was read to the end
+	err error
+}
+
+var errBodyClosed = errors.New("read from a closed response body")
+
+func (body *httpBody) Read(p []byte) (int, error) {
+	if body.err != nil {
+		return 0, body.err
+	}
+
+	n, err := body.reader.Read(p)
+	if err == io.EOF {
+		body.finish(io.EOF, true)
+	} else if err != nil {
+		err = classifyTimeout(body.ctx, err, TIMEOUT_BODY, body.fetcher.BodyTimeout)
+		body.finish(err, false)
+	}
+	return n, err
+}
+
+func (body *httpBody) Close() error {
+	if body.err == nil {
+		body.finish(errBodyClosed, false)
+	}
+	return nil
+}
+
+func (body *httpBody) finish(err error, complete bool) {
+	// if the context was cancelled just as we finished, the connection's deadline may have been clobbered
+	interrupted := !body.stop()
+	body.conn.conn.SetDeadline(time.Time{})
+	body.err = err
+
+	if complete && !interrupted && !body.response.shouldCloseConnection() {
+		body.fetcher.releaseConnection(body.address, body.conn)
+		return
+	}
+	if complete {
+		// in particular, this is necessary because the Python test server only supports HTTP/1.0
+		PrintVerbose(fmt.Sprintf("connection cannot be reused; closing connection to %s", body.address))
+	}
+	body.fetcher.closeConnection(body.address, body.conn)
+}
+
+// Passes the whole body to `complete` once it has been read to the end. Nothing happens if the body is abandoned
+// before then.
+type bodyRecorder struct {
+	body     io.ReadCloser
+	buffer   bytes.Buffer
+	complete func([]byte)
+}
+
+func (r *bodyRecorder) Read(p []byte) (int, error) {
+	n, err := r.body.Read(p)
+	r.buffer.Write(p[:n])
+	if err == io.EOF && r.complete != nil {
+		r.complete(r.buffer.Bytes())
+		r.complete = nil
+	}
+	return n, err
+}
+
+func (r *bodyRecorder) Close() error {
+	return r.body.Close()
+}
+
+// reads the rest of the body from the network into `Body`, if it hasn't been already
+func (response *HttpResponse) readBody() error {
+	if response.body == nil {
+		return nil
+	}
+	defer response.closeBody()
+
+	content, err := io.ReadAll(response.body)
+	if err != nil {
+		return err
+	}
+	response.Body = content
+	return nil
+}
+
+// more than this, and it's cheaper to close the connection than to read the rest of an unwanted body
+const MAX_DISCARDED_BODY_LENGTH = 64 * 1024
+
+// for a response whose body isn't wanted (e.g., a redirect), so that its connection can be reused if possible
+func (response *HttpResponse) discardBody() {
+	if response.body == nil {
+		return
+	}
+	io.CopyN(io.Discard, response.body, MAX_DISCARDED_BODY_LENGTH)
+	response.closeBody()
+}
+
+func (response *HttpResponse) closeBody() {
+	response.body.Close()
+	response.body = nil
+}
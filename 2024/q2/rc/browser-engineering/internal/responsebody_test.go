@@ -0,0 +1,168 @@
+package internal
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFetchStream(t *testing.T) {
+	release := make(chan struct{})
+	server, connections := launchGoServer(t, func(server *http.Server) {
+		server.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Cache-Control", "max-age=3600")
+			w.Header().Set("Content-Type", "application/octet-stream")
+			w.Write([]byte("first\x00"))
+			w.(http.Flusher).Flush()
+			if r.URL.Path == "/slow" {
+				<-release
+			}
+			w.Write([]byte("\xFFsecond"))
+		})
+	})
+	defer server.Close()
+
+	fetcher := NewUrlFetcher()
+	fetcher.Cache = NewMemoryCache()
+	defer fetcher.Cleanup()
+
+	url, err := ParseUrl(server.URL + "/slow")
+	assertNoErr(t, err)
+	r, err := fetcher.FetchStream(context.Background(), NewRequest("GET", url, nil))
+	assertNoErr(t, err)
+	mimeType, ok := r.GetContentType()
+	if !ok || mimeType.Essence() != "application/octet-stream" {
+		t.Errorf("unexpected content type: %v", mimeType)
+	}
+
+	// the start of the body is available before the server has finished sending it
+	body := r.OpenBody()
+	first := make([]byte, 6)
+	_, err = io.ReadFull(body, first)
+	assertNoErr(t, err)
+	assertStrEqual(t, string(first), "first\x00")
+	assertIntEqual(t, len(fetcher.conns.idle), 0)
+
+	close(release)
+	rest, err := io.ReadAll(body)
+	assertNoErr(t, err)
+	assertStrEqual(t, string(rest), "\xFFsecond")
+	body.Close()
+
+	// once the body has been read, the connection is reused and the response is cached
+	r, err = fetcher.Fetch(url)
+	assertNoErr(t, err)
+	assertStrEqual(t, string(r.GetBody()), "first\x00\xFFsecond")
+	if !r.(*HttpResponse).FromCache {
+		t.Errorf("response should have been cached once its body was read")
+	}
+	url, err = ParseUrl(server.URL + "/other")
+	assertNoErr(t, err)
+	_, err = fetcher.Fetch(url)
+	assertNoErr(t, err)
+	assertIntEqual(t, int(connections.Load()), 1)
+}
+
+func TestAbandonedStream(t *testing.T) {
+	server := launchRawServer(t,
+		"HTTP/1.1 200 OK\r\nContent-Length: 11\r\nCache-Control: max-age=3600\r\n\r\nHello",
+		"HTTP/1.1 200 OK\r\nContent-Length: 5\r\n\r\nworld",
+	)
+	defer server.Cleanup()
+
+	url, err := ParseUrl(fmt.Sprintf("http://localhost:%d/", server.Port))
+	assertNoErr(t, err)
+
+	fetcher := NewUrlFetcher()
+	fetcher.Cache = NewMemoryCache()
+	defer fetcher.Cleanup()
+
+	r, err := fetcher.FetchStream(context.Background(), NewRequest("GET", url, nil))
+	assertNoErr(t, err)
+	body := r.OpenBody()
+	prefix := make([]byte, 5)
+	_, err = io.ReadFull(body, prefix)
+	assertNoErr(t, err)
+	body.Close()
+	_, err = body.Read(prefix)
+	if !errors.Is(err, errBodyClosed) {
+		t.Errorf("expected error reading from closed body, got %v", err)
+	}
+
+	// the rest of the first response is still on the old connection, so it can't be reused, and the incomplete
+	// response wasn't cached
+	r, err = fetcher.Fetch(url)
+	assertNoErr(t, err)
+	assertStrEqual(t, string(r.GetBody()), "world")
+	assertIntEqual(t, server.ConnectionCount(), 2)
+}
+
+func TestStreamBodyTimeout(t *testing.T) {
+	release := make(chan struct{})
+	server, _ := launchGoServer(t, func(server *http.Server) {
+		server.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Length", "100")
+			w.Write([]byte("partial"))
+			w.(http.Flusher).Flush()
+			<-release
+		})
+	})
+	defer server.Close()
+	defer close(release)
+
+	fetcher := NewUrlFetcher()
+	fetcher.BodyTimeout = 50 * time.Millisecond
+	defer fetcher.Cleanup()
+
+	url, err := ParseUrl(server.URL)
+	assertNoErr(t, err)
+	r, err := fetcher.FetchStream(context.Background(), NewRequest("GET", url, nil))
+	assertNoErr(t, err)
+	body := r.OpenBody()
+	defer body.Close()
+
+	content, err := io.ReadAll(body)
+	assertStrEqual(t, string(content), "partial")
+	var timeoutErr *TimeoutError
+	if !errors.As(err, &timeoutErr) || timeoutErr.Phase != TIMEOUT_BODY {
+		t.Errorf("expected body timeout, got %v", err)
+	}
+}
+
+func TestChunkedReader(t *testing.T) {
+	// read a byte at a time, so that every chunk boundary falls between reads
+	text := "3\r\nabc\r\n1;ext=1\r\nd\r\n0\r\nTrailer: yes\r\n\r\nnext message"
+	reader := bufio.NewReader(strings.NewReader(text))
+	var trailers Headers
+	chunked := &chunkedReader{reader: reader, onTrailers: func(fields Headers) { trailers = fields }}
+
+	var content strings.Builder
+	buffer := make([]byte, 1)
+	for {
+		n, err := chunked.Read(buffer)
+		content.Write(buffer[:n])
+		if err == io.EOF {
+			break
+		}
+		assertNoErr(t, err)
+	}
+	assertStrEqual(t, content.String(), "abcd")
+	assertStrEqual(t, trailers.Get("trailer"), "yes")
+	rest, err := io.ReadAll(reader)
+	assertNoErr(t, err)
+	assertStrEqual(t, string(rest), "next message")
+
+	for _, truncated := range []string{"3\r\nab", "3\r\nabc", "3\r\nabc\r\n0\r\n"} {
+		chunked = &chunkedReader{reader: bufio.NewReader(strings.NewReader(truncated)), onTrailers: func(Headers) {}}
+		_, err = io.ReadAll(chunked)
+		if !errors.Is(err, io.ErrUnexpectedEOF) {
+			t.Errorf("expected unexpected EOF for %q, got %v", truncated, err)
+		}
+	}
+}
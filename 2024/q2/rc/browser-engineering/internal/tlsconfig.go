@@ -0,0 +1,91 @@
+package internal
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+)
+
+type TlsOptions struct {
+	// PEM file of CA certificates to trust, in addition to the system's
+	CaBundleFile string
+	// PEM files of a client certificate and its private key, for servers that require mutual TLS
+	ClientCertFile string
+	ClientKeyFile  string
+	// e.g., `tls.VersionTLS13`; zero means Go's default
+	MinVersion uint16
+	// accept any certificate the server presents, which makes the connection open to interception
+	Insecure bool
+}
+
+// Builds the configuration for `UrlFetcher.TlsConfig`, loading any files the options refer to.
+func NewTlsConfig(options TlsOptions) (*tls.Config, error) {
+	config := &tls.Config{MinVersion: options.MinVersion, InsecureSkipVerify: options.Insecure}
+
+	if options.CaBundleFile != "" {
+		pem, err := os.ReadFile(options.CaBundleFile)
+		if err != nil {
+			return nil, fmt.Errorf("could not read CA bundle: %w", err)
+		}
+
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			PrintVerbose(fmt.Sprintf("could not load system certificates (%s); trusting only %s", err.Error(), options.CaBundleFile))
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in CA bundle %s", options.CaBundleFile)
+		}
+		config.RootCAs = pool
+	}
+
+	if options.ClientCertFile != "" || options.ClientKeyFile != "" {
+		if options.ClientCertFile == "" || options.ClientKeyFile == "" {
+			return nil, errors.New("a client certificate and key must be given together")
+		}
+
+		certificate, err := tls.LoadX509KeyPair(options.ClientCertFile, options.ClientKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("could not load client certificate: %w", err)
+		}
+		config.Certificates = []tls.Certificate{certificate}
+	}
+
+	return config, nil
+}
+
+var TLS_VERSIONS = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// Parses a version like "1.2".
+func ParseTlsVersion(text string) (uint16, error) {
+	version, ok := TLS_VERSIONS[text]
+	if !ok {
+		return 0, fmt.Errorf("unknown TLS version %q (expected 1.0, 1.1, 1.2 or 1.3)", text)
+	}
+	return version, nil
+}
+
+// the configuration for a connection to `host`
+func (fetcher *UrlFetcher) tlsConfigFor(host string) *tls.Config {
+	var config *tls.Config
+	if fetcher.TlsConfig != nil {
+		config = fetcher.TlsConfig.Clone()
+	} else {
+		config = &tls.Config{}
+	}
+	if config.ServerName == "" {
+		config.ServerName = host
+	}
+	// we only speak HTTP/1.1, but saying so lets the server confirm it
+	if len(config.NextProtos) == 0 {
+		config.NextProtos = []string{"http/1.1"}
+	}
+	return config
+}
@@ -0,0 +1,163 @@
+package internal
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTlsCertificateVerification(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("secure"))
+	}))
+	defer server.Close()
+
+	url, err := ParseUrl(server.URL)
+	assertNoErr(t, err)
+
+	// the test server's certificate is self-signed
+	fetcher := NewUrlFetcher()
+	_, err = fetcher.Fetch(url)
+	if err == nil || !strings.Contains(err.Error(), "certificate") {
+		t.Errorf("expected certificate error, got %v", err)
+	}
+	fetcher.Cleanup()
+
+	caBundle := filepath.Join(t.TempDir(), "ca.pem")
+	writePem(t, caBundle, "CERTIFICATE", server.Certificate().Raw)
+	fetcher = fetcherWithTlsOptions(t, TlsOptions{CaBundleFile: caBundle})
+	r, err := fetcher.Fetch(url)
+	assertNoErr(t, err)
+	assertStrEqual(t, string(r.GetBody()), "secure")
+	fetcher.Cleanup()
+
+	fetcher = fetcherWithTlsOptions(t, TlsOptions{Insecure: true})
+	r, err = fetcher.Fetch(url)
+	assertNoErr(t, err)
+	assertStrEqual(t, string(r.GetBody()), "secure")
+	fetcher.Cleanup()
+}
+
+func TestTlsMinVersion(t *testing.T) {
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("old"))
+	}))
+	server.TLS = &tls.Config{MaxVersion: tls.VersionTLS12}
+	server.StartTLS()
+	defer server.Close()
+
+	url, err := ParseUrl(server.URL)
+	assertNoErr(t, err)
+
+	fetcher := fetcherWithTlsOptions(t, TlsOptions{Insecure: true, MinVersion: tls.VersionTLS12})
+	_, err = fetcher.Fetch(url)
+	assertNoErr(t, err)
+	fetcher.Cleanup()
+
+	version, err := ParseTlsVersion("1.3")
+	assertNoErr(t, err)
+	fetcher = fetcherWithTlsOptions(t, TlsOptions{Insecure: true, MinVersion: version})
+	_, err = fetcher.Fetch(url)
+	if err == nil {
+		t.Errorf("expected handshake to fail with a TLS 1.2 server")
+	}
+	fetcher.Cleanup()
+
+	_, err = ParseTlsVersion("2.0")
+	if err == nil {
+		t.Errorf("expected error for unknown TLS version")
+	}
+}
+
+func TestTlsClientCertificate(t *testing.T) {
+	directory := t.TempDir()
+	certFile := filepath.Join(directory, "client.pem")
+	keyFile := filepath.Join(directory, "client-key.pem")
+	clientCert := generateClientCertificate(t, certFile, keyFile)
+
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(clientCert)
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("hello, " + r.TLS.PeerCertificates[0].Subject.CommonName))
+	}))
+	server.TLS = &tls.Config{ClientAuth: tls.RequireAndVerifyClientCert, ClientCAs: clientCAs}
+	server.StartTLS()
+	defer server.Close()
+
+	url, err := ParseUrl(server.URL)
+	assertNoErr(t, err)
+
+	fetcher := fetcherWithTlsOptions(t, TlsOptions{Insecure: true})
+	_, err = fetcher.Fetch(url)
+	if err == nil {
+		t.Errorf("expected server to reject a connection without a client certificate")
+	}
+	fetcher.Cleanup()
+
+	fetcher = fetcherWithTlsOptions(t, TlsOptions{Insecure: true, ClientCertFile: certFile, ClientKeyFile: keyFile})
+	r, err := fetcher.Fetch(url)
+	assertNoErr(t, err)
+	assertStrEqual(t, string(r.GetBody()), "hello, tincan-test-client")
+	fetcher.Cleanup()
+
+	_, err = NewTlsConfig(TlsOptions{ClientCertFile: certFile})
+	if err == nil {
+		t.Errorf("expected error for client certificate without key")
+	}
+}
+
+func fetcherWithTlsOptions(t *testing.T, options TlsOptions) UrlFetcher {
+	t.Helper()
+	config, err := NewTlsConfig(options)
+	assertNoErr(t, err)
+	fetcher := NewUrlFetcher()
+	fetcher.TlsConfig = config
+	return fetcher
+}
+
+func writePem(t *testing.T, path string, blockType string, der []byte) {
+	t.Helper()
+	data := pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der})
+	assertNoErr(t, os.WriteFile(path, data, 0o600))
+}
+
+// writes a self-signed client certificate and its key to the files
+func generateClientCertificate(t *testing.T, certFile string, keyFile string) *x509.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assertNoErr(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "tincan-test-client"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	assertNoErr(t, err)
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	assertNoErr(t, err)
+
+	writePem(t, certFile, "CERTIFICATE", der)
+	writePem(t, keyFile, "EC PRIVATE KEY", keyDer)
+
+	cert, err := x509.ParseCertificate(der)
+	assertNoErr(t, err)
+	return cert
+}
@@ -0,0 +1,182 @@
+package internal
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// What was negotiated on the TLS connection that a response arrived on.
+type TlsInfo struct {
+	// e.g., `tls.VersionTLS13`
+	Version     uint16
+	CipherSuite uint16
+	// the ALPN protocol, or empty if the server didn't pick one
+	NegotiatedProtocol string
+	// DER-encoded, starting with the server's own certificate; use `Certificates` to parse them. (They're kept in
+	// this form so that responses can be stored by the disk cache.)
+	PeerCertificates [][]byte
+}
+
+func newTlsInfo(state tls.ConnectionState) *TlsInfo {
+	info := &TlsInfo{
+		Version:            state.Version,
+		CipherSuite:        state.CipherSuite,
+		NegotiatedProtocol: state.NegotiatedProtocol,
+	}
+	for _, certificate := range state.PeerCertificates {
+		info.PeerCertificates = append(info.PeerCertificates, certificate.Raw)
+	}
+	return info
+}
+
+func (info *TlsInfo) VersionName() string {
+	return tls.VersionName(info.Version)
+}
+
+func (info *TlsInfo) CipherSuiteName() string {
+	return tls.CipherSuiteName(info.CipherSuite)
+}
+
+func (info *TlsInfo) Certificates() ([]*x509.Certificate, error) {
+	certificates := []*x509.Certificate{}
+	for _, der := range info.PeerCertificates {
+		certificate, err := x509.ParseCertificate(der)
+		if err != nil {
+			return nil, err
+		}
+		certificates = append(certificates, certificate)
+	}
+	return certificates, nil
+}
+
+// A human-readable description of the connection and the server's certificate chain.
+func (info *TlsInfo) String() string {
+	var builder strings.Builder
+	fmt.Fprintf(&builder, "TLS version: %s\n", info.VersionName())
+	fmt.Fprintf(&builder, "Cipher suite: %s\n", info.CipherSuiteName())
+	protocol := info.NegotiatedProtocol
+	if protocol == "" {
+		protocol = "(none)"
+	}
+	fmt.Fprintf(&builder, "ALPN protocol: %s\n", protocol)
+
+	certificates, err := info.Certificates()
+	if err != nil {
+		fmt.Fprintf(&builder, "\nCould not parse certificate chain: %s\n", err.Error())
+		return builder.String()
+	}
+
+	for i, certificate := range certificates {
+		if i == 0 {
+			builder.WriteString("\nServer certificate:\n")
+		} else {
+			fmt.Fprintf(&builder, "\nIntermediate certificate %d:\n", i)
+		}
+		fmt.Fprintf(&builder, "  Subject: %s\n", certificate.Subject)
+		fmt.Fprintf(&builder, "  Issuer: %s\n", certificate.Issuer)
+		fmt.Fprintf(&builder, "  Valid from: %s\n", certificate.NotBefore.UTC().Format(time.RFC1123))
+		fmt.Fprintf(&builder, "  Expires: %s\n", certificate.NotAfter.UTC().Format(time.RFC1123))
+		names := certificateNames(certificate)
+		if len(names) > 0 {
+			fmt.Fprintf(&builder, "  Names: %s\n", strings.Join(names, ", "))
+		}
+	}
+	return builder.String()
+}
+
+// the DNS names and IP addresses that a certificate is valid for
+func certificateNames(certificate *x509.Certificate) []string {
+	names := append([]string{}, certificate.DNSNames...)
+	for _, ip := range certificate.IPAddresses {
+		names = append(names, ip.String())
+	}
+	return names
+}
+
+// A CertificateError means that the server's certificate couldn't be verified, so the connection was abandoned.
+type CertificateError struct {
+	Host string
+	// an explanation of what was wrong with the certificate
+	Reason string
+	Err    error
+}
+
+func (e *CertificateError) Error() string {
+	return fmt.Sprintf("could not verify TLS certificate for %s: %s", e.Host, e.Reason)
+}
+
+func (e *CertificateError) Unwrap() error {
+	return e.Err
+}
+
+// turns the certificate errors that the handshake can fail with into a `CertificateError`
+func classifyCertificateError(host string, err error) error {
+	var unknownAuthority x509.UnknownAuthorityError
+	var hostnameErr x509.HostnameError
+	var invalid x509.CertificateInvalidError
+
+	var reason string
+	if errors.As(err, &unknownAuthority) {
+		reason = "certificate is signed by an unknown authority"
+		if unknownAuthority.Cert != nil {
+			reason += fmt.Sprintf(" (%s)", unknownAuthority.Cert.Issuer)
+		}
+	} else if errors.As(err, &hostnameErr) {
+		names := certificateNames(hostnameErr.Certificate)
+		reason = fmt.Sprintf("certificate is not valid for %s (valid for: %s)", hostnameErr.Host, strings.Join(names, ", "))
+	} else if errors.As(err, &invalid) {
+		switch invalid.Reason {
+		case x509.Expired:
+			notBefore, notAfter := invalid.Cert.NotBefore, invalid.Cert.NotAfter
+			if time.Now().Before(notBefore) {
+				reason = fmt.Sprintf("certificate is not valid until %s", notBefore.UTC().Format(time.RFC1123))
+			} else {
+				reason = fmt.Sprintf("certificate expired on %s", notAfter.UTC().Format(time.RFC1123))
+			}
+		default:
+			reason = invalid.Error()
+		}
+	} else {
+		return err
+	}
+
+	return &CertificateError{Host: host, Reason: reason, Err: err}
+}
+
+// The text of the `about:page-info` page for `response`, including its header fields and the server's certificate chain
+// if it came over TLS.
+// `encoding` is the character encoding its body was decoded from, if it's known.
+func DescribePage(url Url, response GenericResponse, encoding string) string {
+	var builder strings.Builder
+	fmt.Fprintf(&builder, "Page info for %s\n\n", url.String())
+
+	httpResponse, ok := response.(*HttpResponse)
+	if !ok {
+		builder.WriteString("This page did not come from the network.\n")
+		return builder.String()
+	}
+
+	fmt.Fprintf(&builder, "Status: %d %s\n", httpResponse.Status, httpResponse.StatusExplanation)
+	if httpResponse.FromCache {
+		builder.WriteString("Loaded from the cache.\n")
+	}
+	if encoding != "" {
+		fmt.Fprintf(&builder, "Character encoding: %s\n", encoding)
+	}
+	builder.WriteString("\nResponse headers:\n")
+	for _, field := range httpResponse.Headers {
+		fmt.Fprintf(&builder, "  %s: %s\n", field.Name, field.Value)
+	}
+	builder.WriteString("\n")
+
+	if httpResponse.Tls == nil {
+		builder.WriteString("This page was not loaded over a secure connection.\n")
+	} else {
+		builder.WriteString(httpResponse.Tls.String())
+	}
+	return builder.String()
+}
@@ -0,0 +1,138 @@
+package internal
+
+import (
+	"crypto/tls"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func TestTlsInfo(t *testing.T) {
+	var requests atomic.Int32
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		w.Header().Set("X-Served-By", "test")
+		w.Write([]byte("secure"))
+	}))
+	defer server.Close()
+
+	caBundle := filepath.Join(t.TempDir(), "ca.pem")
+	writePem(t, caBundle, "CERTIFICATE", server.Certificate().Raw)
+	fetcher := fetcherWithTlsOptions(t, TlsOptions{CaBundleFile: caBundle})
+	defer fetcher.Cleanup()
+
+	url, err := ParseUrl(server.URL)
+	assertNoErr(t, err)
+	r, err := fetcher.Fetch(url)
+	assertNoErr(t, err)
+
+	info := r.(*HttpResponse).Tls
+	if info == nil {
+		t.Fatalf("expected TLS info for an HTTPS response")
+	}
+	assertIntEqual(t, int(info.Version), tls.VersionTLS13)
+	assertStrEqual(t, info.NegotiatedProtocol, "http/1.1")
+
+	certificates, err := info.Certificates()
+	assertNoErr(t, err)
+	assertIntEqual(t, len(certificates), 1)
+	assertStrEqual(t, certificates[0].Issuer.String(), server.Certificate().Issuer.String())
+
+	description := info.String()
+	for _, expected := range []string{"TLS version: TLS 1.3", "ALPN protocol: http/1.1", "Subject: O=Acme Co", "Expires: "} {
+		if !strings.Contains(description, expected) {
+			t.Errorf("expected %q in TLS description, got:\n%s", expected, description)
+		}
+	}
+
+	page := DescribePage(url, r, UTF_8)
+	if !strings.Contains(page, "Status: 200 OK") || !strings.Contains(page, "Character encoding: UTF-8") || !strings.Contains(page, "Server certificate:") {
+		t.Errorf("unexpected page info:\n%s", page)
+	}
+
+	// about:page-info describes the response that the page was loaded from, without asking the server again
+	url, err = ParseUrl(server.URL + "/?q=1")
+	assertNoErr(t, err)
+	_, err = fetcher.Fetch(url)
+	assertNoErr(t, err)
+	loaded := requests.Load()
+
+	aboutUrl, err := ParseUrl("about:page-info?" + server.URL + "/?q=1")
+	assertNoErr(t, err)
+	r, err = fetcher.Fetch(aboutUrl)
+	assertNoErr(t, err)
+	assertIntEqual(t, int(requests.Load()), int(loaded))
+	page = string(r.GetBody())
+	for _, expected := range []string{"Page info for " + server.URL + "/?q=1", "Status: 200 OK", "X-Served-By: test", "Subject: O=Acme Co", "Issuer: O=Acme Co", "Expires: "} {
+		if !strings.Contains(page, expected) {
+			t.Errorf("expected %q in about:page-info, got:\n%s", expected, page)
+		}
+	}
+
+	aboutUrl, err = ParseUrl("about:page-info?" + server.URL + "/never-loaded")
+	assertNoErr(t, err)
+	_, err = fetcher.Fetch(aboutUrl)
+	if err == nil {
+		t.Errorf("expected error for about:page-info of a page that was not loaded")
+	}
+	assertIntEqual(t, int(requests.Load()), int(loaded))
+
+	aboutUrl, err = ParseUrl("about:page-info")
+	assertNoErr(t, err)
+	_, err = fetcher.Fetch(aboutUrl)
+	if err == nil {
+		t.Errorf("expected error for about:page-info without a URL")
+	}
+}
+
+func TestTlsInfoForPlainHttp(t *testing.T) {
+	server := launchEchoServer(t)
+	defer server.Close()
+
+	fetcher := NewUrlFetcher()
+	defer fetcher.Cleanup()
+
+	url, err := ParseUrl(server.URL)
+	assertNoErr(t, err)
+	r, err := fetcher.Fetch(url)
+	assertNoErr(t, err)
+	if r.(*HttpResponse).Tls != nil {
+		t.Errorf("expected no TLS info for an HTTP response")
+	}
+	if !strings.Contains(DescribePage(url, r, ""), "not loaded over a secure connection") {
+		t.Errorf("expected page info to say the connection was not secure")
+	}
+
+	url, err = ParseUrl("data:,hello")
+	assertNoErr(t, err)
+	r, err = fetcher.Fetch(url)
+	assertNoErr(t, err)
+	if !strings.Contains(DescribePage(url, r, ""), "did not come from the network") {
+		t.Errorf("expected page info to say the page did not come from the network")
+	}
+}
+
+func TestCertificateError(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+
+	fetcher := NewUrlFetcher()
+	defer fetcher.Cleanup()
+
+	url, err := ParseUrl(server.URL)
+	assertNoErr(t, err)
+	_, err = fetcher.Fetch(url)
+
+	var certificateErr *CertificateError
+	if !errors.As(err, &certificateErr) {
+		t.Fatalf("expected CertificateError, got %v", err)
+	}
+	assertStrEqual(t, certificateErr.Host, url.Host)
+	if !strings.Contains(certificateErr.Reason, "unknown authority") {
+		t.Errorf("unexpected reason: %s", certificateErr.Reason)
+	}
+}
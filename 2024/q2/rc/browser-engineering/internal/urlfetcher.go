@@ -3,201 +3,946 @@ package internal
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"crypto/tls"
 	"errors"
 	"fmt"
 	"io"
+	"math"
 	"net"
-	"os"
 	"strconv"
 	"strings"
+	"sync"
+	"syscall"
+	"time"
 )
 
+// To get the body as text, use `DecodeText`.
 type GenericResponse interface {
-	GetContent() string
+	// the body, with any content coding (e.g., gzip) removed. Empty for a response from `FetchStream`, whose body must
+	// be read with `OpenBody` instead.
+	GetBody() []byte
+	// the parsed Content-Type (or the equivalent for URLs that aren't fetched over HTTP); false if it's unknown
+	GetContentType() (MimeType, bool)
+	// the body as a stream, which the caller must close. For a response from `FetchStream`, this reads from the
+	// network and can only be called once.
+	OpenBody() io.ReadCloser
 }
 
 type HttpResponse struct {
+	// the URL the response came from, after following any redirects
+	Url Url
+	// the redirects that were followed to get here, in order
+	RedirectChain     []RedirectHop
 	Version           string
 	Status            int
 	StatusExplanation string
-	Headers           map[string]string
-	Content           string
+	Headers           Headers
+	Body              []byte
+	// size of the body as it came over the wire, before any content coding (e.g., gzip) was removed
+	EncodedLength int
+	// details of the TLS connection the response arrived on, or nil if it wasn't encrypted
+	Tls *TlsInfo
+	// the response was served from the fetcher's cache, either without contacting the server or after the server
+	// confirmed that it was still valid
+	FromCache bool
+	// the body had no explicit length and was terminated by the server closing the connection
+	closeDelimited bool
+	// the server answered before we sent the request body (see `Request.expectsContinue`), so it may still be
+	// waiting for the body
+	bodyNotSent bool
+	// the part of the body that is still to be read from the network, for a response from `FetchStream` (see
+	// `httpBody`); nil once `Body` has been filled in
+	body io.ReadCloser
 }
 
-func (response *HttpResponse) GetContent() string {
-	return response.Content
+// whether the connection the response arrived on must be discarded rather than reused
+func (response *HttpResponse) shouldCloseConnection() bool {
+	if response.closeDelimited || response.bodyNotSent || response.Version == "HTTP/1.0" {
+		return true
+	}
+
+	return hasHttpToken(response.Headers.GetList("connection"), "close")
+}
+
+// The status line and header fields exactly as received (apart from line endings), for display.
+func (response *HttpResponse) HeadString() string {
+	return fmt.Sprintf("%s %d %s\r\n%s", response.Version, response.Status, response.StatusExplanation, response.Headers.String())
+}
+
+// checks for a token in a comma-separated header value like "keep-alive, close"
+func hasHttpToken(headerValue string, token string) bool {
+	for _, part := range strings.Split(headerValue, ",") {
+		if strings.EqualFold(strings.TrimSpace(part), token) {
+			return true
+		}
+	}
+	return false
+}
+
+func (response *HttpResponse) GetBody() []byte {
+	return response.Body
+}
+
+func (response *HttpResponse) GetContentType() (MimeType, bool) {
+	contentType, ok := response.Headers.Lookup("content-type")
+	if !ok {
+		return MimeType{}, false
+	}
+	mimeType, err := parseMimeType(contentType)
+	if err != nil {
+		PrintVerbose(fmt.Sprintf("ignoring invalid Content-Type: %q", contentType))
+		return MimeType{}, false
+	}
+	return mimeType, true
+}
+
+func (response *HttpResponse) OpenBody() io.ReadCloser {
+	if response.body != nil {
+		body := response.body
+		response.body = nil
+		return body
+	}
+	return io.NopCloser(bytes.NewReader(response.Body))
 }
 
 type FileResponse struct {
-	Content string
+	Body []byte
+	// from the file's extension or, failing that, its contents (see `fetchFile`)
+	MimeType MimeType
+}
+
+func (response *FileResponse) GetBody() []byte {
+	return response.Body
+}
+
+func (response *FileResponse) GetContentType() (MimeType, bool) {
+	return response.MimeType, response.MimeType.Type != ""
 }
 
-func (response *FileResponse) GetContent() string {
-	return response.Content
+func (response *FileResponse) OpenBody() io.ReadCloser {
+	return io.NopCloser(bytes.NewReader(response.Body))
 }
 
 type DataResponse struct {
-	Content  string
+	Data     []byte
 	MimeType MimeType
+	Charset  string
 }
 
-func (response *DataResponse) GetContent() string {
-	return response.Content
+func (response *DataResponse) GetBody() []byte {
+	return response.Data
 }
 
+func (response *DataResponse) GetContentType() (MimeType, bool) {
+	return response.MimeType, response.MimeType.Type != ""
+}
+
+func (response *DataResponse) OpenBody() io.ReadCloser {
+	return io.NopCloser(bytes.NewReader(response.Data))
+}
+
+// A UrlFetcher is safe for concurrent use by multiple goroutines, but its configuration fields should not be changed
+// once fetching has started.
 type UrlFetcher struct {
-	connCache map[string]net.Conn
+	conns *connPool
+	auth  *authCache
+	pages *pageHistory
+	// how long an idle connection is kept before it is assumed that the server has closed it
+	IdleTimeout time.Duration
+	// maximum number of connections in use at once per host, not counting idle ones; zero means no limit
+	MaxConnsPerHost int
+	RedirectPolicy  RedirectPolicy
+	// where responses to GET requests are stored for reuse; nil disables caching
+	Cache HttpCache
+	// the cache is shared between users, so responses marked 'Cache-Control: private' are not stored in it
+	SharedCache bool
+	// where cookies set by servers are kept; nil disables cookies
+	Cookies *CookieJar
+	// used for HTTPS connections, with `ServerName` filled in for each host if it's empty; nil means Go's defaults
+	// (see `NewTlsConfig`)
+	TlsConfig *tls.Config
+	// chooses the proxy for each request; nil means that all connections are direct (see
+	// `ProxyConfigFromEnvironment`)
+	Proxy *ProxyConfig
+	// asked in order for credentials when a server responds with 401, if those in the URL (if any) don't work
+	CredentialProviders []CredentialProvider
+	// sent with every HTTP request, in order, unless the request has its own header with the same name. Host,
+	// Connection and Content-Length are managed by the fetcher and don't belong here.
+	DefaultHeaders Headers
+
+	// For all of the timeouts below, zero means no timeout. They apply to each request separately, so a fetch that
+	// follows redirects may take longer in total; use a context deadline to bound the whole fetch.
+
+	// time to establish a TCP connection
+	DialTimeout time.Duration
+	// time to complete the TLS handshake once connected
+	TlsHandshakeTimeout time.Duration
+	// time from starting to send the request until all of the response headers have arrived
+	HeaderTimeout time.Duration
+	// time to read the whole response body
+	BodyTimeout time.Duration
+	// protect against servers that send endless or enormous responses
+	Limits ResponseLimits
 }
 
+type TimeoutPhase string
+
+const (
+	TIMEOUT_DIAL          TimeoutPhase = "connecting"
+	TIMEOUT_TLS_HANDSHAKE TimeoutPhase = "TLS handshake"
+	TIMEOUT_HEADERS       TimeoutPhase = "waiting for response headers"
+	TIMEOUT_BODY          TimeoutPhase = "reading response body"
+)
+
+// A TimeoutError is returned when one of the fetcher's timeouts expires. (If the caller's context expires instead,
+// the error wraps `context.DeadlineExceeded`.)
+type TimeoutError struct {
+	Phase   TimeoutPhase
+	Timeout time.Duration
+}
+
+func (e *TimeoutError) Error() string {
+	return fmt.Sprintf("timed out after %s: %s", e.Timeout, e.Phase)
+}
+
+// For each limit, zero means no limit.
+type ResponseLimits struct {
+	// the longest line allowed in the head of a response (the status line or a header field), not counting the CRLF.
+	// This also applies to the size lines of a chunked body.
+	MaxLineLength int
+	// the most header fields a response may have
+	MaxHeaderFields int
+	// the largest head of a response allowed, counting the status line and the CRLFs. Interim (1xx) responses count
+	// towards the limit of the final response.
+	MaxHeaderBytes int
+	// the largest body allowed, both as sent over the wire and after any content coding is removed (so that a small
+	// compressed body can't expand into an enormous one)
+	MaxBodyLength int
+}
+
+type ResponseLimit string
+
+const (
+	LIMIT_LINE_LENGTH   ResponseLimit = "line length"
+	LIMIT_HEADER_FIELDS ResponseLimit = "number of header fields"
+	LIMIT_HEADER_BYTES  ResponseLimit = "size of response head"
+	LIMIT_BODY_LENGTH   ResponseLimit = "size of response body"
+)
+
+// A LimitError is returned when a response is larger than one of the fetcher's `Limits` allows.
+type LimitError struct {
+	Limit ResponseLimit
+	Max   int
+}
+
+func (e *LimitError) Error() string {
+	return fmt.Sprintf("response exceeds limit: %s is over %d", e.Limit, e.Max)
+}
+
+const DEFAULT_USER_AGENT = "Mozilla/5.0 (desktop; rv:0.1) TinCan/0.1"
+
+// the same as Firefox's defaults for a top-level document
+const DEFAULT_ACCEPT = "text/html,application/xhtml+xml,application/xml;q=0.9,*/*;q=0.8"
+const DEFAULT_ACCEPT_LANGUAGE = "en-US,en;q=0.5"
+
+// many servers close idle connections after a few seconds (Apache's default is 5) but others wait much longer, so
+// this is a compromise; the retry logic in fetchHttpGeneric covers the case where we guess wrong
+const DEFAULT_IDLE_TIMEOUT = 30 * time.Second
+
+// same as most browsers
+const DEFAULT_MAX_CONNS_PER_HOST = 6
+
+const DEFAULT_DIAL_TIMEOUT = 30 * time.Second
+const DEFAULT_TLS_HANDSHAKE_TIMEOUT = 10 * time.Second
+const DEFAULT_HEADER_TIMEOUT = 30 * time.Second
+
+// generous, since large downloads over slow connections can legitimately take a while
+const DEFAULT_BODY_TIMEOUT = 5 * time.Minute
+
+// the same as Chrome's limit on the size of the response head
+const DEFAULT_MAX_HEADER_BYTES = 256 * 1024
+const DEFAULT_MAX_LINE_LENGTH = 64 * 1024
+const DEFAULT_MAX_HEADER_FIELDS = 1000
+const DEFAULT_MAX_BODY_LENGTH = 512 * 1024 * 1024
+
 func NewUrlFetcher() UrlFetcher {
-	return UrlFetcher{connCache: make(map[string]net.Conn)}
+	return UrlFetcher{
+		conns:               newConnPool(),
+		auth:                newAuthCache(),
+		pages:               newPageHistory(),
+		IdleTimeout:         DEFAULT_IDLE_TIMEOUT,
+		MaxConnsPerHost:     DEFAULT_MAX_CONNS_PER_HOST,
+		RedirectPolicy:      RedirectPolicy{MaxRedirects: DEFAULT_MAX_REDIRECTS},
+		DialTimeout:         DEFAULT_DIAL_TIMEOUT,
+		TlsHandshakeTimeout: DEFAULT_TLS_HANDSHAKE_TIMEOUT,
+		HeaderTimeout:       DEFAULT_HEADER_TIMEOUT,
+		BodyTimeout:         DEFAULT_BODY_TIMEOUT,
+		Limits: ResponseLimits{
+			MaxLineLength:   DEFAULT_MAX_LINE_LENGTH,
+			MaxHeaderFields: DEFAULT_MAX_HEADER_FIELDS,
+			MaxHeaderBytes:  DEFAULT_MAX_HEADER_BYTES,
+			MaxBodyLength:   DEFAULT_MAX_BODY_LENGTH,
+		},
+		DefaultHeaders: Headers{
+			{"User-Agent", DEFAULT_USER_AGENT},
+			{"Accept", DEFAULT_ACCEPT},
+			{"Accept-Language", DEFAULT_ACCEPT_LANGUAGE},
+			{"Accept-Encoding", "gzip, deflate"},
+		},
+	}
 }
 
 func (fetcher *UrlFetcher) Fetch(url Url) (GenericResponse, error) {
+	return fetcher.FetchContext(context.Background(), url)
+}
+
+// FetchContext is like Fetch, but gives up as soon as `ctx` is cancelled or expires.
+func (fetcher *UrlFetcher) FetchContext(ctx context.Context, url Url) (GenericResponse, error) {
+	return fetcher.FetchRequest(ctx, NewRequest("GET", url, nil))
+}
+
+// FetchRequest is like FetchContext, but for an arbitrary request, e.g., a POST with a body.
+func (fetcher *UrlFetcher) FetchRequest(ctx context.Context, request *Request) (GenericResponse, error) {
+	response, err := fetcher.FetchStream(ctx, request)
+	if err != nil {
+		return nil, err
+	}
+
+	httpResponse, ok := response.(*HttpResponse)
+	if ok {
+		err = httpResponse.readBody()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return response, nil
+}
+
+// FetchStream is like FetchRequest, but returns as soon as the response headers have arrived. For HTTP, the body is
+// read from the network as the caller reads it from `OpenBody`, and the connection isn't available to other requests
+// until the body has been read to the end or closed. The fetcher's `BodyTimeout` and `ctx` still apply while the body
+// is being read.
+func (fetcher *UrlFetcher) FetchStream(ctx context.Context, request *Request) (GenericResponse, error) {
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+
+	url := request.Url
 	if url.Scheme == "http" || url.Scheme == "https" {
-		return fetcher.fetchHttpGeneric(url)
-	} else if url.Scheme == "file" {
+		r, err := request.prepare()
+		if err != nil {
+			return nil, err
+		}
+		response, err := fetcher.fetchHttpGeneric(ctx, r)
+		if err != nil {
+			return nil, err
+		}
+		fetcher.pages.record(url, response)
+		return response, nil
+	}
+
+	if request.Method != "GET" {
+		return nil, fmt.Errorf("%s requests are not supported for %s: URLs", request.Method, url.Scheme)
+	}
+
+	if url.Scheme == "file" {
 		return fetcher.fetchFile(url)
 	} else if url.Scheme == "data" {
-		return fetcher.fetchData(url), nil
+		return fetcher.fetchData(url)
 	} else if url.Scheme == "about" {
-		return fetcher.fetchAbout(url), nil
+		return fetcher.fetchAbout(url)
 	} else {
 		// should be impossible
 		panic("unrecognized scheme in url.Request()")
 	}
 }
 
-func (fetcher *UrlFetcher) Cleanup() {
-	for k, conn := range fetcher.connCache {
-		conn.Close()
-		delete(fetcher.connCache, k)
+type FetchResult struct {
+	Url      Url
+	Response GenericResponse
+	Err      error
+}
+
+// FetchAll fetches the URLs in parallel and returns the results in the same order as `urls`. At most
+// `MaxConnsPerHost` requests to the same host are in flight at any one time.
+func (fetcher *UrlFetcher) FetchAll(urls []Url) []FetchResult {
+	results := make([]FetchResult, len(urls))
+	var wg sync.WaitGroup
+	for i, url := range urls {
+		wg.Add(1)
+		go func(i int, url Url) {
+			defer wg.Done()
+			response, err := fetcher.Fetch(url)
+			results[i] = FetchResult{Url: url, Response: response, Err: err}
+		}(i, url)
+	}
+	wg.Wait()
+	return results
+}
+
+func (fetcher *UrlFetcher) fetchHttpGeneric(ctx context.Context, request *Request) (*HttpResponse, error) {
+	policy := fetcher.RedirectPolicy
+	url := request.Url
+	chain := []RedirectHop{}
+	visited := map[string]bool{}
+
+	for {
+		visited[fetcher.redirectKey(request)] = true
+		r, err := fetcher.fetchHttpAuthenticated(ctx, request)
+		if err != nil {
+			return nil, err
+		}
+
+		if !isRedirectStatus(r.Status) || policy.MaxRedirects == 0 {
+			r.Url = url
+			r.RedirectChain = chain
+			return r, nil
+		}
+		r.discardBody()
+
+		location, ok := r.Headers.Lookup("location")
+		if !ok {
+			return nil, fmt.Errorf("got HTTP %d response but no 'Location' header present: %s", r.Status, url.Original)
+		}
+
+		redirectUrl, err := url.Resolve(location)
+		if err != nil {
+			return nil, fmt.Errorf("could not parse redirect URL (original=%q, redirect=%q): %s", url.Original, location, err.Error())
+		}
+
+		// WHATWG Fetch standard, section 4.4: the fragment carries over unless the redirect specifies its own
+		if !redirectUrl.HasFragment {
+			redirectUrl.Fragment = url.Fragment
+			redirectUrl.HasFragment = url.HasFragment
+			redirectUrl.Original = redirectUrl.String()
+		}
+
+		if len(chain) >= policy.MaxRedirects {
+			return nil, fmt.Errorf("%w (max %d): %s", ErrTooManyRedirects, policy.MaxRedirects, url.Original)
+		}
+
+		err = policy.check(url, redirectUrl)
+		if err != nil {
+			return nil, err
+		}
+
+		PrintVerbose(fmt.Sprintf("following redirect (%d) from %s to %s", r.Status, url.Original, redirectUrl.Original))
+		chain = append(chain, RedirectHop{Url: url, Status: r.Status})
+
+		method := redirectMethod(r.Status, request.Method)
+		if method != request.Method {
+			request = request.withMethod(method)
+		} else {
+			request = request.clone()
+		}
+		// WHATWG Fetch standard, section 4.4: credentials meant for one origin must not be sent to another
+		if redirectUrl.Origin() != url.Origin() {
+			request.Headers.Del("authorization")
+		}
+		request.Url = redirectUrl
+
+		if visited[fetcher.redirectKey(request)] {
+			return nil, fmt.Errorf("%w: %s redirects back to %s", ErrRedirectLoop, url.Original, redirectUrl.Original)
+		}
+		url = redirectUrl
 	}
 }
 
-func (fetcher *UrlFetcher) openConnection(address string, isTls bool) (net.Conn, error) {
-	existingConn, ok := fetcher.connCache[address]
-	if ok {
-		PrintVerbose(fmt.Sprintf("using cached connection to %s", address))
-		return existingConn, nil
+// makes a single request, without following redirects, using the cache if possible
+func (fetcher *UrlFetcher) fetchHttpCached(ctx context.Context, request *Request) (*HttpResponse, error) {
+	if fetcher.Cache == nil {
+		return fetcher.fetchHttpOnce(ctx, request)
 	}
 
-	var conn net.Conn
-	var err error
-	if isTls {
-		PrintVerbose(fmt.Sprintf("opening TLS connection to %s", address))
-		conn, err = tls.Dial("tcp", address, &tls.Config{})
-	} else {
-		PrintVerbose(fmt.Sprintf("opening TCP connection to %s", address))
-		conn, err = net.Dial("tcp", address)
+	key := cacheKey(request.Url)
+	if request.Method != "GET" || request.isConditional() {
+		r, err := fetcher.fetchHttpOnce(ctx, request)
+		if err == nil && !isSafeMethod(request.Method) && r.Status >= 200 && r.Status < 400 {
+			// RFC 9111, section 4.4: a successful unsafe request (e.g., a POST) may have changed the resource
+			fetcher.Cache.Delete(key)
+		}
+		return r, err
+	}
+
+	// before any conditional headers are added for revalidation
+	original := request
+	requestHeader := func(name string) (string, bool) {
+		return fetcher.requestHeader(original, name)
+	}
+	entry, ok := fetcher.Cache.Get(key)
+	if ok && !entry.matchesVary(requestHeader) {
+		PrintVerbose(fmt.Sprintf("cached response for %s varies on headers that differ for this request", key))
+		ok = false
+	}
+	if ok && entry.isFresh(time.Now(), fetcher.SharedCache) {
+		PrintVerbose(fmt.Sprintf("using cached response for %s", key))
+		r := entry.Response.clone()
+		r.FromCache = true
+		return r, nil
 	}
 
+	var conditionalHeaders Headers
+	if ok {
+		conditionalHeaders = entry.validators()
+	}
+	if conditionalHeaders != nil {
+		PrintVerbose(fmt.Sprintf("revalidating cached response for %s", key))
+		request = request.clone()
+		for _, field := range conditionalHeaders {
+			request.Headers.Set(field.Name, field.Value)
+		}
+	}
+
+	requestTime := time.Now()
+	r, err := fetcher.fetchHttpOnce(ctx, request)
 	if err != nil {
 		return nil, err
 	}
+	responseTime := time.Now()
+
+	if conditionalHeaders != nil && r.Status == 304 {
+		r.discardBody()
+		entry.update(r, requestTime, responseTime)
+		fetcher.storeInCache(key, entry)
+		r = entry.Response.clone()
+		r.FromCache = true
+		return r, nil
+	}
 
-	fetcher.connCache[address] = conn
-	return conn, nil
+	storable := isStorableResponse(r, fetcher.SharedCache)
+	if fetcher.SharedCache && request.Headers.Has("authorization") && !isStorableWithAuthorization(r) {
+		storable = false
+	}
+	if storable {
+		// the response can only be stored once all of its body has arrived
+		r.body = &bodyRecorder{body: r.body, complete: func(body []byte) {
+			stored := r.clone()
+			stored.Body = bytes.Clone(body)
+			fetcher.storeInCache(key, &CacheEntry{
+				Response:     stored,
+				RequestTime:  requestTime,
+				ResponseTime: responseTime,
+				VaryHeaders:  selectVaryHeaders(stored, requestHeader),
+			})
+		}}
+	} else if ok {
+		// RFC 9111, section 4.4: the stored response has been superseded
+		fetcher.Cache.Delete(key)
+	}
+	return r, nil
 }
 
-func (fetcher *UrlFetcher) uncache(address string) {
-	delete(fetcher.connCache, address)
+// the value that `request` will send for the header field `name`, from its own headers, the cookie jar or the
+// fetcher's defaults
+func (fetcher *UrlFetcher) requestHeader(request *Request, name string) (string, bool) {
+	if request.Headers.Has(name) {
+		return request.Headers.GetList(name), true
+	}
+	if strings.EqualFold(name, "cookie") && fetcher.Cookies != nil {
+		cookieHeader := fetcher.Cookies.CookieHeader(request.Url, time.Now())
+		return cookieHeader, cookieHeader != ""
+	}
+	if fetcher.DefaultHeaders.Has(name) {
+		return fetcher.DefaultHeaders.GetList(name), true
+	}
+	return "", false
 }
 
-func (fetcher *UrlFetcher) fetchHttpGeneric(url Url) (*HttpResponse, error) {
-	// TODO: make this configurable
-	redirectsRemaining := 5
+// a failure to write to the cache shouldn't fail the fetch
+func (fetcher *UrlFetcher) storeInCache(key string, entry *CacheEntry) {
+	err := fetcher.Cache.Put(key, entry)
+	if err != nil {
+		PrintVerbose(fmt.Sprintf("could not store response for %s in cache: %s", key, err.Error()))
+	}
+}
 
-	for redirectsRemaining > 0 {
-		address := fmt.Sprintf("%s:%d", url.Host, url.PortOrDefault())
-		isTls := url.Scheme == "https"
-		conn, err := fetcher.openConnection(address, isTls)
-		if err != nil {
-			return nil, err
+// makes a single request, without following redirects
+func (fetcher *UrlFetcher) fetchHttpOnce(ctx context.Context, request *Request) (*HttpResponse, error) {
+	url := request.Url
+	// a Cookie header set by the caller takes precedence over the jar
+	if fetcher.Cookies != nil && !request.Headers.Has("cookie") {
+		cookieHeader := fetcher.Cookies.CookieHeader(url, time.Now())
+		if cookieHeader != "" {
+			request = request.clone()
+			request.Headers.Add("Cookie", cookieHeader)
 		}
+	}
+
+	route := fetcher.routeFor(url)
+	address := route.key()
+	conn, reused, err := fetcher.openConnection(ctx, route)
+	if err != nil {
+		return nil, err
+	}
 
-		err = sendHttpRequest(url, conn)
+	r, err := fetcher.roundTrip(ctx, address, conn, request)
+	if err != nil && reused && isIdempotentMethod(request.Method) && errors.Is(err, errConnectionClosedByServer) {
+		// RFC 9112, section 9.3.1: idempotent requests can be retried if the connection closes before we get a
+		// response
+		PrintVerbose(fmt.Sprintf("cached connection to %s was closed by the server; retrying on a new connection", address))
+		conn.conn.Close()
+		conn, err = fetcher.dialConnection(ctx, route)
 		if err != nil {
+			fetcher.closeConnection(address, nil)
 			return nil, err
 		}
+		r, err = fetcher.roundTrip(ctx, address, conn, request)
+	}
 
-		r, err := receiveHttpResponse(conn)
+	if err != nil {
+		// we don't know where the next response on this connection would start
+		fetcher.closeConnection(address, conn)
+		return nil, err
+	}
+
+	// the connection is handed back once the body has been read (see `httpBody`)
+	r.Tls = conn.tlsInfo
+	if fetcher.Cookies != nil {
+		fetcher.Cookies.SetCookies(url, r.Headers.Values("set-cookie"), time.Now())
+	}
+	return r, nil
+}
+
+// the server closed the connection before sending any part of a response, which usually means that a kept-alive
+// connection timed out on the server's side
+var errConnectionClosedByServer = errors.New("connection closed by server")
+
+// Sends the request and reads the response head. The response's body is left on the connection, which belongs to the
+// body from then on.
+func (fetcher *UrlFetcher) roundTrip(ctx context.Context, address string, c *httpConn, request *Request) (*HttpResponse, error) {
+	// cancelling the context unblocks any pending read or write by moving the deadline into the past, including while
+	// the body is being read
+	stop := context.AfterFunc(ctx, func() {
+		c.conn.SetDeadline(time.Now())
+	})
+
+	response, reader, err := fetcher.roundTripWithDeadlines(ctx, c, request)
+	if err != nil {
+		stop()
+		c.conn.SetDeadline(time.Time{})
+		return nil, err
+	}
+
+	response.body = &httpBody{
+		reader:   reader,
+		response: response,
+		fetcher:  fetcher,
+		address:  address,
+		conn:     c,
+		ctx:      ctx,
+		stop:     stop,
+	}
+	return response, nil
+}
+
+func (fetcher *UrlFetcher) roundTripWithDeadlines(ctx context.Context, c *httpConn, request *Request) (*HttpResponse, io.Reader, error) {
+	headerDeadline := deadlineAfter(fetcher.HeaderTimeout)
+	c.conn.SetDeadline(headerDeadline)
+	err := sendHttpRequestHead(request, fetcher.DefaultHeaders, c.forwardingProxy, c.conn)
+	if err != nil {
+		return nil, nil, classifyWriteError(ctx, err, fetcher.HeaderTimeout)
+	}
+
+	var response *HttpResponse
+	if request.expectsContinue() {
+		response, err = awaitContinue(ctx, c, headerDeadline, fetcher.Limits)
 		if err != nil {
-			return nil, err
+			return nil, nil, classifyTimeout(ctx, err, TIMEOUT_HEADERS, fetcher.HeaderTimeout)
 		}
+	}
 
-		if r.Version == "HTTP/1.0" {
-			// in particular, this is necessary because the Python test server only supports HTTP/1.0
-			PrintVerbose(fmt.Sprintf("connection using HTTP/1.0; removing from connection cache: %s", address))
-			fetcher.uncache(address)
+	// if there's already a response, the server rejected the request before seeing the body
+	if response == nil {
+		if request.body != nil {
+			_, err = c.conn.Write(request.body)
+			if err != nil {
+				return nil, nil, classifyWriteError(ctx, err, fetcher.HeaderTimeout)
+			}
 		}
 
-		if r.Status >= 300 && r.Status < 400 {
-			location, ok := r.Headers["location"]
-			if !ok {
-				return nil, fmt.Errorf("got HTTP %d response but no 'Location' header present: %s", r.Status, url.Original)
-			}
+		response, err = readHttpResponseHead(c.reader, fetcher.Limits)
+		if err != nil {
+			return nil, nil, classifyTimeout(ctx, err, TIMEOUT_HEADERS, fetcher.HeaderTimeout)
+		}
+	}
 
-			PrintVerbose(fmt.Sprintf("following redirect from %s to %s", url.Original, location))
-			if strings.HasPrefix(location, "/") {
-				url.Original = fmt.Sprintf("%s%s", address, location)
-				url.Path = location
-			} else {
-				url, err = ParseUrl(location)
-				if err != nil {
-					return nil, fmt.Errorf("could not parse redirect URL (original=%q, redirect=%q): %s", url.Original, location, err.Error())
-				}
-			}
+	reader, err := openHttpResponseBody(c.reader, response, request.Method, fetcher.Limits)
+	if err != nil {
+		return nil, nil, err
+	}
+	// the body timeout starts now, however slowly the caller reads the body
+	c.conn.SetDeadline(deadlineAfter(fetcher.BodyTimeout))
+	return response, reader, nil
+}
 
-			redirectsRemaining--
-		} else {
-			return r, nil
+func classifyWriteError(ctx context.Context, err error, timeout time.Duration) error {
+	if isConnectionClosedError(err) {
+		return fmt.Errorf("%w: %s", errConnectionClosedByServer, err.Error())
+	}
+	return classifyTimeout(ctx, err, TIMEOUT_HEADERS, timeout)
+}
+
+// RFC 9110, section 10.1.1: after sending "Expect: 100-continue", wait for the server to either tell us to go ahead
+// (in which case nil is returned) or send its final response without seeing the body. Servers that don't understand
+// the expectation never answer, so after a while we send the body anyway.
+func awaitContinue(ctx context.Context, c *httpConn, headerDeadline time.Time, limits ResponseLimits) (*HttpResponse, error) {
+	head := newHeadReader(c.reader, limits)
+	for {
+		continueDeadline := time.Now().Add(EXPECT_CONTINUE_TIMEOUT)
+		if !headerDeadline.IsZero() && headerDeadline.Before(continueDeadline) {
+			continueDeadline = headerDeadline
+		}
+		c.conn.SetReadDeadline(continueDeadline)
+		_, err := c.reader.Peek(1)
+		c.conn.SetReadDeadline(headerDeadline)
+		// if the context was cancelled while we were waiting, we may have just clobbered the deadline that
+		// `roundTrip` set to interrupt us
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+
+		var netErr net.Error
+		if errors.As(err, &netErr) && netErr.Timeout() && continueDeadline != headerDeadline {
+			PrintVerbose("no response to 'Expect: 100-continue'; sending the request body anyway")
+			return nil, nil
+		} else if err != nil {
+			return nil, err
+		}
+
+		response, err := readOneResponseHead(head)
+		if err != nil {
+			return nil, err
+		}
+		if response.Status == 100 {
+			return nil, nil
+		} else if response.Status >= 200 || response.Status == 101 {
+			response.bodyNotSent = true
+			return response, nil
 		}
+		PrintVerbose(fmt.Sprintf("skipping interim response: %d %s", response.Status, response.StatusExplanation))
 	}
+}
 
-	return nil, fmt.Errorf("max redirects exceeded for %s", url.Original)
+// the zero time means no deadline
+func deadlineAfter(timeout time.Duration) time.Time {
+	if timeout == 0 {
+		return time.Time{}
+	}
+	return time.Now().Add(timeout)
 }
 
-func sendHttpRequest(url Url, conn net.Conn) error {
-	var requestHeaders = map[string]string{
-		"Host":       url.Host,
-		"Connection": "keep-alive",
-		"User-Agent": "Mozilla/5.0 (desktop; rv:0.1) TinCan/0.1",
+// I/O errors caused by a deadline are turned into either the context's error (if it was cancelled) or a
+// `TimeoutError` (if our own timeout expired)
+func classifyTimeout(ctx context.Context, err error, phase TimeoutPhase, timeout time.Duration) error {
+	if ctx.Err() != nil {
+		return fmt.Errorf("%w (%s)", ctx.Err(), phase)
 	}
 
-	requestLine := fmt.Sprintf("GET %s HTTP/1.1\r\n", url.Path)
-	_, err := fmt.Fprint(conn, requestLine)
-	if err != nil {
-		return err
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return &TimeoutError{Phase: phase, Timeout: timeout}
 	}
+	return err
+}
 
-	for key, value := range requestHeaders {
-		fmt.Fprintf(conn, "%s: %s\r\n", key, value)
+func isConnectionClosedError(err error) bool {
+	return errors.Is(err, io.EOF) || errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.EPIPE)
+}
+
+// RFC 9110, section 9.2.2
+func isIdempotentMethod(method string) bool {
+	switch method {
+	case "GET", "HEAD", "PUT", "DELETE", "OPTIONS", "TRACE":
+		return true
+	default:
+		return false
 	}
-	fmt.Fprintf(conn, "\r\n")
-	return nil
 }
 
-func receiveHttpResponse(conn net.Conn) (*HttpResponse, error) {
-	reader := bufio.NewReader(conn)
+// Writes the request line and headers, but not the body. The headers are always written in the same order: Host and
+// Connection (and Proxy-Authorization, if needed), then the defaults that the request doesn't override, then the
+// request's own headers, and finally Content-Length.
+//
+// `proxy` is the HTTP proxy that will forward the request, or nil if it's going straight to the server.
+func sendHttpRequestHead(request *Request, defaultHeaders Headers, proxy *Url, writer io.Writer) error {
+	url := request.Url
+	headers := Headers{
+		// RFC 9112, section 3.2: Host should come first
+		{"Host", url.hostAndPort()},
+		{"Connection", "keep-alive"},
+	}
+	target := url.requestTarget()
+	if proxy != nil {
+		target = url.absoluteRequestTarget()
+		authorization := proxyAuthorization(proxy)
+		if authorization != "" {
+			headers.Add("Proxy-Authorization", authorization)
+		}
+	}
+	headers = append(headers, defaultHeaders...)
+	for _, field := range request.Headers {
+		headers.Del(field.Name)
+	}
+	for _, field := range request.Headers {
+		if !isFramingHeader(field.Name) {
+			headers.Add(field.Name, field.Value)
+		}
+	}
+	contentLength, ok := request.contentLength()
+	if ok {
+		headers.Add("Content-Length", strconv.Itoa(contentLength))
+	}
 
-	statusLine, err := readHttpLine(reader)
+	// the fragment is never sent to the server
+	var buffer bytes.Buffer
+	fmt.Fprintf(&buffer, "%s %s HTTP/1.1\r\n", request.Method, target)
+	buffer.WriteString(headers.String())
+	buffer.WriteString("\r\n")
+
+	_, err := writer.Write(buffer.Bytes())
+	return err
+}
+
+// headers that the fetcher computes from the body itself
+func isFramingHeader(name string) bool {
+	return strings.EqualFold(name, "content-length") || strings.EqualFold(name, "transfer-encoding")
+}
+
+// reads the status line and headers, skipping over any interim (1xx) responses
+func readHttpResponseHead(reader *bufio.Reader, limits ResponseLimits) (*HttpResponse, error) {
+	head := newHeadReader(reader, limits)
+	for {
+		response, err := readOneResponseHead(head)
+		if err != nil {
+			return nil, err
+		}
+
+		// interim responses (e.g., 100 Continue) are followed by the real response on the same connection
+		if response.Status >= 100 && response.Status < 200 && response.Status != 101 {
+			PrintVerbose(fmt.Sprintf("skipping interim response: %d %s", response.Status, response.StatusExplanation))
+			continue
+		}
+		return response, nil
+	}
+}
+
+func readOneResponseHead(head *headReader) (*HttpResponse, error) {
+	statusLine, err := head.readLine()
 	if err != nil {
+		if isConnectionClosedError(err) {
+			return nil, fmt.Errorf("%w: %s", errConnectionClosedByServer, err.Error())
+		}
 		return nil, err
 	}
+
+	// RFC 9112, section 4: the reason phrase may be empty, but the space before it may not be left out (although some
+	// servers do anyway)
 	statusParts := strings.SplitN(statusLine, " ", 3)
+	if len(statusParts) < 2 || !strings.HasPrefix(statusParts[0], "HTTP/") {
+		return nil, fmt.Errorf("malformed status line: %q", statusLine)
+	}
 	version := statusParts[0]
 	statusStr := statusParts[1]
+	if len(statusStr) != 3 {
+		return nil, fmt.Errorf("malformed HTTP status: %q", statusStr)
+	}
 	status, err := strconv.Atoi(statusStr)
+	if err != nil || status < 100 {
+		return nil, fmt.Errorf("malformed HTTP status: %q", statusStr)
+	}
+	statusExplanation := ""
+	if len(statusParts) == 3 {
+		statusExplanation = statusParts[2]
+	}
+
+	responseHeaders, err := head.readHeaders()
 	if err != nil {
-		return nil, fmt.Errorf("could not parse HTTP status as integer: %s", err.Error())
+		return nil, err
 	}
-	statusExplanation := statusParts[2]
 
-	responseHeaders := make(map[string]string)
+	return &HttpResponse{
+		Version:           version,
+		Status:            status,
+		StatusExplanation: statusExplanation,
+		Headers:           responseHeaders,
+	}, nil
+}
+
+// RFC 9110, section 6.4.1: responses to HEAD, and 1xx, 204 and 304 responses, never have a body regardless of their
+// headers
+func hasResponseBody(method string, status int) bool {
+	if method == "HEAD" {
+		return false
+	}
+	return !(status >= 100 && status < 200) && status != 204 && status != 304
+}
+
+// RFC 9112, section 6.3: a message with several Content-Length fields (or a list in one field) is only valid if they
+// all agree
+func parseContentLength(values []string) (int, error) {
+	contentLength := -1
+	for _, value := range values {
+		for _, part := range strings.Split(value, ",") {
+			part = strings.TrimSpace(part)
+			n, err := strconv.Atoi(part)
+			if err != nil || n < 0 {
+				return 0, fmt.Errorf("could not parse Content-Length as integer: %q", part)
+			}
+			if contentLength != -1 && n != contentLength {
+				return 0, fmt.Errorf("conflicting Content-Length values: %d and %d", contentLength, n)
+			}
+			contentLength = n
+		}
+	}
+	return contentLength, nil
+}
+
+// reads header fields (or trailer fields) up to and including the blank line that ends them
+func readHttpHeaders(reader *bufio.Reader, limits ResponseLimits) (Headers, error) {
+	return newHeadReader(reader, limits).readHeaders()
+}
+
+// Reads the head of a response, enforcing `limits` on it as a whole.
+type headReader struct {
+	reader *bufio.Reader
+	limits ResponseLimits
+	// how much has been read so far
+	bytes  int
+	fields int
+}
+
+func newHeadReader(reader *bufio.Reader, limits ResponseLimits) *headReader {
+	return &headReader{reader: reader, limits: limits}
+}
+
+func (head *headReader) readLine() (string, error) {
+	// a line can't run past the end of what's allowed for the whole head, either
+	limit, maxLength := LIMIT_LINE_LENGTH, limitOrMax(head.limits.MaxLineLength)
+	if head.limits.MaxHeaderBytes > 0 {
+		remaining := head.limits.MaxHeaderBytes - head.bytes - 2
+		if remaining < maxLength {
+			limit, maxLength = LIMIT_HEADER_BYTES, remaining
+		}
+	}
+
+	line, err := readHttpLine(head.reader, maxLength)
+	if err == errLineTooLong {
+		if limit == LIMIT_HEADER_BYTES {
+			return "", &LimitError{Limit: limit, Max: head.limits.MaxHeaderBytes}
+		}
+		return "", &LimitError{Limit: limit, Max: head.limits.MaxLineLength}
+	} else if err != nil {
+		return "", err
+	}
+	head.bytes += len(line) + 2
+	return line, nil
+}
+
+func (head *headReader) readHeaders() (Headers, error) {
+	headers := Headers{}
 	for {
-		line, err := readHttpLine(reader)
+		line, err := head.readLine()
 		if err != nil {
 			return nil, err
 		}
@@ -206,84 +951,245 @@ func receiveHttpResponse(conn net.Conn) (*HttpResponse, error) {
 			break
 		}
 
-		parts := strings.SplitN(line, ":", 2)
-		// TODO: handle error more gracefully
-		key := strings.ToLower(parts[0])
-		value := strings.TrimSpace(parts[1])
-		responseHeaders[key] = value
-	}
+		// RFC 9112, section 5.2: obsolete line folding continues the previous field's value
+		if line[0] == ' ' || line[0] == '\t' {
+			if len(headers) == 0 {
+				return nil, fmt.Errorf("malformed header line (continuation without a field): %q", line)
+			}
+			last := &headers[len(headers)-1]
+			last.Value = strings.TrimSpace(last.Value + " " + strings.TrimSpace(line))
+			continue
+		}
 
-	// TODO: handle this case
-	_, ok := responseHeaders["transfer-encoding"]
-	if ok {
-		return nil, errors.New("transfer-encoding header not supported")
+		name, value, ok := strings.Cut(line, ":")
+		if !ok {
+			return nil, fmt.Errorf("malformed header line (no colon): %q", line)
+		}
+		// RFC 9112, section 5.1: in particular, there can't be whitespace between the name and the colon
+		if !isHttpToken(name) {
+			return nil, fmt.Errorf("malformed header line (invalid field name): %q", line)
+		}
+		head.fields++
+		if head.limits.MaxHeaderFields > 0 && head.fields > head.limits.MaxHeaderFields {
+			return nil, &LimitError{Limit: LIMIT_HEADER_FIELDS, Max: head.limits.MaxHeaderFields}
+		}
+		headers.Add(name, strings.TrimSpace(value))
 	}
+	return headers, nil
+}
 
-	// TODO: handle this case
-	_, ok = responseHeaders["content-encoding"]
-	if ok {
-		return nil, errors.New("content-encoding header not supported")
+// we only support "chunked" on its own, which is what servers send in practice
+func isChunkedTransferEncoding(value string) bool {
+	return strings.EqualFold(strings.TrimSpace(value), "chunked")
+}
+
+func parseChunkSize(sizeStr string) (int64, error) {
+	if sizeStr == "" || len(sizeStr) > 15 {
+		return 0, fmt.Errorf("invalid chunk size: %q", sizeStr)
 	}
 
-	contentLengthStr, ok := responseHeaders["content-length"]
-	if !ok {
-		return nil, errors.New("content-length header is missing")
+	for i := 0; i < len(sizeStr); i++ {
+		if !isHexDigit(sizeStr[i]) {
+			return 0, fmt.Errorf("invalid chunk size: %q", sizeStr)
+		}
 	}
 
-	contentLength, err := strconv.Atoi(contentLengthStr)
-	if err != nil {
-		return nil, fmt.Errorf("could not parse Content-Length as integer: %s", err.Error())
+	return strconv.ParseInt(sizeStr, 16, 64)
+}
+
+// fields that describe the message framing or routing can't be sent in a trailer (RFC 9110, section 6.5.1)
+var FORBIDDEN_TRAILERS = map[string]bool{
+	"content-length":    true,
+	"content-encoding":  true,
+	"content-type":      true,
+	"host":              true,
+	"transfer-encoding": true,
+	"trailer":           true,
+}
+
+func mergeTrailers(headers *Headers, trailers Headers) {
+	for _, field := range trailers {
+		if FORBIDDEN_TRAILERS[strings.ToLower(field.Name)] {
+			PrintVerbose(fmt.Sprintf("ignoring forbidden trailer field: %s", field.Name))
+			continue
+		}
+		headers.Add(field.Name, field.Value)
 	}
+}
 
-	content := make([]byte, contentLength)
-	_, err = io.ReadFull(reader, content)
+func (fetcher *UrlFetcher) fetchData(url Url) (*DataResponse, error) {
+	data, err := DecodeDataUrl(url)
 	if err != nil {
 		return nil, err
 	}
 
-	return &HttpResponse{
-		Version:           version,
-		Status:            status,
-		StatusExplanation: statusExplanation,
-		Headers:           responseHeaders,
-		// TODO: read charset from Content-Type header
-		Content: string(content),
-	}, nil
+	return &DataResponse{Data: data, MimeType: url.MimeType, Charset: url.MimeType.Charset()}, nil
+}
+
+func (fetcher *UrlFetcher) fetchAbout(url Url) (*DataResponse, error) {
+	// TODO: bad idea to reuse DataResponse type for `about:` URLs?
+	switch url.Path {
+	case "cookies":
+		return &DataResponse{Data: []byte(fetcher.describeCookies()), MimeType: TEXT_PLAIN_UTF8, Charset: "utf-8"}, nil
+	case "page-info":
+		info, err := fetcher.describePageAt(url.Query)
+		if err != nil {
+			return nil, err
+		}
+		return &DataResponse{Data: []byte(info), MimeType: TEXT_PLAIN_UTF8, Charset: "utf-8"}, nil
+	default:
+		return &DataResponse{Data: []byte{}}, nil
+	}
 }
 
-func (fetcher *UrlFetcher) fetchFile(url Url) (*FileResponse, error) {
-	PrintVerbose(fmt.Sprintf("reading local file: %s", url.Path))
-	data, err := os.ReadFile(url.Path)
+var TEXT_PLAIN_UTF8 = MimeType{Type: "text", Subtype: "plain", Parameters: []MimeTypeParameter{{Name: "charset", Value: "utf-8"}}}
+var TEXT_HTML_UTF8 = MimeType{Type: "text", Subtype: "html", Parameters: []MimeTypeParameter{{Name: "charset", Value: "utf-8"}}}
+
+// the text of the `about:page-info` page for the page at `target`, from the response that the page was loaded from
+// (see `pageHistory`), so that nothing is sent to the server again
+func (fetcher *UrlFetcher) describePageAt(target string) (string, error) {
+	if target == "" {
+		return "", errors.New("about:page-info needs the URL of a page, e.g., about:page-info?https://example.com/")
+	}
+	url, err := ParseUrl(target)
 	if err != nil {
-		return nil, err
+		return "", err
+	}
+
+	response, ok := fetcher.pages.lookup(url)
+	if !ok {
+		return "", fmt.Errorf("no page info for %s: it has not been loaded", url.String())
 	}
-	return &FileResponse{Content: string(data)}, nil
+	return DescribePage(url, response, ""), nil
 }
 
-func (fetcher *UrlFetcher) fetchData(url Url) *DataResponse {
-	return &DataResponse{Content: url.Path, MimeType: url.MimeType}
+// the same as Firefox's default limit on session history entries (browser.sessionhistory.max_entries)
+const MAX_PAGE_HISTORY = 50
+
+// The heads of the most recent HTTP responses that the fetcher returned, by URL, for `about:page-info`. Bodies aren't
+// kept.
+type pageHistory struct {
+	mu sync.Mutex
+	// by URL without the fragment, both as requested and after redirects
+	entries map[string]*HttpResponse
+	// keys of `entries`, oldest first
+	order []string
 }
 
-func (fetcher *UrlFetcher) fetchAbout(url Url) *DataResponse {
-	// TODO: bad idea to reuse DataResponse type for `about:` URLs?
-	return &DataResponse{Content: ""}
+func newPageHistory() *pageHistory {
+	return &pageHistory{entries: make(map[string]*HttpResponse)}
 }
 
-func readHttpLine(reader *bufio.Reader) (string, error) {
+func (history *pageHistory) record(requested Url, response *HttpResponse) {
+	head := response.clone()
+	head.Body = nil
+
+	history.mu.Lock()
+	defer history.mu.Unlock()
+	for _, url := range []Url{requested, response.Url} {
+		key := url.withoutFragment().String()
+		if _, ok := history.entries[key]; ok {
+			history.forget(key)
+		}
+		history.entries[key] = head
+		history.order = append(history.order, key)
+	}
+	for len(history.order) > MAX_PAGE_HISTORY {
+		delete(history.entries, history.order[0])
+		history.order = history.order[1:]
+	}
+}
+
+// removes `key` from `order`; the caller holds the lock
+func (history *pageHistory) forget(key string) {
+	for i, k := range history.order {
+		if k == key {
+			history.order = append(history.order[:i], history.order[i+1:]...)
+			return
+		}
+	}
+}
+
+func (history *pageHistory) lookup(url Url) (*HttpResponse, bool) {
+	history.mu.Lock()
+	defer history.mu.Unlock()
+	response, ok := history.entries[url.withoutFragment().String()]
+	return response, ok
+}
+
+// the text of the `about:cookies` page
+func (fetcher *UrlFetcher) describeCookies() string {
+	if fetcher.Cookies == nil {
+		return "Cookies are disabled.\n"
+	}
+
+	cookies := fetcher.Cookies.Cookies()
+	if len(cookies) == 0 {
+		return "No cookies.\n"
+	}
+
+	var builder strings.Builder
+	for _, cookie := range cookies {
+		domain := cookie.Domain
+		if !cookie.HostOnly {
+			domain = "." + domain
+		}
+		fmt.Fprintf(&builder, "%s=%s\n", cookie.Name, cookie.Value)
+		fmt.Fprintf(&builder, "  domain: %s\n", domain)
+		fmt.Fprintf(&builder, "  path: %s\n", cookie.Path)
+		if cookie.isPersistent() {
+			fmt.Fprintf(&builder, "  expires: %s\n", cookie.Expires.UTC().Format(time.RFC1123))
+		} else {
+			fmt.Fprintf(&builder, "  expires: end of session\n")
+		}
+
+		flags := []string{}
+		if cookie.Secure {
+			flags = append(flags, "Secure")
+		}
+		if cookie.HttpOnly {
+			flags = append(flags, "HttpOnly")
+		}
+		if cookie.SameSite != "" {
+			flags = append(flags, "SameSite="+cookie.SameSite)
+		}
+		if len(flags) > 0 {
+			fmt.Fprintf(&builder, "  %s\n", strings.Join(flags, ", "))
+		}
+		builder.WriteString("\n")
+	}
+	return builder.String()
+}
+
+var errLineTooLong = errors.New("line too long")
+
+// Reads a line ending in CRLF (a bare LF doesn't end it) and returns it without the CRLF. If the line is longer than
+// `maxLength`, `errLineTooLong` is returned without buffering the rest of it.
+func readHttpLine(reader *bufio.Reader, maxLength int) (string, error) {
 	var buffer bytes.Buffer
 	for {
 		// TODO: safe to convert header from bytes to string?
-		bs, err := reader.ReadString('\n')
-		if err != nil {
+		bs, err := reader.ReadSlice('\n')
+		if err != nil && err != bufio.ErrBufferFull {
 			return "", err
 		}
+		buffer.Write(bs)
+		if buffer.Len()-2 > maxLength {
+			return "", errLineTooLong
+		}
 
-		if strings.HasSuffix(bs, "\r\n") {
-			buffer.WriteString(strings.TrimSuffix(bs, "\r\n"))
+		if err == nil && bytes.HasSuffix(buffer.Bytes(), []byte("\r\n")) {
+			buffer.Truncate(buffer.Len() - 2)
 			break
-		} else {
-			buffer.WriteString(bs)
 		}
 	}
 	return buffer.String(), nil
 }
+
+// for limits where zero means no limit
+func limitOrMax(limit int) int {
+	if limit <= 0 {
+		return math.MaxInt
+	}
+	return limit
+}
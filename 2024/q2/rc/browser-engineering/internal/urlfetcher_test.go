@@ -1,10 +1,24 @@
 package internal
 
 import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"context"
+	"errors"
 	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -21,7 +35,7 @@ func TestRequest(t *testing.T) {
 	r, err := fetcher.Fetch(url)
 	assertNoErr(t, err)
 
-	assertStrEqual(t, r.GetContent(), EXAMPLE_TXT_CONTENTS)
+	assertStrEqual(t, string(r.GetBody()), EXAMPLE_TXT_CONTENTS)
 
 	url, err = ParseUrl(fmt.Sprintf("http://localhost:%d/example.html", testServer.Port))
 	assertNoErr(t, err)
@@ -29,7 +43,701 @@ func TestRequest(t *testing.T) {
 	r, err = fetcher.Fetch(url)
 	assertNoErr(t, err)
 
-	assertStrEqual(t, r.GetContent(), EXAMPLE_HTML_CONTENTS)
+	assertStrEqual(t, string(r.GetBody()), EXAMPLE_HTML_CONTENTS)
+}
+
+func TestFetchDataUrl(t *testing.T) {
+	url, err := ParseUrl("data:text/html;charset=utf-8;base64,PHA+aMOpPC9wPg==")
+	assertNoErr(t, err)
+
+	fetcher := NewUrlFetcher()
+	r, err := fetcher.Fetch(url)
+	assertNoErr(t, err)
+
+	dataResponse := r.(*DataResponse)
+	assertStrEqual(t, string(dataResponse.Data), "<p>hé</p>")
+	assertStrEqual(t, dataResponse.Charset, "utf-8")
+	assertStrEqual(t, dataResponse.MimeType.Essence(), "text/html")
+}
+
+func TestChunkedResponse(t *testing.T) {
+	server := launchRawServer(t,
+		"HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\n"+
+			"7\r\nHello, \r\n"+
+			"6;name=value\r\nworld!\r\n"+
+			"0\r\nX-Checksum: abc123\r\nContent-Length: 999\r\n\r\n",
+		"HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\n"+
+			"A\r\nsecond one\r\n0\r\n\r\n",
+	)
+	defer server.Cleanup()
+
+	url, err := ParseUrl(fmt.Sprintf("http://localhost:%d/", server.Port))
+	assertNoErr(t, err)
+
+	fetcher := NewUrlFetcher()
+	defer fetcher.Cleanup()
+
+	r, err := fetcher.Fetch(url)
+	assertNoErr(t, err)
+	httpResponse := r.(*HttpResponse)
+	assertStrEqual(t, string(httpResponse.Body), "Hello, world!")
+	assertStrEqual(t, httpResponse.Headers.Get("x-checksum"), "abc123")
+	ok := httpResponse.Headers.Has("content-length")
+	if ok {
+		t.Errorf("forbidden trailer field should not have been merged into headers")
+	}
+
+	// the second response must be read from the same connection
+	r, err = fetcher.Fetch(url)
+	assertNoErr(t, err)
+	assertStrEqual(t, string(r.GetBody()), "second one")
+	assertIntEqual(t, server.ConnectionCount(), 1)
+}
+
+func TestMalformedChunkedResponse(t *testing.T) {
+	server := launchRawServer(t,
+		"HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\nzz\r\nHello\r\n0\r\n\r\n",
+	)
+	defer server.Cleanup()
+
+	url, err := ParseUrl(fmt.Sprintf("http://localhost:%d/", server.Port))
+	assertNoErr(t, err)
+
+	fetcher := NewUrlFetcher()
+	defer fetcher.Cleanup()
+
+	_, err = fetcher.Fetch(url)
+	if err == nil {
+		t.Errorf("expected error for invalid chunk size")
+	}
+}
+
+func TestMalformedHeaderLine(t *testing.T) {
+	server := launchRawServer(t,
+		"HTTP/1.1 200 OK\r\nContent-Length: 5\r\nthis is not a header\r\n\r\nHello",
+	)
+	defer server.Cleanup()
+
+	url, err := ParseUrl(fmt.Sprintf("http://localhost:%d/", server.Port))
+	assertNoErr(t, err)
+
+	fetcher := NewUrlFetcher()
+	defer fetcher.Cleanup()
+
+	_, err = fetcher.Fetch(url)
+	if err == nil || !strings.Contains(err.Error(), "malformed header line") {
+		t.Errorf("expected malformed header error, got %v", err)
+	}
+}
+
+func TestContentEncoding(t *testing.T) {
+	const body = "Hello, compressed world! Hello, compressed world! Hello, compressed world!"
+
+	var gzipped bytes.Buffer
+	gzipWriter := gzip.NewWriter(&gzipped)
+	gzipWriter.Write([]byte(body))
+	gzipWriter.Close()
+
+	var zlibbed bytes.Buffer
+	zlibWriter := zlib.NewWriter(&zlibbed)
+	zlibWriter.Write([]byte(body))
+	zlibWriter.Close()
+
+	var deflated bytes.Buffer
+	flateWriter, _ := flate.NewWriter(&deflated, flate.DefaultCompression)
+	flateWriter.Write([]byte(body))
+	flateWriter.Close()
+
+	server := launchRawServer(t,
+		fmt.Sprintf("HTTP/1.1 200 OK\r\nContent-Encoding: gzip\r\nContent-Length: %d\r\n\r\n%s", gzipped.Len(), gzipped.String()),
+		// gzip stacked with chunked transfer encoding, split across two chunks
+		fmt.Sprintf("HTTP/1.1 200 OK\r\nContent-Encoding: gzip\r\nTransfer-Encoding: chunked\r\n\r\n%x\r\n%s\r\n%x\r\n%s\r\n0\r\n\r\n",
+			10, gzipped.String()[:10], gzipped.Len()-10, gzipped.String()[10:]),
+		fmt.Sprintf("HTTP/1.1 200 OK\r\nContent-Encoding: deflate\r\nContent-Length: %d\r\n\r\n%s", zlibbed.Len(), zlibbed.String()),
+		fmt.Sprintf("HTTP/1.1 200 OK\r\nContent-Encoding: deflate\r\nContent-Length: %d\r\n\r\n%s", deflated.Len(), deflated.String()),
+		"HTTP/1.1 200 OK\r\nContent-Encoding: br\r\nContent-Length: 3\r\n\r\nabc",
+	)
+	defer server.Cleanup()
+
+	url, err := ParseUrl(fmt.Sprintf("http://localhost:%d/", server.Port))
+	assertNoErr(t, err)
+
+	fetcher := NewUrlFetcher()
+	defer fetcher.Cleanup()
+
+	expectedLengths := []int{gzipped.Len(), gzipped.Len(), zlibbed.Len(), deflated.Len()}
+	for _, expectedLength := range expectedLengths {
+		r, err := fetcher.Fetch(url)
+		assertNoErr(t, err)
+		httpResponse := r.(*HttpResponse)
+		assertStrEqual(t, string(httpResponse.Body), body)
+		assertIntEqual(t, httpResponse.EncodedLength, expectedLength)
+	}
+
+	_, err = fetcher.Fetch(url)
+	if err == nil {
+		t.Errorf("expected error for unsupported content encoding")
+	}
+}
+
+func TestCloseDelimitedResponse(t *testing.T) {
+	server := launchRawServer(t,
+		"HTTP/1.1 200 OK\r\nConnection: close\r\n\r\nread until EOF",
+		"HTTP/1.0 200 OK\r\n\r\nHTTP/1.0 body",
+	)
+	defer server.Cleanup()
+
+	url, err := ParseUrl(fmt.Sprintf("http://localhost:%d/", server.Port))
+	assertNoErr(t, err)
+
+	fetcher := NewUrlFetcher()
+	defer fetcher.Cleanup()
+
+	r, err := fetcher.Fetch(url)
+	assertNoErr(t, err)
+	assertStrEqual(t, string(r.GetBody()), "read until EOF")
+
+	// the first connection was closed by the server, so the fetcher must have opened a new one
+	r, err = fetcher.Fetch(url)
+	assertNoErr(t, err)
+	assertStrEqual(t, string(r.GetBody()), "HTTP/1.0 body")
+	assertIntEqual(t, server.ConnectionCount(), 2)
+	assertIntEqual(t, len(fetcher.conns.idle), 0)
+}
+
+func TestBodylessResponses(t *testing.T) {
+	server := launchRawServer(t,
+		"HTTP/1.1 204 No Content\r\n\r\n",
+		// a 304 may carry the Content-Length of the cached representation, but never a body
+		"HTTP/1.1 304 Not Modified\r\nContent-Length: 1000\r\n\r\n",
+		"HTTP/1.1 100 Continue\r\n\r\nHTTP/1.1 200 OK\r\nContent-Length: 5\r\n\r\nfinal",
+	)
+	defer server.Cleanup()
+
+	url, err := ParseUrl(fmt.Sprintf("http://localhost:%d/", server.Port))
+	assertNoErr(t, err)
+
+	fetcher := NewUrlFetcher()
+	defer fetcher.Cleanup()
+
+	r, err := fetcher.Fetch(url)
+	assertNoErr(t, err)
+	assertIntEqual(t, r.(*HttpResponse).Status, 204)
+	assertStrEqual(t, string(r.GetBody()), "")
+
+	r, err = fetcher.Fetch(url)
+	assertNoErr(t, err)
+	assertIntEqual(t, r.(*HttpResponse).Status, 304)
+	assertStrEqual(t, string(r.GetBody()), "")
+
+	r, err = fetcher.Fetch(url)
+	assertNoErr(t, err)
+	assertIntEqual(t, r.(*HttpResponse).Status, 200)
+	assertStrEqual(t, string(r.GetBody()), "final")
+	assertIntEqual(t, server.ConnectionCount(), 1)
+}
+
+func TestHeadResponseHasNoBody(t *testing.T) {
+	r, err := fetchRawResponseForTest(t, "HEAD", ResponseLimits{}, "HTTP/1.1 200 OK\r\nContent-Length: 1000\r\n\r\n")
+	assertNoErr(t, err)
+	assertStrEqual(t, string(r.Body), "")
+	assertStrEqual(t, r.Headers.Get("content-length"), "1000")
+}
+
+func TestMalformedStatusLine(t *testing.T) {
+	for _, statusLine := range []string{"HTTP/1.1", "HTTP/1.1 ", "HTTP/1.1 2000 OK", "HTTP/1.1 -10 OK", "200 OK", ""} {
+		_, err := fetchRawResponseForTest(t, "GET", ResponseLimits{}, statusLine+"\r\nContent-Length: 0\r\n\r\n")
+		if err == nil || !strings.Contains(err.Error(), "malformed") {
+			t.Errorf("expected error for status line %q, got %v", statusLine, err)
+		}
+	}
+
+	// the reason phrase is optional
+	r, err := fetchRawResponseForTest(t, "GET", ResponseLimits{}, "HTTP/1.1 204\r\n\r\n")
+	assertNoErr(t, err)
+	assertIntEqual(t, r.Status, 204)
+	assertStrEqual(t, r.StatusExplanation, "")
+}
+
+func TestResponseLimits(t *testing.T) {
+	limits := ResponseLimits{MaxLineLength: 30, MaxHeaderFields: 2, MaxHeaderBytes: 70, MaxBodyLength: 5}
+
+	testCases := []struct {
+		response string
+		limit    ResponseLimit
+	}{
+		{"HTTP/1.1 200 OK\r\nX-Long: 0123456789abcdef0123456789\r\n\r\n", LIMIT_LINE_LENGTH},
+		{"HTTP/1.1 200 OK\r\nX-Endless: " + strings.Repeat("a", 10000), LIMIT_LINE_LENGTH},
+		{"HTTP/1.1 200 OK\r\nA: 1\r\nB: 2\r\nC: 3\r\n\r\n", LIMIT_HEADER_FIELDS},
+		{"HTTP/1.1 200 OK\r\nA: 0123456789abcdef012345\r\nB: 0123456789abcdef012345\r\n\r\n", LIMIT_HEADER_BYTES},
+		{strings.Repeat("HTTP/1.1 100 Continue\r\n\r\n", 5), LIMIT_HEADER_BYTES},
+		{"HTTP/1.1 200 OK\r\nContent-Length: 6\r\n\r\nHello!", LIMIT_BODY_LENGTH},
+		{"HTTP/1.1 200 OK\r\nContent-Length: 99999999999\r\n\r\n", LIMIT_BODY_LENGTH},
+		{"HTTP/1.1 200 OK\r\nConnection: close\r\n\r\nHello!", LIMIT_BODY_LENGTH},
+		{"HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\n3\r\nabc\r\n3\r\ndef\r\n0\r\n\r\n", LIMIT_BODY_LENGTH},
+		{"HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\n3" + strings.Repeat(" ", 30) + "\r\nabc\r\n0\r\n\r\n", LIMIT_LINE_LENGTH},
+		{"HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\n0\r\nA: 1\r\nB: 2\r\nC: 3\r\n\r\n", LIMIT_HEADER_FIELDS},
+	}
+
+	for _, testCase := range testCases {
+		_, err := fetchRawResponseForTest(t, "GET", limits, testCase.response)
+		var limitErr *LimitError
+		if !errors.As(err, &limitErr) || limitErr.Limit != testCase.limit {
+			t.Errorf("expected %s limit to be exceeded for %q, got %v", testCase.limit, testCase.response, err)
+		}
+	}
+
+	// right up to the limits is fine
+	response := "HTTP/1.1 200 OK\r\nContent-Length: 5\r\n\r\nHello"
+	r, err := fetchRawResponseForTest(t, "GET", limits, response)
+	assertNoErr(t, err)
+	assertStrEqual(t, string(r.Body), "Hello")
+}
+
+func TestCompressedBodyLimit(t *testing.T) {
+	// a few hundred bytes that decompress to a megabyte
+	var bomb bytes.Buffer
+	gzipWriter := gzip.NewWriter(&bomb)
+	gzipWriter.Write(make([]byte, 1024*1024))
+	gzipWriter.Close()
+
+	server := launchRawServer(t,
+		fmt.Sprintf("HTTP/1.1 200 OK\r\nContent-Encoding: gzip\r\nContent-Length: %d\r\n\r\n%s", bomb.Len(), bomb.String()),
+	)
+	defer server.Cleanup()
+
+	url, err := ParseUrl(fmt.Sprintf("http://localhost:%d/", server.Port))
+	assertNoErr(t, err)
+
+	fetcher := NewUrlFetcher()
+	fetcher.Limits.MaxBodyLength = 64 * 1024
+	defer fetcher.Cleanup()
+
+	_, err = fetcher.Fetch(url)
+	var limitErr *LimitError
+	if !errors.As(err, &limitErr) || limitErr.Limit != LIMIT_BODY_LENGTH {
+		t.Errorf("expected body length limit to be exceeded, got %v", err)
+	}
+}
+
+// The response parser must never panic or exceed its limits, whatever the server sends.
+func FuzzReadHttpResponse(f *testing.F) {
+	f.Add("HTTP/1.1 200 OK\r\nContent-Length: 5\r\n\r\nHello")
+	f.Add("HTTP/1.1 100 Continue\r\n\r\nHTTP/1.1 204 No Content\r\nX-Folded: a\r\n b\r\n\r\n")
+	f.Add("HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\n5;ext=1\r\nHello\r\n0\r\nTrailer: x\r\n\r\n")
+	f.Add("HTTP/1.0 200\r\nContent-Encoding: gzip\r\n\r\n\x1f\x8b\x08\x00")
+	f.Add("HTTP/1.1 200 OK\r\nContent-Encoding: deflate, gzip\r\nContent-Length: 1, 1\r\n\r\nx")
+	f.Add("HTTP/1.1\r\n\r\n")
+
+	limits := ResponseLimits{MaxLineLength: 100, MaxHeaderFields: 10, MaxHeaderBytes: 500, MaxBodyLength: 1000}
+	f.Fuzz(func(t *testing.T, input string) {
+		reader := bufio.NewReader(strings.NewReader(input))
+		r, err := readHttpResponseHead(reader, limits)
+		if err != nil {
+			return
+		}
+		// the same readers that `httpBody` reads through, without a connection underneath
+		body, err := openHttpResponseBody(reader, r, "GET", limits)
+		if err != nil {
+			return
+		}
+		r.Body, err = io.ReadAll(body)
+		if err != nil {
+			return
+		}
+		if len(r.Body) > limits.MaxBodyLength {
+			t.Errorf("body of %d bytes is over the limit", len(r.Body))
+		}
+		if len(r.Headers) > limits.MaxHeaderFields*2 {
+			// trailers have a limit of their own
+			t.Errorf("%d header fields is over the limit", len(r.Headers))
+		}
+		if r.Status < 100 || r.Status > 999 {
+			t.Errorf("invalid status: %d", r.Status)
+		}
+	})
+}
+
+func TestStaleConnectionIsRetried(t *testing.T) {
+	server, connections := launchGoServer(t, func(server *http.Server) {
+		// the server closes idle connections long before the fetcher gives up on them
+		server.IdleTimeout = 50 * time.Millisecond
+	})
+	defer server.Close()
+
+	url, err := ParseUrl(server.URL)
+	assertNoErr(t, err)
+
+	fetcher := NewUrlFetcher()
+	defer fetcher.Cleanup()
+
+	r, err := fetcher.Fetch(url)
+	assertNoErr(t, err)
+	assertStrEqual(t, string(r.GetBody()), "Hello from Go")
+
+	time.Sleep(200 * time.Millisecond)
+
+	r, err = fetcher.Fetch(url)
+	assertNoErr(t, err)
+	assertStrEqual(t, string(r.GetBody()), "Hello from Go")
+	assertIntEqual(t, int(connections.Load()), 2)
+}
+
+func TestIdleConnectionsAreEvicted(t *testing.T) {
+	server, connections := launchGoServer(t, nil)
+	defer server.Close()
+
+	url, err := ParseUrl(server.URL)
+	assertNoErr(t, err)
+
+	fetcher := NewUrlFetcher()
+	fetcher.IdleTimeout = 20 * time.Millisecond
+	defer fetcher.Cleanup()
+
+	_, err = fetcher.Fetch(url)
+	assertNoErr(t, err)
+	_, err = fetcher.Fetch(url)
+	assertNoErr(t, err)
+	assertIntEqual(t, int(connections.Load()), 1)
+
+	time.Sleep(50 * time.Millisecond)
+
+	address := net.JoinHostPort(url.Host, fmt.Sprintf("%d", url.Port))
+	_, reused, err := fetcher.openConnection(context.Background(), connRoute{address: address})
+	assertNoErr(t, err)
+	if reused {
+		t.Errorf("expected idle connection to have been evicted")
+	}
+}
+
+func TestMaxConnsPerHost(t *testing.T) {
+	server, _ := launchGoServer(t, nil)
+	defer server.Close()
+
+	url, err := ParseUrl(server.URL)
+	assertNoErr(t, err)
+	address := net.JoinHostPort(url.Host, fmt.Sprintf("%d", url.Port))
+
+	fetcher := NewUrlFetcher()
+	fetcher.MaxConnsPerHost = 2
+	defer fetcher.Cleanup()
+
+	c1, _, err := fetcher.openConnection(context.Background(), connRoute{address: address})
+	assertNoErr(t, err)
+	c2, _, err := fetcher.openConnection(context.Background(), connRoute{address: address})
+	assertNoErr(t, err)
+
+	// a third checkout has to wait until one of the first two is checked back in
+	checkedOut := make(chan *httpConn)
+	go func() {
+		c, _, err := fetcher.openConnection(context.Background(), connRoute{address: address})
+		if err != nil {
+			t.Errorf("unexpected error: %s", err.Error())
+		}
+		checkedOut <- c
+	}()
+
+	select {
+	case <-checkedOut:
+		t.Fatalf("expected third connection to wait")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	fetcher.releaseConnection(address, c2)
+	c3 := <-checkedOut
+	if c3 != c2 {
+		t.Errorf("expected released connection to be reused")
+	}
+
+	fetcher.closeConnection(address, c1)
+	fetcher.releaseConnection(address, c3)
+	assertIntEqual(t, len(fetcher.conns.idle[address]), 1)
+}
+
+func TestFetchAll(t *testing.T) {
+	var inFlight atomic.Int32
+	var maxInFlight atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := inFlight.Add(1)
+		defer inFlight.Add(-1)
+		for {
+			m := maxInFlight.Load()
+			if n <= m || maxInFlight.CompareAndSwap(m, n) {
+				break
+			}
+		}
+
+		time.Sleep(20 * time.Millisecond)
+		fmt.Fprint(w, r.URL.Path)
+	}))
+	defer server.Close()
+
+	fetcher := NewUrlFetcher()
+	fetcher.MaxConnsPerHost = 2
+	defer fetcher.Cleanup()
+
+	urls := []Url{}
+	for i := 0; i < 8; i++ {
+		url, err := ParseUrl(fmt.Sprintf("%s/%d", server.URL, i))
+		assertNoErr(t, err)
+		urls = append(urls, url)
+	}
+	badUrl, err := ParseUrl("http://localhost:1/")
+	assertNoErr(t, err)
+	urls = append(urls, badUrl)
+
+	results := fetcher.FetchAll(urls)
+	assertIntEqual(t, len(results), len(urls))
+	for i := 0; i < 8; i++ {
+		assertNoErr(t, results[i].Err)
+		assertStrEqual(t, string(results[i].Response.GetBody()), fmt.Sprintf("/%d", i))
+	}
+	if results[8].Err == nil {
+		t.Errorf("expected error fetching from closed port")
+	}
+
+	if maxInFlight.Load() > 2 {
+		t.Errorf("expected at most 2 concurrent requests, got %d", maxInFlight.Load())
+	}
+	assertIntEqual(t, len(fetcher.conns.idle[strings.TrimPrefix(server.URL, "http://")]), 2)
+}
+
+func TestTimeouts(t *testing.T) {
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow-body" {
+			w.Header().Set("Content-Length", "100")
+			w.Write([]byte("partial"))
+			w.(http.Flusher).Flush()
+		}
+		<-release
+	}))
+	defer server.Close()
+	defer close(release)
+
+	fetcher := NewUrlFetcher()
+	fetcher.HeaderTimeout = 50 * time.Millisecond
+	fetcher.BodyTimeout = 50 * time.Millisecond
+	defer fetcher.Cleanup()
+
+	url, err := ParseUrl(server.URL + "/slow-headers")
+	assertNoErr(t, err)
+	_, err = fetcher.Fetch(url)
+	var timeoutErr *TimeoutError
+	if !errors.As(err, &timeoutErr) {
+		t.Fatalf("expected TimeoutError, got %v", err)
+	}
+	assertStrEqual(t, string(timeoutErr.Phase), string(TIMEOUT_HEADERS))
+
+	url, err = ParseUrl(server.URL + "/slow-body")
+	assertNoErr(t, err)
+	_, err = fetcher.Fetch(url)
+	if !errors.As(err, &timeoutErr) {
+		t.Fatalf("expected TimeoutError, got %v", err)
+	}
+	assertStrEqual(t, string(timeoutErr.Phase), string(TIMEOUT_BODY))
+}
+
+func TestTlsHandshakeTimeout(t *testing.T) {
+	// accepts connections but never says anything, so the handshake can't complete
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assertNoErr(t, err)
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	url, err := ParseUrl(fmt.Sprintf("https://127.0.0.1:%d/", listener.Addr().(*net.TCPAddr).Port))
+	assertNoErr(t, err)
+
+	fetcher := NewUrlFetcher()
+	fetcher.TlsHandshakeTimeout = 50 * time.Millisecond
+	defer fetcher.Cleanup()
+
+	_, err = fetcher.Fetch(url)
+	var timeoutErr *TimeoutError
+	if !errors.As(err, &timeoutErr) {
+		t.Fatalf("expected TimeoutError, got %v", err)
+	}
+	assertStrEqual(t, string(timeoutErr.Phase), string(TIMEOUT_TLS_HANDSHAKE))
+}
+
+func TestFetchContextCancellation(t *testing.T) {
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer server.Close()
+	defer close(release)
+
+	url, err := ParseUrl(server.URL)
+	assertNoErr(t, err)
+
+	fetcher := NewUrlFetcher()
+	defer fetcher.Cleanup()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		cancel()
+	}()
+
+	start := time.Now()
+	_, err = fetcher.FetchContext(ctx, url)
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+	if time.Since(start) > time.Second {
+		t.Errorf("cancellation took too long: %s", time.Since(start))
+	}
+
+	ctx, cancel = context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err = fetcher.FetchContext(ctx, url)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected context.DeadlineExceeded, got %v", err)
+	}
+	var timeoutErr *TimeoutError
+	if errors.As(err, &timeoutErr) {
+		t.Errorf("context deadline should not be reported as a TimeoutError")
+	}
+}
+
+// sends `response` from a raw server in answer to a single request, and returns what the fetcher made of it
+func fetchRawResponseForTest(t *testing.T, method string, limits ResponseLimits, response string) (*HttpResponse, error) {
+	t.Helper()
+	server := launchRawServer(t, response)
+	defer server.Cleanup()
+
+	fetcher := NewUrlFetcher()
+	fetcher.Limits = limits
+	defer fetcher.Cleanup()
+
+	url, err := ParseUrl(fmt.Sprintf("http://localhost:%d/", server.Port))
+	assertNoErr(t, err)
+	r, err := fetcher.FetchRequest(context.Background(), NewRequest(method, url, nil))
+	if err != nil {
+		return nil, err
+	}
+	return r.(*HttpResponse), nil
+}
+
+// fetches `urlString`, which must be an http: or https: URL, failing the test on error
+func fetchHttpForTest(t *testing.T, fetcher *UrlFetcher, urlString string) *HttpResponse {
+	t.Helper()
+	url, err := ParseUrl(urlString)
+	assertNoErr(t, err)
+	r, err := fetcher.Fetch(url)
+	assertNoErr(t, err)
+	return r.(*HttpResponse)
+}
+
+// launches an in-process HTTP server and returns it along with a count of the connections it has accepted
+//
+// `configure`, if not nil, is called before the server starts
+func launchGoServer(t *testing.T, configure func(*http.Server)) (*httptest.Server, *atomic.Int32) {
+	t.Helper()
+	var connections atomic.Int32
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "Hello from Go")
+	}))
+	server.Config.ConnState = func(conn net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			connections.Add(1)
+		}
+	}
+	if configure != nil {
+		configure(server.Config)
+	}
+	server.Start()
+	return server, &connections
+}
+
+// A server that answers each request with the next of a fixed list of responses, written to the socket verbatim, so
+// that tests have full control over the bytes on the wire. The server closes the connection after a response that
+// asks for it (HTTP/1.0 or `Connection: close`), as a real server would.
+type RawTestServer struct {
+	Port        int
+	listener    net.Listener
+	mu          sync.Mutex
+	responses   []string
+	connections int
+}
+
+func launchRawServer(t *testing.T, responses ...string) *RawTestServer {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assertNoErr(t, err)
+
+	server := &RawTestServer{Port: listener.Addr().(*net.TCPAddr).Port, listener: listener, responses: responses}
+	go server.serve()
+	return server
+}
+
+func (server *RawTestServer) serve() {
+	for {
+		conn, err := server.listener.Accept()
+		if err != nil {
+			return
+		}
+
+		server.mu.Lock()
+		server.connections++
+		server.mu.Unlock()
+
+		go server.handle(conn)
+	}
+}
+
+func (server *RawTestServer) handle(conn net.Conn) {
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	for {
+		// read and discard the request headers
+		for {
+			line, err := reader.ReadString('\n')
+			if err != nil {
+				return
+			}
+			if line == "\r\n" {
+				break
+			}
+		}
+
+		server.mu.Lock()
+		if len(server.responses) == 0 {
+			server.mu.Unlock()
+			return
+		}
+		response := server.responses[0]
+		server.responses = server.responses[1:]
+		server.mu.Unlock()
+
+		_, err := conn.Write([]byte(response))
+		if err != nil {
+			return
+		}
+
+		lowered := strings.ToLower(response)
+		if strings.HasPrefix(lowered, "http/1.0") || strings.Contains(lowered, "\r\nconnection: close\r\n") {
+			return
+		}
+	}
+}
+
+func (server *RawTestServer) ConnectionCount() int {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	return server.connections
+}
+
+func (server *RawTestServer) Cleanup() {
+	server.listener.Close()
 }
 
 type TestServer struct {
@@ -1,28 +1,31 @@
 package internal
 
 import (
+	"encoding/base64"
 	"errors"
 	"fmt"
+	"net"
 	"regexp"
 	"strconv"
 	"strings"
 )
 
 type Url struct {
-	Original   string
-	Scheme     string
-	Host       string
-	Port       int
-	Path       string
-	MimeType   MimeType // only for 'data:' URLs
-	ViewSource bool
-}
-
-type MimeType struct {
-	Type           string
-	Subtype        string
-	ParameterName  string
-	ParameterValue string
+	Original string
+	Scheme   string
+	Username string
+	Password string
+	Host     string // IPv6 addresses are stored without the surrounding brackets
+	Port     int
+	Path     string
+	Query    string // without the leading '?'
+	Fragment string // without the leading '#'
+	// whether the URL had a '?' or '#' at all, since an empty query or fragment is still part of the URL
+	HasQuery    bool
+	HasFragment bool
+	MimeType    MimeType // only for 'data:' URLs
+	Base64      bool     // only for 'data:' URLs
+	ViewSource  bool
 }
 
 func (url Url) PortOrDefault() int {
@@ -43,12 +46,13 @@ func checkUrlScheme(scheme string) bool {
 }
 
 func ParseUrl(text string) (Url, error) {
-	parts := strings.SplitN(text, ":", 2)
+	rest, viewSource := trimPrefix(stripUrlWhitespace(text), "view-source:")
+	parts := strings.SplitN(rest, ":", 2)
 	if len(parts) != 2 {
 		return Url{}, fmt.Errorf("invalid URL: expected colon")
 	}
 	scheme := strings.ToLower(parts[0])
-	rest := parts[1]
+	rest = parts[1]
 
 	if scheme == "data" {
 		return parseDataUrl(rest)
@@ -56,78 +60,504 @@ func ParseUrl(text string) (Url, error) {
 		return parseAboutUrl(rest)
 	}
 
-	rest = strings.TrimPrefix(rest, "//")
-
-	scheme, viewSource := trimPrefix(scheme, "view-source:")
 	if !checkUrlScheme(scheme) {
 		return Url{}, fmt.Errorf("not a supported URL schema: %q", scheme)
 	}
 
-	var host string
-	var path string
-	if strings.Contains(rest, "/") {
-		parts = strings.SplitN(rest, "/", 2)
-		host = parts[0]
-		path = "/" + parts[1]
-	} else {
-		host = rest
+	rest = strings.TrimPrefix(rest, "//")
+
+	authorityEnd := strings.IndexAny(rest, "/?#")
+	if authorityEnd == -1 {
+		authorityEnd = len(rest)
+	}
+	authority := rest[:authorityEnd]
+	path, query, fragment := splitPathQueryFragment(rest[authorityEnd:])
+	if path == "" {
 		path = "/"
 	}
 
-	port := 0
-	var err error
-	if strings.Contains(host, ":") {
-		parts = strings.SplitN(host, ":", 2)
-		host = parts[0]
-		port, err = strconv.Atoi(parts[1])
+	url := Url{
+		Original:    text,
+		Scheme:      scheme,
+		Path:        percentEncode(path, isPathPercentEncoded),
+		Query:       percentEncode(strings.TrimPrefix(query, "?"), isSpecialQueryPercentEncoded),
+		Fragment:    percentEncode(strings.TrimPrefix(fragment, "#"), isFragmentPercentEncoded),
+		HasQuery:    query != "",
+		HasFragment: fragment != "",
+		ViewSource:  viewSource,
+	}
+
+	err := url.parseAuthority(authority)
+	if err != nil {
+		return Url{}, err
+	}
+	// WHATWG URL standard, "file host state": "localhost" is the same as no host at all
+	if scheme == "file" && url.Host == "localhost" {
+		url.Host = ""
+	}
+
+	return url, nil
+}
+
+// parses "user:password@host:port", where everything but the host is optional
+func (url *Url) parseAuthority(authority string) error {
+	if i := strings.LastIndex(authority, "@"); i != -1 {
+		userinfo := authority[:i]
+		authority = authority[i+1:]
+
+		parts := strings.SplitN(userinfo, ":", 2)
+		url.Username = percentEncode(parts[0], isUserinfoPercentEncoded)
+		if len(parts) == 2 {
+			url.Password = percentEncode(parts[1], isUserinfoPercentEncoded)
+		}
+	}
+
+	host := authority
+	portStr := ""
+	if strings.HasPrefix(authority, "[") {
+		end := strings.Index(authority, "]")
+		if end == -1 {
+			return fmt.Errorf("invalid URL: missing closing bracket in IPv6 host: %q", authority)
+		}
+		host = authority[1:end]
+		if net.ParseIP(host) == nil || !strings.Contains(host, ":") {
+			return fmt.Errorf("invalid URL: not an IPv6 address: %q", host)
+		}
+
+		after := authority[end+1:]
+		if after != "" {
+			if !strings.HasPrefix(after, ":") {
+				return fmt.Errorf("invalid URL: unexpected characters after IPv6 host: %q", after)
+			}
+			portStr = after[1:]
+		}
+	} else if i := strings.LastIndex(authority, ":"); i != -1 {
+		host = authority[:i]
+		portStr = authority[i+1:]
+	}
+
+	if portStr != "" {
+		port, err := strconv.Atoi(portStr)
 		if err != nil {
-			return Url{}, err
+			return fmt.Errorf("invalid URL: could not parse port as integer: %q", portStr)
+		}
+		if port <= 0 || port > 65535 {
+			return fmt.Errorf("invalid URL: port out of range: %d", port)
+		}
+		url.Port = port
+	}
+
+	if strings.Contains(host, ":") {
+		url.Host = strings.ToLower(host)
+		return nil
+	}
+
+	// WHATWG URL standard: hosts are percent-decoded before IDNA processing
+	host = percentDecode(host)
+	if i := strings.IndexAny(host, FORBIDDEN_HOST_CHARS); i != -1 {
+		return fmt.Errorf("invalid URL: forbidden character %q in host %q", host[i], host)
+	}
+
+	asciiHost, err := hostToAscii(host)
+	if err != nil {
+		return err
+	}
+	url.Host = asciiHost
+	return nil
+}
+
+// FilePath returns the local filesystem path for a 'file:' URL, with percent escapes decoded.
+func (url Url) FilePath() string {
+	return percentDecode(url.Path)
+}
+
+// String returns the canonical serialization of the URL, which can be passed back to `ParseUrl`.
+func (url Url) String() string {
+	var sb strings.Builder
+	if url.ViewSource {
+		sb.WriteString("view-source:")
+	}
+
+	sb.WriteString(url.Scheme)
+	sb.WriteString(":")
+
+	if url.Scheme == "data" {
+		sb.WriteString(url.MimeType.String())
+		if url.Base64 {
+			sb.WriteString(";base64")
+		}
+		sb.WriteString(",")
+		sb.WriteString(url.Path)
+		return sb.String()
+	} else if url.Scheme == "about" {
+		sb.WriteString(url.Path)
+		if url.HasQuery {
+			sb.WriteString("?")
+			sb.WriteString(url.Query)
+		}
+		return sb.String()
+	}
+
+	sb.WriteString("//")
+	if url.Username != "" || url.Password != "" {
+		sb.WriteString(url.Username)
+		if url.Password != "" {
+			sb.WriteString(":")
+			sb.WriteString(url.Password)
+		}
+		sb.WriteString("@")
+	}
+	sb.WriteString(url.hostAndPort())
+	sb.WriteString(url.requestTarget())
+	if url.HasFragment {
+		sb.WriteString("#")
+		sb.WriteString(url.Fragment)
+	}
+	return sb.String()
+}
+
+// Resolve interprets `ref` relative to `url`, following the reference resolution algorithm in RFC 3986,
+// section 5.2. `ref` may also be an absolute URL, in which case it is parsed as-is.
+func (url Url) Resolve(ref string) (Url, error) {
+	ref = stripUrlWhitespace(ref)
+	if hasUrlScheme(ref) {
+		return ParseUrl(ref)
+	}
+
+	if url.Scheme == "data" || url.Scheme == "about" {
+		return Url{}, fmt.Errorf("cannot resolve relative URL %q against %q", ref, url.Original)
+	}
+
+	if strings.HasPrefix(ref, "//") {
+		return ParseUrl(fmt.Sprintf("%s:%s", url.Scheme, ref))
+	}
+
+	refPath, refQuery, refFragment := splitPathQueryFragment(ref)
+	refPath = percentEncode(refPath, isPathPercentEncoded)
+	refQuery = percentEncode(refQuery, isSpecialQueryPercentEncoded)
+
+	resolved := url
+	resolved.Fragment = percentEncode(strings.TrimPrefix(refFragment, "#"), isFragmentPercentEncoded)
+	resolved.HasFragment = refFragment != ""
+	resolved.ViewSource = false
+	if refPath == "" {
+		if refQuery != "" {
+			resolved.Query = strings.TrimPrefix(refQuery, "?")
+			resolved.HasQuery = true
+		}
+	} else {
+		resolved.Query = strings.TrimPrefix(refQuery, "?")
+		resolved.HasQuery = refQuery != ""
+		if strings.HasPrefix(refPath, "/") {
+			resolved.Path = removeDotSegments(refPath)
+		} else {
+			resolved.Path = removeDotSegments(mergePaths(url.Path, refPath))
+		}
+	}
+
+	resolved.Original = resolved.String()
+	return resolved, nil
+}
+
+func (url Url) withoutFragment() Url {
+	url.Fragment = ""
+	url.HasFragment = false
+	return url
+}
+
+// Origin returns the scheme, host and port, e.g. "https://example.com:443". Two URLs are same-origin if their origins
+// are equal.
+func (url Url) Origin() string {
+	host := url.Host
+	if strings.Contains(host, ":") {
+		host = fmt.Sprintf("[%s]", host)
+	}
+	return fmt.Sprintf("%s://%s:%d", url.Scheme, host, url.PortOrDefault())
+}
+
+// the path and query, as sent in the request line of an HTTP request
+func (url Url) requestTarget() string {
+	if !url.HasQuery {
+		return url.Path
+	} else {
+		return fmt.Sprintf("%s?%s", url.Path, url.Query)
+	}
+}
+
+// RFC 9112, section 3.2.2: the form of the request target that is sent to a proxy
+func (url Url) absoluteRequestTarget() string {
+	return fmt.Sprintf("%s://%s%s", url.Scheme, url.hostAndPort(), url.requestTarget())
+}
+
+func (url Url) hostAndPort() string {
+	host := url.Host
+	if strings.Contains(host, ":") {
+		host = fmt.Sprintf("[%s]", host)
+	}
+
+	if url.Port == 0 {
+		return host
+	} else {
+		return fmt.Sprintf("%s:%d", host, url.Port)
+	}
+}
+
+// characters that may not appear in a (non-IPv6) host
+const FORBIDDEN_HOST_CHARS = "\x00\t\n\r #%/:<>?@[\\]^|"
+
+// WHATWG URL standard: leading and trailing C0 control characters and spaces are stripped, and tabs and newlines
+// are removed everywhere
+func stripUrlWhitespace(text string) string {
+	text = strings.TrimFunc(text, func(r rune) bool {
+		return r <= ' '
+	})
+	return strings.Map(func(r rune) rune {
+		if r == '\t' || r == '\n' || r == '\r' {
+			return -1
+		}
+		return r
+	}, text)
+}
+
+// The percent-encode sets from the WHATWG URL standard, section 1.3. Each is a superset of the previous one, except
+// that the fragment set branches off from the C0 control set.
+
+func isC0ControlPercentEncoded(b byte) bool {
+	return b < 0x20 || b > 0x7e
+}
+
+func isFragmentPercentEncoded(b byte) bool {
+	return isC0ControlPercentEncoded(b) || b == ' ' || b == '"' || b == '<' || b == '>' || b == '`'
+}
+
+func isQueryPercentEncoded(b byte) bool {
+	return isC0ControlPercentEncoded(b) || b == ' ' || b == '"' || b == '#' || b == '<' || b == '>'
+}
+
+// http, https and file are all "special" schemes, so this is the set we use for queries
+func isSpecialQueryPercentEncoded(b byte) bool {
+	return isQueryPercentEncoded(b) || b == '\''
+}
+
+func isPathPercentEncoded(b byte) bool {
+	return isQueryPercentEncoded(b) || b == '?' || b == '^' || b == '`' || b == '{' || b == '}'
+}
+
+func isUserinfoPercentEncoded(b byte) bool {
+	return isPathPercentEncoded(b) || strings.IndexByte("/:;=@[\\]|", b) != -1
+}
+
+// existing percent escapes are left alone, so encoding an already-encoded string is a no-op
+func percentEncode(text string, shouldEncode func(byte) bool) string {
+	var sb strings.Builder
+	for i := 0; i < len(text); i++ {
+		b := text[i]
+		if shouldEncode(b) {
+			sb.WriteString(fmt.Sprintf("%%%02X", b))
+		} else {
+			sb.WriteByte(b)
 		}
 	}
+	return sb.String()
+}
+
+// malformed escapes (e.g., "%zz" or a trailing "%") are passed through unchanged, as in the WHATWG URL standard
+func percentDecode(text string) string {
+	if !strings.Contains(text, "%") {
+		return text
+	}
 
-	return Url{Original: text, Scheme: scheme, Host: strings.ToLower(host), Port: port, Path: path, ViewSource: viewSource}, nil
+	var buf []byte
+	for i := 0; i < len(text); i++ {
+		b := text[i]
+		if b == '%' && i+2 < len(text) && isHexDigit(text[i+1]) && isHexDigit(text[i+2]) {
+			buf = append(buf, unhex(text[i+1])<<4|unhex(text[i+2]))
+			i += 2
+		} else {
+			buf = append(buf, b)
+		}
+	}
+	return string(buf)
 }
 
+func isHexDigit(b byte) bool {
+	return ('0' <= b && b <= '9') || ('a' <= b && b <= 'f') || ('A' <= b && b <= 'F')
+}
+
+func unhex(b byte) byte {
+	switch {
+	case '0' <= b && b <= '9':
+		return b - '0'
+	case 'a' <= b && b <= 'f':
+		return b - 'a' + 10
+	default:
+		return b - 'A' + 10
+	}
+}
+
+var URL_SCHEME_PATTERN = regexp.MustCompile("^[A-Za-z][A-Za-z0-9+.-]*:")
+
+func hasUrlScheme(text string) bool {
+	return URL_SCHEME_PATTERN.MatchString(text)
+}
+
+// splits a path like "/a/b?x=1#sec" into "/a/b", "?x=1" and "#sec"
+//
+// the query and fragment retain their leading delimiters so that an empty query ("/a?") can be distinguished from
+// a missing one
+func splitPathQueryFragment(text string) (string, string, string) {
+	fragment := ""
+	if i := strings.Index(text, "#"); i != -1 {
+		fragment = text[i:]
+		text = text[:i]
+	}
+
+	query := ""
+	if i := strings.Index(text, "?"); i != -1 {
+		query = text[i:]
+		text = text[:i]
+	}
+
+	return text, query, fragment
+}
+
+// RFC 3986, section 5.2.3
+func mergePaths(basePath string, refPath string) string {
+	if basePath == "" {
+		return "/" + refPath
+	}
+
+	i := strings.LastIndex(basePath, "/")
+	return basePath[:i+1] + refPath
+}
+
+// RFC 3986, section 5.2.4
+func removeDotSegments(path string) string {
+	output := []string{}
+	segments := strings.Split(path, "/")
+	for i, segment := range segments {
+		isLast := i == len(segments)-1
+		if segment == "." {
+			if isLast {
+				output = append(output, "")
+			}
+		} else if segment == ".." {
+			// never pop the empty segment that represents the leading slash
+			if len(output) > 1 {
+				output = output[:len(output)-1]
+			}
+			if isLast {
+				output = append(output, "")
+			}
+		} else {
+			output = append(output, segment)
+		}
+	}
+
+	result := strings.Join(output, "/")
+	if strings.HasPrefix(path, "/") && !strings.HasPrefix(result, "/") {
+		result = "/" + result
+	}
+	return result
+}
+
+// 'data:' URLs are parsed following the "data: URL processor" algorithm from the WHATWG Fetch standard, section 4.2.
+// The payload is kept as-is in `Path`; use `DecodeDataUrl` to get the actual bytes.
 func parseDataUrl(rest string) (Url, error) {
-	parts := strings.SplitN(rest, ",", 2)
-	if len(parts) != 2 {
+	original := fmt.Sprintf("data:%s", rest)
+	rest = strings.Trim(rest, ASCII_WHITESPACE)
+	comma := strings.Index(rest, ",")
+	if comma == -1 {
 		return Url{}, errors.New("missing comma in 'data:' URL")
 	}
 
-	var mimeType MimeType
-	if parts[0] != "" {
-		var err error
-		mimeType, err = parseMimeType(parts[0])
+	mimeTypeText := strings.Trim(rest[:comma], ASCII_WHITESPACE)
+	payload := rest[comma+1:]
+
+	mimeTypeText, isBase64 := trimBase64Marker(mimeTypeText)
+	if strings.HasPrefix(mimeTypeText, ";") {
+		mimeTypeText = "text/plain" + mimeTypeText
+	}
+
+	mimeType, err := parseMimeType(mimeTypeText)
+	if err != nil {
+		// MDN: "If omitted, defaults to text/plain;charset=US-ASCII"
+		// https://developer.mozilla.org/en-US/docs/Web/HTTP/Basics_of_HTTP/Data_URLs
+		mimeType = MimeType{Type: "text", Subtype: "plain", Parameters: []MimeTypeParameter{{Name: "charset", Value: "US-ASCII"}}}
+	}
+
+	url := Url{Original: original, Scheme: "data", Host: "", Port: 0, Path: payload, MimeType: mimeType, Base64: isBase64}
+	if isBase64 {
+		// fail early rather than when the URL is fetched
+		_, err = DecodeDataUrl(url)
 		if err != nil {
 			return Url{}, err
 		}
-	} else {
-		// MDN: "If omitted, defaults to text/plain;charset=US-ASCII"
-		// https://developer.mozilla.org/en-US/docs/Web/HTTP/Basics_of_HTTP/Data_URLs
-		mimeType = MimeType{Type: "text", Subtype: "plain", ParameterName: "charset", ParameterValue: "US-ASCII"}
+	}
+	return url, nil
+}
+
+// strips a trailing ";base64" (with optional spaces after the semicolon) from the MIME type portion of a 'data:' URL
+func trimBase64Marker(mimeTypeText string) (string, bool) {
+	if len(mimeTypeText) < len("base64") || !strings.EqualFold(mimeTypeText[len(mimeTypeText)-6:], "base64") {
+		return mimeTypeText, false
 	}
 
-	// TODO: support full 'data:' URL specification
-	// https://developer.mozilla.org/en-US/docs/Web/HTTP/Basics_of_HTTP/Data_URLs
-	return Url{Original: fmt.Sprintf("data:%s", rest), Scheme: "data", Host: "", Port: 0, Path: parts[1], MimeType: mimeType}, nil
+	trimmed := strings.TrimRight(mimeTypeText[:len(mimeTypeText)-6], " ")
+	if !strings.HasSuffix(trimmed, ";") {
+		return mimeTypeText, false
+	}
+	return strings.Trim(trimmed[:len(trimmed)-1], ASCII_WHITESPACE), true
 }
 
-func parseAboutUrl(rest string) (Url, error) {
-	rest = strings.ToLower(rest)
-	if rest == "blank" {
-		return Url{Original: fmt.Sprintf("about:%s", rest), Scheme: "about", Host: "", Port: 0, Path: rest}, nil
+// DecodeDataUrl returns the payload of a 'data:' URL, percent-decoded and, if the URL is marked as base64,
+// base64-decoded.
+func DecodeDataUrl(url Url) ([]byte, error) {
+	data := []byte(percentDecode(url.Path))
+	if !url.Base64 {
+		return data, nil
 	}
-	return Url{}, errors.New("unknown `about:` scheme")
+
+	decoded, err := forgivingBase64Decode(string(data))
+	if err != nil {
+		return nil, fmt.Errorf("invalid base64 in 'data:' URL: %s", err.Error())
+	}
+	return decoded, nil
 }
 
-func parseMimeType(text string) (MimeType, error) {
-	// TODO: should only compile this regex once
-	chpat := "[A-Za-z0-9-]"
-	pat := regexp.MustCompile(fmt.Sprintf("^(%[1]s+)/(%[1]s+)(;(%[1]s+)=(%[1]s+))?$", chpat))
-	matches := pat.FindStringSubmatch(text)
-	if matches == nil {
-		return MimeType{}, fmt.Errorf("invalid MIME type: %q", text)
+// the "forgiving-base64 decode" algorithm from the WHATWG Infra standard: whitespace is ignored and padding is
+// optional
+func forgivingBase64Decode(text string) ([]byte, error) {
+	text = strings.Map(func(r rune) rune {
+		if strings.ContainsRune(ASCII_WHITESPACE, r) {
+			return -1
+		}
+		return r
+	}, text)
+
+	if len(text)%4 == 0 {
+		if strings.HasSuffix(text, "==") {
+			text = text[:len(text)-2]
+		} else if strings.HasSuffix(text, "=") {
+			text = text[:len(text)-1]
+		}
+	}
+
+	if len(text)%4 == 1 {
+		return nil, errors.New("invalid length")
 	}
 
-	return MimeType{Type: matches[1], Subtype: matches[2], ParameterName: matches[4], ParameterValue: matches[5]}, nil
+	return base64.RawStdEncoding.DecodeString(text)
+}
+
+// `about:page-info` takes the URL of the page to describe as its query, e.g., "about:page-info?https://example.com/"
+func parseAboutUrl(rest string) (Url, error) {
+	name, query, hasQuery := strings.Cut(rest, "?")
+	name = strings.ToLower(name)
+	if name == "blank" || name == "cookies" || name == "page-info" {
+		url := Url{Scheme: "about", Host: "", Port: 0, Path: name, Query: query, HasQuery: hasQuery}
+		url.Original = url.String()
+		return url, nil
+	}
+	return Url{}, errors.New("unknown `about:` scheme")
 }